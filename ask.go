@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"prompt-service-server/core"
+	"prompt-service-server/handlers"
+	"prompt-service-server/utils"
+	"strings"
+)
+
+// Exit codes of ask, so scripts can tell the outcomes apart.
+const (
+	exitAnswered    = 0
+	exitDeclined    = 1   // A confirm prompt was answered no
+	exitTimedOut    = 2   // Nobody answered in time
+	exitUnreachable = 3   // The server could not be reached or refused the prompt
+	exitUsage       = 64  // EX_USAGE of sysexits.h
+	exitInterrupted = 130 // Killed by SIGINT, as shells report it
+)
+
+// askRequest is the prompt ask posts.
+type askRequest struct {
+	PublicKey   string             `json:"public_key"`
+	Message     string             `json:"message"`
+	Input       *core.InputSpec    `json:"input,omitempty"`
+	Timeout     float64            `json:"timeout,omitempty"`
+	ProofOfWork *utils.ProofOfWork `json:"proof_of_work,omitempty"`
+}
+
+// askResponse is what the server answered a post with.
+type askResponse struct {
+	status      int
+	contentType string
+	body        []byte
+}
+
+// problem returns the problem+json code and detail of the response, or its
+// status text if it has none.
+func (r *askResponse) problem() (string, string) {
+	var problem struct {
+		Code   string `json:"code"`
+		Detail string `json:"detail"`
+	}
+	json.Unmarshal(r.body, &problem)
+	if problem.Detail == "" {
+		problem.Detail = http.StatusText(r.status)
+	}
+	return problem.Code, problem.Detail
+}
+
+// choices collects the repeated -choice flag.
+type choices []string
+
+func (c *choices) String() string {
+	return strings.Join(*c, ",")
+}
+
+func (c *choices) Set(value string) error {
+	*c = append(*c, value)
+	return nil
+}
+
+// runAsk posts a prompt and waits for the answer, so shell scripts can ask
+// a person instead of using read:
+//
+//	answer=$(prompt-service-server ask -to alice "Which branch?")
+//
+// The answer is printed to stdout and the outcome is the exit code.
+// Cancelling ctx cancels the prompt.
+func runAsk(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("ask", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	server := flags.String("server", envOr("PROMPT_SERVER", "http://localhost:8080"), "URL of the server, or unix:/path of its socket")
+	to := flags.String("to", os.Getenv("PROMPT_TO"), "Recipient: a public key, a file holding one, or an alias")
+	aliases := flags.String("aliases", os.Getenv("PROMPT_ALIASES"), "File of \"alias public-key\" lines (default <config dir>/prompt-service/aliases)")
+	var options choices
+	flags.Var(&options, "choice", "An answer to choose from, repeated for each")
+	confirm := flags.Bool("confirm", false, "Ask a yes or no question; no exits with 1")
+	timeout := flags.Duration("timeout", 0, "How long to wait for an answer, such as 10m (default the server's)")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: prompt-service-server ask -to <recipient> [flags] [message...]")
+		fmt.Fprintln(stderr, "The message is read from stdin if it is not given or is -.")
+		fmt.Fprintln(stderr, "Exits with 0 answered, 1 declined, 2 timed out, 3 unreachable, 64 usage.")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitAnswered
+		}
+		return exitUsage
+	}
+	usage := func(format string, args ...interface{}) int {
+		fmt.Fprintf(stderr, "ask: "+format+"\n", args...)
+		return exitUsage
+	}
+
+	message := strings.Join(flags.Args(), " ")
+	if flags.NArg() == 0 || message == "-" {
+		data, err := io.ReadAll(stdin)
+		if err != nil {
+			return usage("reading the message: %v", err)
+		}
+		message = strings.TrimRight(string(data), "\n")
+	}
+	if message == "" {
+		return usage("no message to ask")
+	}
+	if *to == "" {
+		return usage("-to is required")
+	}
+	key, err := resolveRecipient(*to, *aliases)
+	if err != nil {
+		return usage("%v", err)
+	}
+	if *confirm && len(options) > 0 {
+		return usage("-confirm and -choice can not be used together")
+	}
+	if *timeout < 0 {
+		return usage("-timeout must not be negative")
+	}
+
+	prompt := askRequest{PublicKey: key, Message: message, Timeout: timeout.Seconds()}
+	if *confirm {
+		prompt.Input = &core.InputSpec{Type: core.InputConfirm}
+	} else if len(options) > 0 {
+		prompt.Input = &core.InputSpec{Type: core.InputSingleChoice, Options: options}
+	}
+
+	client, base := askClient(*server)
+	res, err := postPrompt(ctx, client, base, prompt)
+	if err == nil && res.status == http.StatusForbidden {
+		// The recipient wants unsigned prompts to cost some work
+		if code, _ := res.problem(); code == handlers.CodeProofOfWorkRequired {
+			prompt.ProofOfWork, err = solveChallenge(ctx, client, base, key, message)
+			if err == nil {
+				res, err = postPrompt(ctx, client, base, prompt)
+			}
+		}
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			fmt.Fprintln(stderr, "ask: interrupted")
+			return exitInterrupted
+		}
+		fmt.Fprintf(stderr, "ask: %v\n", err)
+		return exitUnreachable
+	}
+	if res.status == http.StatusOK {
+		return printAnswer(stdout, res)
+	}
+	_, detail := res.problem()
+	fmt.Fprintf(stderr, "ask: %s\n", detail)
+	switch res.status {
+	case http.StatusRequestTimeout:
+		return exitTimedOut
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return exitUsage
+	default:
+		return exitUnreachable
+	}
+}
+
+// envOr returns the environment variable name, or value if it is not set.
+func envOr(name string, value string) string {
+	if v, ok := os.LookupEnv(name); ok {
+		return v
+	}
+	return value
+}
+
+// resolveRecipient returns the public key that to names: an alias from the
+// aliases file, a file holding the key, or the key itself.
+func resolveRecipient(to string, aliases string) (string, error) {
+	key := to
+	if aliased, err := lookupAlias(to, aliases); err != nil {
+		return "", err
+	} else if aliased != "" {
+		key = aliased
+	}
+	if data, err := os.ReadFile(key); err == nil {
+		key = strings.TrimSpace(string(data))
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != ed25519.PublicKeySize {
+		return "", fmt.Errorf("-to %q is not an alias, a key file or a public key", to)
+	}
+	return key, nil
+}
+
+// lookupAlias returns what name stands for in the aliases file, or "" if
+// it is not listed. Lines are an alias and a key or key file, and lines
+// starting with # are comments. A missing default file lists nothing.
+func lookupAlias(name string, path string) (string, error) {
+	explicit := path != ""
+	if !explicit {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return "", nil
+		}
+		path = filepath.Join(dir, "prompt-service", "aliases")
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("aliases: %w", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == name {
+			return fields[1], nil
+		}
+	}
+	return "", nil
+}
+
+// askClient returns a client for server and the base URL of the API.
+// Servers given as unix:/path are reached over that socket.
+func askClient(server string) (*http.Client, string) {
+	if path, ok := strings.CutPrefix(server, "unix:"); ok {
+		var dialer net.Dialer
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "unix", path)
+			},
+		}
+		return &http.Client{Transport: transport}, "http://localhost"
+	}
+	// No timeout, the post is held until the prompt is answered or expires
+	return &http.Client{}, strings.TrimRight(server, "/")
+}
+
+// postPrompt posts the prompt and waits for the server to answer.
+func postPrompt(ctx context.Context, client *http.Client, base string, prompt askRequest) (*askResponse, error) {
+	body, err := json.Marshal(prompt)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", base+"/api/prompts", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &askResponse{status: res.StatusCode, contentType: res.Header.Get("Content-Type"), body: data}, nil
+}
+
+// solveChallenge fetches a proof-of-work challenge for the recipient and
+// solves it for message, unless ctx is cancelled first.
+func solveChallenge(ctx context.Context, client *http.Client, base string, key string, message string) (*utils.ProofOfWork, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", base+"/api/challenge?recipient="+url.QueryEscape(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching a proof-of-work challenge: %s", res.Status)
+	}
+	var challenge struct {
+		Challenge  string `json:"challenge"`
+		Difficulty int    `json:"difficulty"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&challenge); err != nil {
+		return nil, fmt.Errorf("fetching a proof-of-work challenge: %w", err)
+	}
+	nonce, err := utils.SolveProofOfWork(ctx, challenge.Challenge, message, challenge.Difficulty)
+	if err != nil {
+		return nil, err
+	}
+	return &utils.ProofOfWork{Challenge: challenge.Challenge, Nonce: nonce}, nil
+}
+
+// printAnswer writes the answer to stdout the way a script wants to read
+// it: free text as it is, chosen options without JSON quotes, and other
+// JSON values compacted. Returns the exit code.
+func printAnswer(stdout io.Writer, res *askResponse) int {
+	if !strings.HasPrefix(res.contentType, "application/json") {
+		fmt.Fprintln(stdout, string(res.body))
+		return exitAnswered
+	}
+	var answer interface{}
+	if err := json.Unmarshal(res.body, &answer); err != nil {
+		fmt.Fprintln(stdout, string(res.body))
+		return exitAnswered
+	}
+	switch answer := answer.(type) {
+	case string:
+		fmt.Fprintln(stdout, answer)
+	case bool:
+		fmt.Fprintln(stdout, answer)
+		if !answer {
+			return exitDeclined
+		}
+	default:
+		var compact bytes.Buffer
+		json.Compact(&compact, res.body)
+		fmt.Fprintln(stdout, compact.String())
+	}
+	return exitAnswered
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"prompt-service-server/core"
+	"prompt-service-server/metrics"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// askResult is how an ask run ended.
+type askResult struct {
+	code   int
+	stdout string
+	stderr string
+}
+
+// runTestAsk runs ask with args and the message on stdin.
+func runTestAsk(ctx context.Context, stdin string, args ...string) askResult {
+	var stdout, stderr bytes.Buffer
+	code := runAsk(ctx, args, strings.NewReader(stdin), &stdout, &stderr)
+	return askResult{code, stdout.String(), stderr.String()}
+}
+
+// answerWhenAsked answers the next prompt for key once it arrives, and then
+// passes it on.
+func answerWhenAsked(t *testing.T, store *core.PromptStore, key string, response string) <-chan core.Prompt {
+	asked := make(chan core.Prompt, 1)
+	go func() {
+		defer close(asked)
+		for i := 0; i < 200; i++ {
+			for _, prompt := range store.PromptsFor(key) {
+				if prompt.IsPending() {
+					_, err := store.Answer(prompt.Id, key, response)
+					assert.NoError(t, err)
+					asked <- prompt
+					return
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Error("the prompt never arrived")
+	}()
+	return asked
+}
+
+func newTestKey(t *testing.T) string {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(pub)
+}
+
+func TestAsk(t *testing.T) {
+	app := NewApp(testConfig(), metrics.New(), nil)
+	server := httptest.NewServer(app.Router)
+	defer server.Close()
+	ctx := context.Background()
+
+	key := newTestKey(t)
+	answerWhenAsked(t, app.store, key, "main")
+	result := runTestAsk(ctx, "", "-server", server.URL, "-to", key, "Which", "branch?")
+	assert.Equal(t, exitAnswered, result.code, result.stderr)
+	assert.Equal(t, "main\n", result.stdout)
+
+	// The message is read from stdin, and choices come back unquoted
+	asked := answerWhenAsked(t, app.store, key, `"staging"`)
+	result = runTestAsk(ctx, "Deploy where?\n", "-server", server.URL, "-to", key, "-choice", "staging", "-choice", "production")
+	assert.Equal(t, exitAnswered, result.code, result.stderr)
+	assert.Equal(t, "staging\n", result.stdout)
+	prompt := <-asked
+	assert.Equal(t, "Deploy where?", prompt.Message)
+	assert.Equal(t, []string{"staging", "production"}, prompt.Input.Options)
+
+	answerWhenAsked(t, app.store, key, "false")
+	result = runTestAsk(ctx, "", "-server", server.URL, "-to", key, "-confirm", "Deploy?")
+	assert.Equal(t, exitDeclined, result.code, result.stderr)
+	assert.Equal(t, "false\n", result.stdout)
+
+	result = runTestAsk(ctx, "", "-server", server.URL, "-to", key, "-timeout", "50ms", "Anyone?")
+	assert.Equal(t, exitTimedOut, result.code)
+	assert.Contains(t, result.stderr, "Nobody answered in time")
+	assert.Empty(t, result.stdout)
+}
+
+func TestAsk_ProofOfWork(t *testing.T) {
+	app := NewApp(testConfig(), metrics.New(), nil)
+	server := httptest.NewServer(app.Router)
+	defer server.Close()
+
+	key := newTestKey(t)
+	require.NoError(t, app.store.SetSenderPolicy(key, core.SenderPolicy{Mode: core.SenderPolicyOpen, Difficulty: 4}))
+	answerWhenAsked(t, app.store, key, "ok")
+	result := runTestAsk(context.Background(), "", "-server", server.URL, "-to", key, "Costly?")
+	assert.Equal(t, exitAnswered, result.code, result.stderr)
+	assert.Equal(t, "ok\n", result.stdout)
+}
+
+func TestAsk_InterruptedProofOfWork(t *testing.T) {
+	app := NewApp(testConfig(), metrics.New(), nil)
+	server := httptest.NewServer(app.Router)
+	defer server.Close()
+
+	// Minutes of work, cut short by the interrupt
+	key := newTestKey(t)
+	require.NoError(t, app.store.SetSenderPolicy(key, core.SenderPolicy{Mode: core.SenderPolicyOpen, Difficulty: 32}))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	result := runTestAsk(ctx, "", "-server", server.URL, "-to", key, "Costly?")
+	assert.Equal(t, exitInterrupted, result.code, result.stderr)
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestAsk_UnixSocket(t *testing.T) {
+	app := NewApp(testConfig(), metrics.New(), nil)
+	path := filepath.Join(t.TempDir(), "api.sock")
+	listener, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	server := &http.Server{Handler: app.Router}
+	go server.Serve(listener)
+	defer server.Close()
+
+	key := newTestKey(t)
+	answerWhenAsked(t, app.store, key, "yes")
+	result := runTestAsk(context.Background(), "", "-server", "unix:"+path, "-to", key, "Over a socket?")
+	assert.Equal(t, exitAnswered, result.code, result.stderr)
+	assert.Equal(t, "yes\n", result.stdout)
+}
+
+func TestAsk_Errors(t *testing.T) {
+	ctx := context.Background()
+	key := newTestKey(t)
+	// Keep the aliases of whoever runs the tests out of it
+	aliases := filepath.Join(t.TempDir(), "aliases")
+	require.NoError(t, os.WriteFile(aliases, nil, 0600))
+	t.Setenv("PROMPT_ALIASES", aliases)
+
+	// Nothing listens here
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := "http://" + listener.Addr().String()
+	listener.Close()
+	result := runTestAsk(ctx, "", "-server", closed, "-to", key, "Hello?")
+	assert.Equal(t, exitUnreachable, result.code)
+
+	for name, args := range map[string][]string{
+		"no recipient":       {"Hello?"},
+		"bad recipient":      {"-to", "bob", "Hello?"},
+		"confirm and choice": {"-to", key, "-confirm", "-choice", "a", "Hello?"},
+		"negative timeout":   {"-to", key, "-timeout", "-1s", "Hello?"},
+		"unknown flag":       {"-to", key, "-loud", "Hello?"},
+		"no message":         {"-to", key},
+	} {
+		result := runTestAsk(ctx, "", append([]string{"-server", closed}, args...)...)
+		assert.Equal(t, exitUsage, result.code, name)
+	}
+
+	// Interrupting gives up on the prompt
+	app := NewApp(testConfig(), metrics.New(), nil)
+	server := httptest.NewServer(app.Router)
+	defer server.Close()
+	interrupt, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	result = runTestAsk(interrupt, "", "-server", server.URL, "-to", key, "Still there?")
+	assert.Equal(t, exitInterrupted, result.code)
+}
+
+func TestResolveRecipient(t *testing.T) {
+	dir := t.TempDir()
+	key := newTestKey(t)
+	keyFile := filepath.Join(dir, "alice.pub")
+	require.NoError(t, os.WriteFile(keyFile, []byte(key+"\n"), 0600))
+	aliases := filepath.Join(dir, "aliases")
+	require.NoError(t, os.WriteFile(aliases, []byte("# people\nalice "+keyFile+"\nbob "+key+"\n"), 0600))
+
+	for _, to := range []string{key, keyFile, "alice", "bob"} {
+		resolved, err := resolveRecipient(to, aliases)
+		require.NoError(t, err, to)
+		assert.Equal(t, key, resolved, to)
+	}
+	_, err := resolveRecipient("carol", aliases)
+	assert.Error(t, err)
+	_, err = resolveRecipient("alice", filepath.Join(dir, "missing"))
+	assert.Error(t, err, "a named aliases file must exist")
+}
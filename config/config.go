@@ -1,23 +1,328 @@
 package config
 
 import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
 	"os"
+	"strconv"
+	"strings"
 )
 
+// MinSecretLength is the shortest CSRF_TOKEN_SECRET accepted, in bytes.
+const MinSecretLength = 32
+
+// Config holds the server settings. Every setting has a flag, an
+// environment variable and a key in the config file, all named alike:
+// -prompt-timeout, PROMPT_TIMEOUT and prompt_timeout.
 type Config struct {
-	Port                   string
-	CSRFTokenExpirySeconds int
-	CSRFTokenSecret        string
-	MaxRequestBodySize     int64
-	AllowedOrigins         string
+	Port                    string `json:"port"`
+	Listen                  string `json:"listen"`        // Comma separated addresses to serve on, instead of Port
+	SocketMode              string `json:"socket_mode"`   // Permissions of Unix sockets, in octal
+	TLSCertFile             string `json:"tls_cert_file"` // HTTPS is served if set, with TLSKeyFile
+	TLSKeyFile              string `json:"tls_key_file"`
+	HTTPRedirectAddr        string `json:"http_redirect_addr"` // Redirects plain HTTP here to HTTPS on HTTPSPort, if set
+	CSRFTokenExpirySeconds  int    `json:"csrf_token_expiry"`
+	CSRFTokenSecret         string `json:"csrf_token_secret"`
+	CSRFKeyFile             string `json:"csrf_key_file"` // Generated signing keys are kept here
+	MaxRequestBodySize      int64  `json:"max_request_body_size"`
+	AllowedOrigins          string `json:"allowed_origins"`
+	StorageBackend          string `json:"storage_backend"` // "memory" (default) or "file"
+	StoragePath             string `json:"storage_path"`
+	PromptTimeoutSeconds    int    `json:"prompt_timeout"`
+	MaxPromptTimeoutSeconds int    `json:"prompt_timeout_max"`
+	ResultRetentionSeconds  int    `json:"result_retention"`
+	WebhookMaxAttempts      int    `json:"webhook_max_attempts"`
+	WebhookDeadLetterPath   string `json:"webhook_dead_letter_path"`
+	WebhookAllowPrivate     bool   `json:"webhook_allow_private"` // Deliver to loopback and private addresses too
+
+	// Prompt posting limits. A rate of zero disables that limit.
+	RateLimitIPPerMinute        int  `json:"rate_limit_ip"`
+	RateLimitIPBurst            int  `json:"rate_limit_ip_burst"`
+	RateLimitSenderPerMinute    int  `json:"rate_limit_sender"`
+	RateLimitSenderBurst        int  `json:"rate_limit_sender_burst"`
+	RateLimitRecipientPerMinute int  `json:"rate_limit_recipient"`
+	RateLimitRecipientBurst     int  `json:"rate_limit_recipient_burst"`
+	MaxPendingPerRecipient      int  `json:"max_pending_per_recipient"`
+	MaxRecipients               int  `json:"max_recipients"` // Recipients one prompt may have
+	TrustProxy                  bool `json:"trust_proxy"`    // Take the client IP from X-Forwarded-For
+
+	// /metrics is served on MetricsAddr if set, or on the main port if only
+	// MetricsToken is set. It is not served at all otherwise.
+	MetricsAddr  string `json:"metrics_addr"`
+	MetricsToken string `json:"metrics_token"` // Bearer token scrapers must send, if set
+
+	LogLevel     string `json:"log_level"` // debug, info, warn or error
+	AuditLogPath string `json:"audit_log"` // Audit events go to the main log if empty
+
+	ShutdownGraceSeconds int `json:"shutdown_grace"` // How long shutting down may take
 }
 
-func LoadConfig() *Config {
+// Default returns the built-in settings.
+func Default() *Config {
 	return &Config{
-		Port:                   os.Getenv("PORT"),
-		CSRFTokenExpirySeconds: 300, // 5 minutes
-		CSRFTokenSecret:        os.Getenv("CSRF_TOKEN_SECRET"),
-		MaxRequestBodySize:     10 * 1024 * 1024, // 10MB limit
-		AllowedOrigins:         os.Getenv("ALLOWED_ORIGINS"),
+		Port:                    "8080",
+		SocketMode:              "0660",
+		CSRFTokenExpirySeconds:  300,              // 5 minutes
+		MaxRequestBodySize:      10 * 1024 * 1024, // 10MB limit
+		PromptTimeoutSeconds:    3600,             // 1 hour
+		MaxPromptTimeoutSeconds: 86400,            // 24 hours
+		ResultRetentionSeconds:  3600,             // 1 hour
+		WebhookMaxAttempts:      8,
+
+		RateLimitIPPerMinute:        60,
+		RateLimitIPBurst:            30,
+		RateLimitSenderPerMinute:    60,
+		RateLimitSenderBurst:        30,
+		RateLimitRecipientPerMinute: 30,
+		RateLimitRecipientBurst:     30,
+		MaxPendingPerRecipient:      100,
+		MaxRecipients:               20,
+
+		LogLevel:             "info",
+		ShutdownGraceSeconds: 10,
+	}
+}
+
+// Load builds the config from, in increasing order of precedence, the
+// defaults, the JSON config file named by -config or CONFIG_FILE, the
+// environment and the command line flags in args. The result is validated.
+// It returns flag.ErrHelp if args ask for usage, which has then been
+// printed.
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+	flags := cfg.flagSet()
+	configFile := flags.String("config", os.Getenv("CONFIG_FILE"), "JSON config file")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	// Flags win over the file and the environment, so keep what was given
+	// and apply it again last
+	given := map[string]string{}
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = f.Value.String()
+	})
+
+	if *configFile != "" {
+		if err := cfg.loadFile(*configFile); err != nil {
+			return nil, err
+		}
+	}
+	var errs []error
+	flags.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		name := envName(f.Name)
+		if value, ok := os.LookupEnv(name); ok {
+			if err := f.Value.Set(value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			}
+		}
+	})
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	for name, value := range given {
+		flags.Set(name, value)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadFile overrides settings with those in a JSON file. Unknown keys are
+// refused, so a typo does not go unnoticed.
+func (c *Config) loadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// flagSet binds a flag to every setting, with the current values as
+// defaults.
+func (c *Config) flagSet() *flag.FlagSet {
+	flags := flag.NewFlagSet("prompt-service-server", flag.ContinueOnError)
+	flags.StringVar(&c.Port, "port", c.Port, "Port to listen on")
+	flags.StringVar(&c.Listen, "listen", c.Listen, "Comma separated addresses to serve on: host:port, unix:/path, systemd or systemd:name")
+	flags.StringVar(&c.SocketMode, "socket-mode", c.SocketMode, "Permissions of the Unix sockets created, in octal")
+	flags.StringVar(&c.TLSCertFile, "tls-cert-file", c.TLSCertFile, "PEM certificate chain to serve HTTPS with")
+	flags.StringVar(&c.TLSKeyFile, "tls-key-file", c.TLSKeyFile, "PEM private key of the certificate")
+	flags.StringVar(&c.HTTPRedirectAddr, "http-redirect-addr", c.HTTPRedirectAddr, "Address to redirect plain HTTP to HTTPS from, such as :80")
+	flags.IntVar(&c.CSRFTokenExpirySeconds, "csrf-token-expiry", c.CSRFTokenExpirySeconds, "Seconds a CSRF token is valid")
+	flags.StringVar(&c.CSRFTokenSecret, "csrf-token-secret", c.CSRFTokenSecret, "Secret that signs CSRF tokens, at least 32 bytes")
+	flags.StringVar(&c.CSRFKeyFile, "csrf-key-file", c.CSRFKeyFile, "File that generated CSRF signing keys are kept in")
+	flags.Int64Var(&c.MaxRequestBodySize, "max-request-body-size", c.MaxRequestBodySize, "Largest request body accepted, in bytes")
+	flags.StringVar(&c.AllowedOrigins, "allowed-origins", c.AllowedOrigins, "Comma separated origins allowed by CORS")
+	flags.StringVar(&c.StorageBackend, "storage-backend", c.StorageBackend, `Where prompts are kept: "memory" or "file"`)
+	flags.StringVar(&c.StoragePath, "storage-path", c.StoragePath, "Journal file of the file storage backend")
+	flags.IntVar(&c.PromptTimeoutSeconds, "prompt-timeout", c.PromptTimeoutSeconds, "Seconds a prompt stays open unless it asks otherwise")
+	flags.IntVar(&c.MaxPromptTimeoutSeconds, "prompt-timeout-max", c.MaxPromptTimeoutSeconds, "Most seconds a prompt may stay open")
+	flags.IntVar(&c.ResultRetentionSeconds, "result-retention", c.ResultRetentionSeconds, "Seconds a closed prompt's result is kept")
+	flags.IntVar(&c.WebhookMaxAttempts, "webhook-max-attempts", c.WebhookMaxAttempts, "Deliveries tried per webhook")
+	flags.StringVar(&c.WebhookDeadLetterPath, "webhook-dead-letter-path", c.WebhookDeadLetterPath, "File that failed webhooks are written to")
+	flags.BoolVar(&c.WebhookAllowPrivate, "webhook-allow-private", c.WebhookAllowPrivate, "Deliver webhooks to loopback, private and link-local addresses")
+	flags.IntVar(&c.RateLimitIPPerMinute, "rate-limit-ip", c.RateLimitIPPerMinute, "Prompts per minute per client IP, 0 for no limit")
+	flags.IntVar(&c.RateLimitIPBurst, "rate-limit-ip-burst", c.RateLimitIPBurst, "Burst of prompts per client IP")
+	flags.IntVar(&c.RateLimitSenderPerMinute, "rate-limit-sender", c.RateLimitSenderPerMinute, "Prompts per minute per signing sender, 0 for no limit")
+	flags.IntVar(&c.RateLimitSenderBurst, "rate-limit-sender-burst", c.RateLimitSenderBurst, "Burst of prompts per signing sender")
+	flags.IntVar(&c.RateLimitRecipientPerMinute, "rate-limit-recipient", c.RateLimitRecipientPerMinute, "Prompts per minute per recipient, 0 for no limit")
+	flags.IntVar(&c.RateLimitRecipientBurst, "rate-limit-recipient-burst", c.RateLimitRecipientBurst, "Burst of prompts per recipient")
+	flags.IntVar(&c.MaxPendingPerRecipient, "max-pending-per-recipient", c.MaxPendingPerRecipient, "Pending prompts allowed per recipient, 0 for no limit")
+	flags.IntVar(&c.MaxRecipients, "max-recipients", c.MaxRecipients, "Recipients one prompt may have")
+	flags.BoolVar(&c.TrustProxy, "trust-proxy", c.TrustProxy, "Take the client IP from X-Forwarded-For")
+	flags.StringVar(&c.MetricsAddr, "metrics-addr", c.MetricsAddr, "Separate address to serve /metrics on")
+	flags.StringVar(&c.MetricsToken, "metrics-token", c.MetricsToken, "Bearer token required for /metrics")
+	flags.StringVar(&c.LogLevel, "log-level", c.LogLevel, "debug, info, warn or error")
+	flags.StringVar(&c.AuditLogPath, "audit-log", c.AuditLogPath, "File the audit stream is written to")
+	flags.IntVar(&c.ShutdownGraceSeconds, "shutdown-grace", c.ShutdownGraceSeconds, "Seconds shutting down may take")
+	return flags
+}
+
+// TLSEnabled reports whether the server serves HTTPS itself.
+func (c *Config) TLSEnabled() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
+// ListenAddrs returns the addresses the API is served on: those in Listen,
+// or every interface on Port.
+func (c *Config) ListenAddrs() []string {
+	if c.Listen == "" {
+		return []string{":" + c.Port}
+	}
+	var addrs []string
+	for _, addr := range strings.Split(c.Listen, ",") {
+		addrs = append(addrs, strings.TrimSpace(addr))
+	}
+	return addrs
+}
+
+// HTTPSPort returns the port HTTPS is served on: that of the first TCP
+// address in Listen, or Port. It is "" if HTTPS is only served on Unix or
+// systemd sockets, whose port is unknown.
+func (c *Config) HTTPSPort() string {
+	if c.Listen == "" {
+		return c.Port
+	}
+	for _, addr := range c.ListenAddrs() {
+		if strings.HasPrefix(addr, "unix:") || addr == "systemd" || strings.HasPrefix(addr, "systemd:") {
+			continue
+		}
+		if _, port, err := net.SplitHostPort(addr); err == nil {
+			return port
+		}
+	}
+	return ""
+}
+
+// SocketFileMode returns SocketMode as permission bits.
+func (c *Config) SocketFileMode() os.FileMode {
+	mode, _ := strconv.ParseUint(c.SocketMode, 8, 32)
+	return os.FileMode(mode)
+}
+
+// validAddr reports whether addr is an address a server can be served on.
+func validAddr(addr string) bool {
+	switch {
+	case addr == "systemd":
+		return true
+	case strings.HasPrefix(addr, "systemd:"):
+		return addr != "systemd:"
+	case strings.HasPrefix(addr, "unix:"):
+		return addr != "unix:"
+	}
+	_, _, err := net.SplitHostPort(addr)
+	return err == nil
+}
+
+// envName returns the environment variable of a flag.
+func envName(flag string) string {
+	return strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// Validate reports every setting that is missing, out of range or unsafe.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	if c.CSRFTokenSecret != "" {
+		check(len(c.CSRFTokenSecret) >= MinSecretLength, "CSRF_TOKEN_SECRET must be at least %d bytes", MinSecretLength)
+		check(!weakSecret(c.CSRFTokenSecret), "CSRF_TOKEN_SECRET is too easy to guess")
+		check(c.CSRFKeyFile == "", "CSRF_TOKEN_SECRET and CSRF_KEY_FILE can not both be set")
+	}
+	check(c.Port != "" || c.Listen != "", "PORT or LISTEN is required")
+	if c.Listen != "" {
+		for _, addr := range c.ListenAddrs() {
+			check(validAddr(addr), "LISTEN address %q is not host:port, unix:/path or systemd[:name]", addr)
+		}
+	}
+	check(c.MetricsAddr == "" || validAddr(c.MetricsAddr), "METRICS_ADDR %q is not host:port, unix:/path or systemd[:name]", c.MetricsAddr)
+	check(c.HTTPRedirectAddr == "" || validAddr(c.HTTPRedirectAddr), "HTTP_REDIRECT_ADDR %q is not host:port, unix:/path or systemd[:name]", c.HTTPRedirectAddr)
+	if mode, err := strconv.ParseUint(c.SocketMode, 8, 32); err != nil || mode > 0777 {
+		check(false, "SOCKET_MODE %q is not octal permissions such as 0660", c.SocketMode)
+	}
+	check((c.TLSCertFile == "") == (c.TLSKeyFile == ""), "TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	check(c.HTTPRedirectAddr == "" || c.TLSEnabled(), "HTTP_REDIRECT_ADDR needs TLS_CERT_FILE and TLS_KEY_FILE")
+	check(c.HTTPRedirectAddr == "" || c.HTTPSPort() != "", "HTTP_REDIRECT_ADDR needs a host:port in LISTEN to redirect to")
+	check(c.CSRFTokenExpirySeconds > 0, "CSRF_TOKEN_EXPIRY must be positive")
+	check(c.MaxRequestBodySize > 0, "MAX_REQUEST_BODY_SIZE must be positive")
+	switch c.StorageBackend {
+	case "", "memory":
+	case "file":
+		check(c.StoragePath != "", "STORAGE_PATH is required with the file storage backend")
+	default:
+		check(false, "STORAGE_BACKEND %q is not memory or file", c.StorageBackend)
+	}
+	check(c.PromptTimeoutSeconds > 0, "PROMPT_TIMEOUT must be positive")
+	check(c.MaxPromptTimeoutSeconds >= c.PromptTimeoutSeconds, "PROMPT_TIMEOUT_MAX must be at least PROMPT_TIMEOUT")
+	check(c.ResultRetentionSeconds >= 0, "RESULT_RETENTION must not be negative")
+	check(c.WebhookMaxAttempts > 0, "WEBHOOK_MAX_ATTEMPTS must be positive")
+	check(c.MaxRecipients > 0, "MAX_RECIPIENTS must be positive")
+	for _, setting := range []struct {
+		name  string
+		value int
+	}{
+		{"RATE_LIMIT_IP", c.RateLimitIPPerMinute},
+		{"RATE_LIMIT_IP_BURST", c.RateLimitIPBurst},
+		{"RATE_LIMIT_SENDER", c.RateLimitSenderPerMinute},
+		{"RATE_LIMIT_SENDER_BURST", c.RateLimitSenderBurst},
+		{"RATE_LIMIT_RECIPIENT", c.RateLimitRecipientPerMinute},
+		{"RATE_LIMIT_RECIPIENT_BURST", c.RateLimitRecipientBurst},
+		{"MAX_PENDING_PER_RECIPIENT", c.MaxPendingPerRecipient},
+		{"SHUTDOWN_GRACE", c.ShutdownGraceSeconds},
+	} {
+		check(setting.value >= 0, "%s must not be negative", setting.name)
+	}
+	switch strings.ToLower(c.LogLevel) {
+	case "", "debug", "info", "warn", "error":
+	default:
+		check(false, "LOG_LEVEL %q is not debug, info, warn or error", c.LogLevel)
+	}
+	return errors.Join(errs...)
+}
+
+// weakSecret reports whether a secret is made of too few distinct bytes to
+// be random, like a repeated word or character.
+func weakSecret(secret string) bool {
+	distinct := map[rune]bool{}
+	for _, r := range secret {
+		distinct[r] = true
 	}
+	return len(distinct) < 10
 }
@@ -1,36 +1,164 @@
 package config
 
 import (
+	"flag"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-func TestLoadConfig(t *testing.T) {
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+func TestLoad(t *testing.T) {
 	// Test with environment variables set
-	os.Setenv("PORT", "8080")
-	os.Setenv("JWT_SECRET", "test-jwt-secret")
-	os.Setenv("CSRF_TOKEN_SECRET", "test-csrf-secret")
+	t.Setenv("PORT", "9000")
+	t.Setenv("CSRF_TOKEN_SECRET", testSecret)
+
+	config, err := Load(nil)
+	require.NoError(t, err)
 
-	defer func() {
-		os.Unsetenv("PORT")
-		os.Unsetenv("JWT_SECRET")
-		os.Unsetenv("CSRF_TOKEN_SECRET")
-	}()
+	assert.Equal(t, "9000", config.Port)
+	assert.Equal(t, 300, config.CSRFTokenExpirySeconds)
+	assert.Equal(t, testSecret, config.CSRFTokenSecret)
+}
 
-	config := LoadConfig()
+func TestLoad_Defaults(t *testing.T) {
+	config, err := Load(nil)
+	require.NoError(t, err)
 
 	assert.Equal(t, "8080", config.Port)
 	assert.Equal(t, 300, config.CSRFTokenExpirySeconds)
-	assert.Equal(t, "test-csrf-secret", config.CSRFTokenSecret)
+	assert.Equal(t, int64(10*1024*1024), config.MaxRequestBodySize)
+	assert.Equal(t, 3600, config.PromptTimeoutSeconds)
+	assert.Equal(t, 86400, config.MaxPromptTimeoutSeconds)
+	assert.Equal(t, 60, config.RateLimitIPPerMinute)
+	assert.Equal(t, 100, config.MaxPendingPerRecipient)
+	assert.False(t, config.TrustProxy)
+	assert.Equal(t, 10, config.ShutdownGraceSeconds)
 }
 
-func TestLoadConfig_Defaults(t *testing.T) {
-	// Test with no environment variables set
-	config := LoadConfig()
+func TestLoad_Precedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"csrf_token_secret": "`+testSecret+`",
+		"port": "7000",
+		"prompt_timeout": 60,
+		"rate_limit_ip": 5,
+		"trust_proxy": true
+	}`), 0600))
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("PROMPT_TIMEOUT", "120")
+	t.Setenv("RATE_LIMIT_IP", "10")
 
-	assert.Empty(t, config.Port)
-	assert.Equal(t, 300, config.CSRFTokenExpirySeconds)
-	assert.Empty(t, config.CSRFTokenSecret)
+	config, err := Load([]string{"-rate-limit-ip", "20"})
+	require.NoError(t, err)
+
+	// File over defaults, environment over file, flags over environment
+	assert.Equal(t, "7000", config.Port)
+	assert.True(t, config.TrustProxy)
+	assert.Equal(t, 120, config.PromptTimeoutSeconds)
+	assert.Equal(t, 20, config.RateLimitIPPerMinute)
+	assert.Equal(t, 3600, config.ResultRetentionSeconds)
+}
+
+func TestLoad_Errors(t *testing.T) {
+	dir := t.TempDir()
+	unknown := filepath.Join(dir, "unknown.json")
+	require.NoError(t, os.WriteFile(unknown, []byte(`{"prot": "8080"}`), 0600))
+
+	_, err := Load([]string{"-config", unknown})
+	assert.Error(t, err)
+	_, err = Load([]string{"-config", filepath.Join(dir, "missing.json")})
+	assert.Error(t, err)
+	_, err = Load([]string{"-no-such-flag"})
+	assert.Error(t, err)
+	_, err = Load([]string{"-h"})
+	assert.Equal(t, flag.ErrHelp, err)
+
+	t.Setenv("CSRF_TOKEN_SECRET", testSecret)
+	t.Setenv("PROMPT_TIMEOUT", "an hour")
+	_, err = Load(nil)
+	assert.Error(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() *Config {
+		config := Default()
+		config.CSRFTokenSecret = testSecret
+		return config
+	}
+	require.NoError(t, valid().Validate())
+	// Without a secret, keys are generated
+	require.NoError(t, Default().Validate())
+
+	for name, change := range map[string]func(*Config){
+		"secret and key file":   func(c *Config) { c.CSRFKeyFile = "csrf-keys.json" },
+		"short secret":          func(c *Config) { c.CSRFTokenSecret = "test-csrf-secret" },
+		"repetitive secret":     func(c *Config) { c.CSRFTokenSecret = "abababababababababababababababab" },
+		"no port":               func(c *Config) { c.Port = "" },
+		"unknown storage":       func(c *Config) { c.StorageBackend = "redis" },
+		"file without path":     func(c *Config) { c.StorageBackend = "file" },
+		"timeout above max":     func(c *Config) { c.PromptTimeoutSeconds = c.MaxPromptTimeoutSeconds + 1 },
+		"negative rate limit":   func(c *Config) { c.RateLimitSenderPerMinute = -1 },
+		"no webhook attempts":   func(c *Config) { c.WebhookMaxAttempts = 0 },
+		"no recipients allowed": func(c *Config) { c.MaxRecipients = 0 },
+		"unknown log level":     func(c *Config) { c.LogLevel = "verbose" },
+		"no csrf token expiry":  func(c *Config) { c.CSRFTokenExpirySeconds = 0 },
+		"cert without key":      func(c *Config) { c.TLSCertFile = "cert.pem" },
+		"redirect without tls":  func(c *Config) { c.HTTPRedirectAddr = ":80" },
+		"redirect to sockets": func(c *Config) {
+			c.TLSCertFile, c.TLSKeyFile = "cert.pem", "key.pem"
+			c.HTTPRedirectAddr = ":80"
+			c.Listen = "unix:/run/api.sock,systemd"
+		},
+		"listen without port":   func(c *Config) { c.Listen = "localhost" },
+		"listen empty socket":   func(c *Config) { c.Listen = ":8080,unix:" },
+		"metrics without port":  func(c *Config) { c.MetricsAddr = "9090" },
+		"socket mode not octal": func(c *Config) { c.SocketMode = "0669" },
+		"socket mode too wide":  func(c *Config) { c.SocketMode = "01777" },
+	} {
+		config := valid()
+		change(config)
+		assert.Error(t, config.Validate(), name)
+	}
+
+	// Every problem is reported at once
+	config := valid()
+	config.CSRFTokenSecret = "secret"
+	config.Port = ""
+	err := config.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "CSRF_TOKEN_SECRET")
+	assert.Contains(t, err.Error(), "PORT")
+}
+
+func TestListenAddrs(t *testing.T) {
+	config := Default()
+	assert.Equal(t, []string{":8080"}, config.ListenAddrs())
+
+	config.Listen = "unix:/run/prompt-service-server/api.sock, systemd:admin,127.0.0.1:9090"
+	config.Port = ""
+	require.NoError(t, config.Validate())
+	assert.Equal(t, []string{"unix:/run/prompt-service-server/api.sock", "systemd:admin", "127.0.0.1:9090"}, config.ListenAddrs())
+
+	config.SocketMode = "0600"
+	assert.Equal(t, os.FileMode(0600), config.SocketFileMode())
+}
+
+func TestHTTPSPort(t *testing.T) {
+	config := Default()
+	assert.Equal(t, "8080", config.HTTPSPort())
+
+	// Redirects go where HTTPS is listened on, not to PORT
+	config.TLSCertFile, config.TLSKeyFile = "cert.pem", "key.pem"
+	config.HTTPRedirectAddr = ":80"
+	config.Listen = "systemd:admin,:443,127.0.0.1:9443"
+	require.NoError(t, config.Validate())
+	assert.Equal(t, "443", config.HTTPSPort())
+
+	config.Listen = "unix:/run/api.sock"
+	assert.Equal(t, "", config.HTTPSPort())
 }
@@ -0,0 +1,160 @@
+package core
+
+import (
+	"container/list"
+	"time"
+)
+
+// defaultEventBuffer is how many events are kept per key for replay unless
+// StoreOptions says otherwise.
+const defaultEventBuffer = 100
+
+const (
+	// maxEventLogs is how many keys events are kept for. Beyond that the log
+	// that was written to least recently is forgotten for each new key.
+	maxEventLogs = 10000
+	// eventLogIdle is how long the log of a key that has no connections and
+	// no prompts is kept after its last event.
+	eventLogIdle = 10 * time.Minute
+)
+
+// event is an SSE event kept for replay to reconnecting clients.
+type event struct {
+	seq       uint64
+	eventType string
+	data      string
+	id        string
+	sender    string        // Hash of the key that signed the prompt, if any
+	requestId string        // Id of the request that caused the event, if any
+	retry     time.Duration // How long clients wait before reconnecting, if set
+}
+
+// eventLog is a bounded ring buffer of the latest events sent to one key.
+// Sequence numbers increase by one per event and are never reused. The
+// buffer grows as events arrive, up to size.
+type eventLog struct {
+	key     string
+	events  []event
+	size    int
+	start   int
+	next    uint64
+	updated time.Time
+}
+
+func newEventLog(size int, first uint64) *eventLog {
+	return &eventLog{size: size, next: first}
+}
+
+// append records an event, dropping the oldest one if the buffer is full.
+// The event is returned with its sequence number set.
+func (l *eventLog) append(e event) event {
+	e.seq = l.next
+	l.next++
+	l.updated = time.Now()
+	if len(l.events) < l.size {
+		l.events = append(l.events, e)
+	} else {
+		l.events[l.start] = e
+		l.start = (l.start + 1) % len(l.events)
+	}
+	return e
+}
+
+// since returns the events after seq in order. It returns false if events
+// after seq were already dropped, or if seq was never handed out, in which
+// case the client has to start over.
+func (l *eventLog) since(seq uint64) ([]event, bool) {
+	oldest := l.next - uint64(len(l.events))
+	if seq >= l.next || seq+1 < oldest {
+		return nil, false
+	}
+	missed := make([]event, 0, l.next-seq-1)
+	for i := range l.events {
+		e := l.events[(l.start+i)%len(l.events)]
+		if e.seq > seq {
+			missed = append(missed, e)
+		}
+	}
+	return missed, true
+}
+
+// forget blanks the data of the events about prompt id, so a removed prompt
+// is not kept in memory by its events.
+func (l *eventLog) forget(id string) {
+	for i := range l.events {
+		if l.events[i].id == id {
+			l.events[i].data = ""
+		}
+	}
+}
+
+// eventLog returns the event log of key, creating it if needed. The caller
+// must hold eventMutex.
+func (s *PromptStore) eventLog(key string) *eventLog {
+	s.pruneEventLogs(time.Now())
+	element, exists := s.events[key]
+	if !exists {
+		for len(s.events) >= maxEventLogs {
+			s.dropEventLog(s.eventLogs.Front())
+		}
+		element = s.eventLogs.PushBack(newEventLog(s.eventBuffer, s.eventEpoch))
+		element.Value.(*eventLog).key = key
+		s.events[key] = element
+	}
+	s.eventLogs.MoveToBack(element)
+	return element.Value.(*eventLog)
+}
+
+// pruneEventLogs forgets the logs that were idle for eventLogIdle, unless
+// their key still has connections or prompts that clients may come back
+// for. It looks at most once per eventLogIdle. The caller must hold
+// eventMutex.
+func (s *PromptStore) pruneEventLogs(now time.Time) {
+	if now.Sub(s.eventsPruned) < eventLogIdle {
+		return
+	}
+	s.eventsPruned = now
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for element := s.eventLogs.Front(); element != nil; {
+		log := element.Value.(*eventLog)
+		if now.Sub(log.updated) < eventLogIdle {
+			break
+		}
+		next := element.Next()
+		if len(s.connections[log.key]) == 0 && s.stored[log.key] == 0 {
+			s.dropEventLog(element)
+		}
+		element = next
+	}
+}
+
+// dropEventLog forgets a log. Logs created for its key later on continue
+// after its sequence numbers, so they are not handed out twice. The caller
+// must hold eventMutex.
+func (s *PromptStore) dropEventLog(element *list.Element) {
+	log := s.eventLogs.Remove(element).(*eventLog)
+	delete(s.events, log.key)
+	s.eventEpoch = max(s.eventEpoch, log.next)
+}
+
+// forgetEvents blanks the data of the events about a removed prompt. The
+// caller must hold eventMutex.
+func (s *PromptStore) forgetEvents(prompt *Prompt) {
+	for _, key := range prompt.RecipientKeys() {
+		if element, exists := s.events[key]; exists {
+			element.Value.(*eventLog).forget(prompt.Id)
+		}
+	}
+}
+
+// countStored adds delta to the count of stored prompts, pending or closed,
+// of every recipient of prompt. The caller must hold the write lock.
+func (s *PromptStore) countStored(prompt *Prompt, delta int) {
+	for _, key := range prompt.RecipientKeys() {
+		s.stored[key] += delta
+		if s.stored[key] <= 0 {
+			delete(s.stored, key)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package core
+
+import (
+	"context"
+	"prompt-service-server/logging"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventLog(t *testing.T) {
+	events := newEventLog(3, 10)
+	// The buffer grows as events arrive
+	assert.Equal(t, 0, cap(events.events))
+
+	// Nothing was missed by a client that saw the id before the first event
+	missed, ok := events.since(9)
+	assert.True(t, ok)
+	assert.Empty(t, missed)
+
+	for _, id := range []string{"a", "b", "c", "d"} {
+		events.append(event{eventType: "new_prompt", id: id})
+	}
+
+	missed, ok = events.since(11)
+	require.True(t, ok)
+	require.Len(t, missed, 2)
+	assert.Equal(t, uint64(12), missed[0].seq)
+	assert.Equal(t, "c", missed[0].id)
+	assert.Equal(t, "d", missed[1].id)
+
+	missed, ok = events.since(13)
+	assert.True(t, ok)
+	assert.Empty(t, missed)
+
+	// Event 10 was dropped from the buffer, so a client that only saw 9
+	// cannot catch up
+	_, ok = events.since(9)
+	assert.False(t, ok)
+
+	// Ids that were never handed out
+	_, ok = events.since(14)
+	assert.False(t, ok)
+}
+
+func TestResumeSSEConnection(t *testing.T) {
+	store := NewPromptStoreWithOptions(StoreOptions{EventBuffer: 2})
+	key := "test-key"
+
+	first := &MockResponseWriter{}
+	store.AddSSEConnection(key, first, &MockFlusher{})
+	store.SendEventToConnections(key, "new_prompt", "one", "1")
+	store.SendEventToConnections(key, "new_prompt", "two", "2")
+	store.SendEventToConnections(key, "new_prompt", "three", "3")
+
+	// Every recorded event carries an id
+	lines := strings.Split(first.WaitFor(`"content":"three"`), "\n")
+	require.True(t, strings.HasPrefix(lines[0], "id: "))
+	lastSeen := strings.TrimPrefix(lines[0], "id: ")
+
+	// The client saw "one" and missed the rest
+	resumed := &MockResponseWriter{}
+	store.ResumeSSEConnection(key, resumed, &MockFlusher{}, lastSeen)
+	assert.Contains(t, resumed.WaitFor(`"content":"three"`), `"type":"reconnected"`)
+	assert.NotContains(t, resumed.String(), `"content":"one"`)
+	assert.Contains(t, resumed.String(), `"content":"two"`)
+	assert.Contains(t, resumed.String(), `"content":"three"`)
+
+	// The resumed connection also gets live events
+	store.SendEventToConnections(key, "new_prompt", "four", "4")
+	assert.Contains(t, resumed.WaitFor(`"content":"four"`), `"content":"four"`)
+
+	// Without a usable id the client starts over
+	fresh := &MockResponseWriter{}
+	store.ResumeSSEConnection(key, fresh, &MockFlusher{}, "")
+	assert.Contains(t, fresh.WaitFor(`"type":"connected"`), `"type":"connected"`)
+	assert.NotContains(t, fresh.String(), `"content":"four"`)
+
+	// Neither can a client whose last event already fell out of the buffer
+	stale := &MockResponseWriter{}
+	store.ResumeSSEConnection(key, stale, &MockFlusher{}, lastSeen)
+	assert.Contains(t, stale.WaitFor(`"type":"connected"`), `"type":"connected"`)
+}
+
+func TestNewPromptEventCarriesSender(t *testing.T) {
+	store := NewPromptStore()
+	w := &MockResponseWriter{}
+	store.AddSSEConnection("key", w, &MockFlusher{})
+
+	require.NoError(t, store.Submit(&Prompt{Key: "key", Message: "signed", SenderKey: "sender", SenderHash: "sender-hash"}))
+	assert.Contains(t, w.WaitFor(`"content":"signed"`), `"sender":"sender-hash"`)
+
+	require.NoError(t, store.Submit(&Prompt{Key: "key", Message: "anonymous"}))
+	for _, line := range strings.Split(w.WaitFor(`"content":"anonymous"`), "\n") {
+		if strings.Contains(line, `"content":"anonymous"`) {
+			assert.NotContains(t, line, `"sender"`)
+		}
+	}
+}
+
+func TestEventsCarryRequestId(t *testing.T) {
+	store := NewPromptStore()
+	w := &MockResponseWriter{}
+	store.AddSSEConnection("key", w, &MockFlusher{})
+
+	prompt := &Prompt{Key: "key", Message: "traced", RequestId: "post-request"}
+	require.NoError(t, store.Submit(prompt))
+	assert.Contains(t, w.WaitFor(`"content":"traced"`), `"request_id":"post-request"`)
+
+	ctx := logging.WithRequestID(context.Background(), "answer-request")
+	_, err := store.AnswerContext(ctx, prompt.Id, "key", "done", nil)
+	require.NoError(t, err)
+	assert.Contains(t, w.WaitFor(`"type":"prompt_responded"`), `"request_id":"answer-request"`)
+}
+
+func TestEventLogsAreForgotten(t *testing.T) {
+	store := NewPromptStore()
+	store.SendEventToConnections("idle", "new_prompt", "one", "1")
+	idleNext := store.events["idle"].Value.(*eventLog).next
+	store.AddPrompt("prompted", "waiting", func(string) {})
+	connection := store.AddSSEConnection("connected", &MockResponseWriter{}, &MockFlusher{})
+	defer store.RemoveSSEConnection("connected", connection)
+	store.SendEventToConnections("connected", "new_prompt", "two", "2")
+
+	// Only the log of a key nobody comes back for goes once it is idle
+	store.eventMutex.Lock()
+	for element := store.eventLogs.Front(); element != nil; element = element.Next() {
+		element.Value.(*eventLog).updated = time.Now().Add(-eventLogIdle)
+	}
+	store.eventsPruned = time.Time{}
+	store.eventMutex.Unlock()
+	store.SendEventToConnections("other", "new_prompt", "three", "3")
+	assert.NotContains(t, store.events, "idle")
+	assert.Contains(t, store.events, "prompted")
+	assert.Contains(t, store.events, "connected")
+	assert.Equal(t, 3, store.eventLogs.Len())
+
+	// A new log for the key does not hand out the old ids again
+	store.SendEventToConnections("idle", "new_prompt", "four", "4")
+	assert.True(t, store.events["idle"].Value.(*eventLog).events[0].seq >= idleNext)
+}
+
+func TestEventLogsAreCapped(t *testing.T) {
+	store := NewPromptStore()
+	for i := 0; i <= maxEventLogs; i++ {
+		store.SendEventToConnections(strconv.Itoa(i), "new_prompt", "", "")
+	}
+	assert.Len(t, store.events, maxEventLogs)
+	assert.Equal(t, maxEventLogs, store.eventLogs.Len())
+	assert.NotContains(t, store.events, "0")
+	assert.Contains(t, store.events, strconv.Itoa(maxEventLogs))
+}
+
+func TestRemovePromptForgetsItsEvents(t *testing.T) {
+	store := NewPromptStore()
+	id := store.AddPrompt("key", "secret", func(string) {})
+	store.SendEventToConnections("key", "prompt_responded", "answer", id)
+	store.SendEventToConnections("key", "new_prompt", "kept", "other")
+
+	store.RemovePrompt(id)
+	events := store.events["key"].Value.(*eventLog).events
+	require.Len(t, events, 3)
+	assert.Empty(t, events[0].data)
+	assert.Empty(t, events[1].data)
+	assert.Equal(t, "kept", events[2].data)
+	assert.Empty(t, store.stored)
+}
@@ -0,0 +1,298 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Journal operations
+const (
+	journalPut    = "put"
+	journalDelete = "delete"
+	journalPolicy = "policy"
+)
+
+// compactMinEntries is the journal length below which compaction is never
+// attempted, so small journals are not rewritten on every delete.
+const compactMinEntries = 128
+
+type journalEntry struct {
+	Op     string        `json:"op"`
+	Id     string        `json:"id,omitempty"`
+	Prompt *storedPrompt `json:"prompt,omitempty"`
+	Key    string        `json:"key,omitempty"`    // Recipient of a sender policy
+	Policy *SenderPolicy `json:"policy,omitempty"` // Sender policy of Key
+}
+
+// storedPrompt adds the fields that Prompt hides from API responses but
+// which are needed to restore it.
+type storedPrompt struct {
+	*Prompt
+	Key             string   `json:"key"`
+	PosterTokenHash string   `json:"poster_token_hash,omitempty"`
+	Recipients      []string `json:"recipients,omitempty"`
+	Answers         []Answer `json:"answers,omitempty"`
+	CallbackURL     string   `json:"callback_url,omitempty"`
+	CallbackSecret  string   `json:"callback_secret,omitempty"`
+}
+
+func newStoredPrompt(prompt *Prompt) *storedPrompt {
+	return &storedPrompt{
+		Prompt:          prompt,
+		Key:             prompt.Key,
+		PosterTokenHash: prompt.PosterTokenHash,
+		Recipients:      prompt.Recipients,
+		Answers:         prompt.Answers,
+		CallbackURL:     prompt.CallbackURL,
+		CallbackSecret:  prompt.CallbackSecret,
+	}
+}
+
+func (p *storedPrompt) restore() *Prompt {
+	p.Prompt.Key = p.Key
+	p.Prompt.PosterTokenHash = p.PosterTokenHash
+	p.Prompt.Recipients = p.Recipients
+	p.Prompt.Answers = p.Answers
+	p.Prompt.CallbackURL = p.CallbackURL
+	p.Prompt.CallbackSecret = p.CallbackSecret
+	return p.Prompt
+}
+
+// FileStorage is an append-only journal of prompt and sender policy
+// changes. The journal is replayed on open and compacted once most of its
+// entries are stale.
+type FileStorage struct {
+	path     string
+	file     *os.File
+	prompts  map[string]*Prompt
+	policies map[string]SenderPolicy
+	entries  int
+	mutex    sync.RWMutex
+}
+
+// OpenFileStorage replays the journal at path, creating it if needed, and
+// compacts it before accepting new writes.
+func OpenFileStorage(path string) (*FileStorage, error) {
+	storage := &FileStorage{
+		path:     path,
+		prompts:  make(map[string]*Prompt),
+		policies: make(map[string]SenderPolicy),
+	}
+	if err := storage.replay(); err != nil {
+		return nil, err
+	}
+	if err := storage.compact(); err != nil {
+		return nil, err
+	}
+	return storage, nil
+}
+
+func (f *FileStorage) replay() error {
+	file, err := os.Open(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open journal: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A torn final write is expected after a crash. Everything
+			// before it is still valid.
+			break
+		}
+		switch entry.Op {
+		case journalPut:
+			if entry.Prompt != nil && entry.Prompt.Prompt != nil {
+				prompt := entry.Prompt.restore()
+				f.prompts[prompt.Id] = prompt
+			}
+		case journalDelete:
+			delete(f.prompts, entry.Id)
+		case journalPolicy:
+			if entry.Policy != nil {
+				f.policies[entry.Key] = *entry.Policy
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read journal: %w", err)
+	}
+	return nil
+}
+
+// compact rewrites the journal with one entry per live prompt and sender
+// policy and reopens
+// it for appending. The caller must hold the write lock or be the only user.
+func (f *FileStorage) compact() error {
+	tmpPath := f.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("create journal: %w", err)
+	}
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	for _, prompt := range f.prompts {
+		if err := encoder.Encode(journalEntry{Op: journalPut, Prompt: newStoredPrompt(prompt)}); err != nil {
+			tmp.Close()
+			return fmt.Errorf("write journal: %w", err)
+		}
+	}
+	for key, policy := range f.policies {
+		if err := encoder.Encode(journalEntry{Op: journalPolicy, Key: key, Policy: &policy}); err != nil {
+			tmp.Close()
+			return fmt.Errorf("write journal: %w", err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write journal: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync journal: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close journal: %w", err)
+	}
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	if err := os.Rename(tmpPath, f.path); err != nil {
+		return fmt.Errorf("replace journal: %w", err)
+	}
+	if dir, err := os.Open(filepath.Dir(f.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("open journal: %w", err)
+	}
+	f.file = file
+	f.entries = f.live()
+	return nil
+}
+
+func (f *FileStorage) append(entry journalEntry) error {
+	if f.file == nil {
+		return errors.New("journal is closed")
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := f.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("write journal: %w", err)
+	}
+	if err := f.file.Sync(); err != nil {
+		return fmt.Errorf("sync journal: %w", err)
+	}
+	f.entries++
+	if f.entries > compactMinEntries && f.entries > 2*f.live() {
+		return f.compact()
+	}
+	return nil
+}
+
+// live returns the number of journal entries compaction would keep.
+func (f *FileStorage) live() int {
+	return len(f.prompts) + len(f.policies)
+}
+
+func (f *FileStorage) Put(prompt *Prompt) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	// Recorded before appending, so a compaction triggered by the append
+	// keeps the prompt
+	previous, existed := f.prompts[prompt.Id]
+	f.prompts[prompt.Id] = prompt
+	if err := f.append(journalEntry{Op: journalPut, Prompt: newStoredPrompt(prompt)}); err != nil {
+		if existed {
+			f.prompts[prompt.Id] = previous
+		} else {
+			delete(f.prompts, prompt.Id)
+		}
+		return err
+	}
+	return nil
+}
+
+func (f *FileStorage) Delete(id string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if _, exists := f.prompts[id]; !exists {
+		return nil
+	}
+	delete(f.prompts, id)
+	return f.append(journalEntry{Op: journalDelete, Id: id})
+}
+
+func (f *FileStorage) Get(id string) (*Prompt, bool) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	prompt, ok := f.prompts[id]
+	return prompt, ok
+}
+
+func (f *FileStorage) List() []*Prompt {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	prompts := make([]*Prompt, 0, len(f.prompts))
+	for _, prompt := range f.prompts {
+		prompts = append(prompts, prompt)
+	}
+	return prompts
+}
+
+func (f *FileStorage) PutSenderPolicy(key string, policy SenderPolicy) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	// Recorded before appending, so a compaction triggered by the append
+	// keeps the policy
+	previous, existed := f.policies[key]
+	f.policies[key] = policy
+	if err := f.append(journalEntry{Op: journalPolicy, Key: key, Policy: &policy}); err != nil {
+		if existed {
+			f.policies[key] = previous
+		} else {
+			delete(f.policies, key)
+		}
+		return err
+	}
+	return nil
+}
+
+func (f *FileStorage) SenderPolicy(key string) (SenderPolicy, bool) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	policy, ok := f.policies[key]
+	return policy, ok
+}
+
+func (f *FileStorage) Durable() bool {
+	return true
+}
+
+func (f *FileStorage) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
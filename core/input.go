@@ -0,0 +1,336 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// Input types a poster can ask for
+const (
+	InputText         = "text"
+	InputConfirm      = "confirm"
+	InputSingleChoice = "single_choice"
+	InputMultiChoice  = "multi_choice"
+	InputNumber       = "number"
+	InputForm         = "form"
+)
+
+// ErrInvalidAnswer is wrapped by every error returned from ParseAnswer.
+var ErrInvalidAnswer = errors.New("invalid answer")
+
+// InputSpec describes the answer a prompt expects. Answers to anything but
+// free text are JSON values: a boolean for confirm, an option string for
+// single_choice, an array of option strings for multi_choice, a number for
+// number and an object matching Schema for form.
+type InputSpec struct {
+	Type    string          `json:"type"`
+	Options []string        `json:"options,omitempty"`
+	Min     *float64        `json:"min,omitempty"`
+	Max     *float64        `json:"max,omitempty"`
+	Schema  json.RawMessage `json:"schema,omitempty"`
+}
+
+// IsStructured reports whether answers to the spec are JSON values rather
+// than free text.
+func (spec *InputSpec) IsStructured() bool {
+	return spec != nil && spec.Type != "" && spec.Type != InputText
+}
+
+// Validate checks that the spec itself is usable.
+func (spec *InputSpec) Validate() error {
+	if spec == nil {
+		return nil
+	}
+	switch spec.Type {
+	case "", InputText, InputConfirm:
+		return nil
+	case InputSingleChoice, InputMultiChoice:
+		if len(spec.Options) == 0 {
+			return fmt.Errorf("%s input needs options", spec.Type)
+		}
+		seen := make(map[string]bool, len(spec.Options))
+		for _, option := range spec.Options {
+			if seen[option] {
+				return fmt.Errorf("duplicate option %q", option)
+			}
+			seen[option] = true
+		}
+		return nil
+	case InputNumber:
+		if spec.Min != nil && spec.Max != nil && *spec.Min > *spec.Max {
+			return errors.New("number input has min greater than max")
+		}
+		return nil
+	case InputForm:
+		if len(spec.Schema) == 0 {
+			return errors.New("form input needs a schema")
+		}
+		schema, err := parseSchema(spec.Schema)
+		if err != nil {
+			return err
+		}
+		if schema.Type != "object" {
+			return errors.New("form schema must describe an object")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown input type %q", spec.Type)
+	}
+}
+
+// ParseAnswer validates a responder's answer against the spec and returns it
+// in canonical form. Free text is returned unchanged, structured answers are
+// returned as compact JSON with object keys sorted and without HTML
+// escaping, which clients can produce to sign their answer.
+func (spec *InputSpec) ParseAnswer(answer string) (string, error) {
+	if !spec.IsStructured() {
+		return answer, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader([]byte(answer)))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return "", fmt.Errorf("%w: answer is not JSON", ErrInvalidAnswer)
+	}
+	if decoder.More() {
+		return "", fmt.Errorf("%w: trailing data after answer", ErrInvalidAnswer)
+	}
+
+	switch spec.Type {
+	case InputConfirm:
+		if _, ok := value.(bool); !ok {
+			return "", fmt.Errorf("%w: expected true or false", ErrInvalidAnswer)
+		}
+	case InputSingleChoice:
+		choice, ok := value.(string)
+		if !ok || !slices.Contains(spec.Options, choice) {
+			return "", fmt.Errorf("%w: expected one of the options", ErrInvalidAnswer)
+		}
+	case InputMultiChoice:
+		choices, ok := value.([]interface{})
+		if !ok {
+			return "", fmt.Errorf("%w: expected a list of options", ErrInvalidAnswer)
+		}
+		seen := make(map[string]bool, len(choices))
+		for _, item := range choices {
+			choice, ok := item.(string)
+			if !ok || !slices.Contains(spec.Options, choice) {
+				return "", fmt.Errorf("%w: expected only listed options", ErrInvalidAnswer)
+			}
+			if seen[choice] {
+				return "", fmt.Errorf("%w: option %q chosen twice", ErrInvalidAnswer, choice)
+			}
+			seen[choice] = true
+		}
+	case InputNumber:
+		number, ok := value.(json.Number)
+		if !ok {
+			return "", fmt.Errorf("%w: expected a number", ErrInvalidAnswer)
+		}
+		n, err := number.Float64()
+		if err != nil {
+			return "", fmt.Errorf("%w: expected a number", ErrInvalidAnswer)
+		}
+		if spec.Min != nil && n < *spec.Min {
+			return "", fmt.Errorf("%w: number is below %v", ErrInvalidAnswer, *spec.Min)
+		}
+		if spec.Max != nil && n > *spec.Max {
+			return "", fmt.Errorf("%w: number is above %v", ErrInvalidAnswer, *spec.Max)
+		}
+	case InputForm:
+		schema, err := parseSchema(spec.Schema)
+		if err != nil {
+			return "", err
+		}
+		if err := schema.validate(value, "answer"); err != nil {
+			return "", fmt.Errorf("%w: %v", ErrInvalidAnswer, err)
+		}
+	}
+
+	var canonical bytes.Buffer
+	encoder := json.NewEncoder(&canonical)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidAnswer, err)
+	}
+	return strings.TrimSuffix(canonical.String(), "\n"), nil
+}
+
+// jsonSchema is the subset of JSON Schema that is enough to describe a small
+// form: types, object properties, arrays, enums and basic bounds.
+type jsonSchema struct {
+	Type                 string                 `json:"type"`
+	Title                string                 `json:"title,omitempty"`
+	Properties           map[string]*jsonSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AdditionalProperties *bool                  `json:"additionalProperties,omitempty"`
+	Items                *jsonSchema            `json:"items,omitempty"`
+	Enum                 []interface{}          `json:"enum,omitempty"`
+	Minimum              *float64               `json:"minimum,omitempty"`
+	Maximum              *float64               `json:"maximum,omitempty"`
+	MinLength            *int                   `json:"minLength,omitempty"`
+	MaxLength            *int                   `json:"maxLength,omitempty"`
+	MinItems             *int                   `json:"minItems,omitempty"`
+	MaxItems             *int                   `json:"maxItems,omitempty"`
+	Pattern              string                 `json:"pattern,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// parseSchema decodes and compiles a schema. Numbers are kept as json.Number
+// so enum values compare equal to decoded answers.
+func parseSchema(raw json.RawMessage) (*jsonSchema, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var schema jsonSchema
+	if err := decoder.Decode(&schema); err != nil {
+		return nil, fmt.Errorf("invalid form schema: %w", err)
+	}
+	if err := schema.compile(); err != nil {
+		return nil, err
+	}
+	return &schema, nil
+}
+
+var schemaTypes = []string{"", "object", "array", "string", "number", "integer", "boolean", "null"}
+
+// compile checks the schema and prepares its patterns.
+func (s *jsonSchema) compile() error {
+	if !slices.Contains(schemaTypes, s.Type) {
+		return fmt.Errorf("unsupported schema type %q", s.Type)
+	}
+	if s.Pattern != "" {
+		pattern, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid schema pattern: %w", err)
+		}
+		s.pattern = pattern
+	}
+	for _, property := range s.Properties {
+		if property == nil {
+			return errors.New("empty schema property")
+		}
+		if err := property.compile(); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.compile()
+	}
+	return nil
+}
+
+func (s *jsonSchema) validate(value interface{}, path string) error {
+	if len(s.Enum) > 0 && !s.inEnum(value) {
+		return fmt.Errorf("%s is not one of the allowed values", path)
+	}
+
+	switch s.Type {
+	case "":
+		return nil
+	case "null":
+		if value != nil {
+			return fmt.Errorf("%s must be null", path)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s must be a boolean", path)
+		}
+	case "number", "integer":
+		number, ok := value.(json.Number)
+		if !ok {
+			return fmt.Errorf("%s must be a number", path)
+		}
+		n, err := number.Float64()
+		if err != nil {
+			return fmt.Errorf("%s must be a number", path)
+		}
+		if s.Type == "integer" && n != math.Trunc(n) {
+			return fmt.Errorf("%s must be an integer", path)
+		}
+		if s.Minimum != nil && n < *s.Minimum {
+			return fmt.Errorf("%s must be at least %v", path, *s.Minimum)
+		}
+		if s.Maximum != nil && n > *s.Maximum {
+			return fmt.Errorf("%s must be at most %v", path, *s.Maximum)
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s must be a string", path)
+		}
+		length := utf8.RuneCountInString(str)
+		if s.MinLength != nil && length < *s.MinLength {
+			return fmt.Errorf("%s must be at least %d characters", path, *s.MinLength)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			return fmt.Errorf("%s must be at most %d characters", path, *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(str) {
+			return fmt.Errorf("%s does not match the required pattern", path)
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an array", path)
+		}
+		if s.MinItems != nil && len(items) < *s.MinItems {
+			return fmt.Errorf("%s must have at least %d items", path, *s.MinItems)
+		}
+		if s.MaxItems != nil && len(items) > *s.MaxItems {
+			return fmt.Errorf("%s must have at most %d items", path, *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range items {
+				if err := s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an object", path)
+		}
+		for _, name := range s.Required {
+			if _, exists := object[name]; !exists {
+				return fmt.Errorf("%s.%s is required", path, name)
+			}
+		}
+		for name, field := range object {
+			property, known := s.Properties[name]
+			if !known {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return fmt.Errorf("%s.%s is not allowed", path, name)
+				}
+				continue
+			}
+			if err := property.validate(field, path+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) inEnum(value interface{}) bool {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range s.Enum {
+		candidate, err := json.Marshal(allowed)
+		if err == nil && bytes.Equal(encoded, candidate) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func float(v float64) *float64 {
+	return &v
+}
+
+func TestInputSpecValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		spec  *InputSpec
+		valid bool
+	}{
+		{"nil spec", nil, true},
+		{"text", &InputSpec{Type: InputText}, true},
+		{"confirm", &InputSpec{Type: InputConfirm}, true},
+		{"choice", &InputSpec{Type: InputSingleChoice, Options: []string{"a", "b"}}, true},
+		{"choice without options", &InputSpec{Type: InputMultiChoice}, false},
+		{"duplicate options", &InputSpec{Type: InputSingleChoice, Options: []string{"a", "a"}}, false},
+		{"number", &InputSpec{Type: InputNumber, Min: float(1), Max: float(10)}, true},
+		{"inverted bounds", &InputSpec{Type: InputNumber, Min: float(10), Max: float(1)}, false},
+		{"form", &InputSpec{Type: InputForm, Schema: json.RawMessage(`{"type":"object"}`)}, true},
+		{"form without schema", &InputSpec{Type: InputForm}, false},
+		{"form of non-object", &InputSpec{Type: InputForm, Schema: json.RawMessage(`{"type":"string"}`)}, false},
+		{"form with bad pattern", &InputSpec{Type: InputForm, Schema: json.RawMessage(`{"type":"object","properties":{"a":{"type":"string","pattern":"("}}}`)}, false},
+		{"unknown type", &InputSpec{Type: "slider"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.spec.Validate()
+			if tt.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestInputSpecParseAnswer(t *testing.T) {
+	form := &InputSpec{Type: InputForm, Schema: json.RawMessage(`{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string", "minLength": 1},
+			"replicas": {"type": "integer", "minimum": 1, "maximum": 5},
+			"region": {"enum": ["eu", "us"]}
+		},
+		"required": ["name"],
+		"additionalProperties": false
+	}`)}
+
+	tests := []struct {
+		name     string
+		spec     *InputSpec
+		answer   string
+		expected string
+		valid    bool
+	}{
+		{"free text passes through", nil, "  anything \n", "  anything \n", true},
+		{"confirm true", &InputSpec{Type: InputConfirm}, "true", "true", true},
+		{"confirm text", &InputSpec{Type: InputConfirm}, "yes", "", false},
+		{"single choice", &InputSpec{Type: InputSingleChoice, Options: []string{"staging", "prod"}}, ` "prod" `, `"prod"`, true},
+		{"single choice unknown", &InputSpec{Type: InputSingleChoice, Options: []string{"staging"}}, `"prod"`, "", false},
+		{"multi choice", &InputSpec{Type: InputMultiChoice, Options: []string{"a", "b", "c"}}, `["c","a"]`, `["c","a"]`, true},
+		{"multi choice repeated", &InputSpec{Type: InputMultiChoice, Options: []string{"a"}}, `["a","a"]`, "", false},
+		{"multi choice not a list", &InputSpec{Type: InputMultiChoice, Options: []string{"a"}}, `"a"`, "", false},
+		{"number in range", &InputSpec{Type: InputNumber, Min: float(0), Max: float(10)}, "7.5", "7.5", true},
+		{"number too large", &InputSpec{Type: InputNumber, Max: float(10)}, "11", "", false},
+		{"number as string", &InputSpec{Type: InputNumber}, `"7"`, "", false},
+		{"trailing data", &InputSpec{Type: InputConfirm}, "true false", "", false},
+		{"form", form, `{"name": "api", "replicas": 3, "region": "eu"}`, `{"name":"api","region":"eu","replicas":3}`, true},
+		{"form not html escaped", form, `{"name": "a<b&c"}`, `{"name":"a<b&c"}`, true},
+		{"form missing required", form, `{"replicas": 3}`, "", false},
+		{"form fractional integer", form, `{"name": "api", "replicas": 2.5}`, "", false},
+		{"form out of range", form, `{"name": "api", "replicas": 9}`, "", false},
+		{"form enum mismatch", form, `{"name": "api", "region": "ap"}`, "", false},
+		{"form extra field", form, `{"name": "api", "debug": true}`, "", false},
+		{"form empty string", form, `{"name": ""}`, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			answer, err := tt.spec.ParseAnswer(tt.answer)
+			if tt.valid {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.expected, answer)
+			} else {
+				assert.Error(t, err)
+				assert.True(t, errors.Is(err, ErrInvalidAnswer), "error should wrap ErrInvalidAnswer")
+			}
+		})
+	}
+}
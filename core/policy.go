@@ -0,0 +1,137 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"prompt-service-server/utils"
+	"time"
+)
+
+// Approval policy modes for prompts with several recipients
+const (
+	PolicyAny    = "any"
+	PolicyAll    = "all"
+	PolicyQuorum = "quorum"
+)
+
+// Outcomes of a prompt with several recipients
+const (
+	OutcomeApproved = "approved"
+	OutcomeRejected = "rejected"
+)
+
+// ApprovalPolicy decides when the answers to a prompt with several
+// recipients are enough to close it.
+type ApprovalPolicy struct {
+	Mode   string `json:"mode"`
+	Quorum int    `json:"quorum,omitempty"` // Approvals needed in quorum mode
+}
+
+// Validate checks the policy against the number of recipients.
+func (p *ApprovalPolicy) Validate(recipients int) error {
+	switch p.Mode {
+	case PolicyAny, PolicyAll:
+		return nil
+	case PolicyQuorum:
+		if p.Quorum < 1 || p.Quorum > recipients {
+			return fmt.Errorf("quorum must be between 1 and %d", recipients)
+		}
+		return nil
+	default:
+		return errors.New("policy mode must be any, all or quorum")
+	}
+}
+
+// required returns the number of approvals that satisfy the policy.
+func (p *ApprovalPolicy) required(recipients int) int {
+	switch p.Mode {
+	case PolicyAll:
+		return recipients
+	case PolicyQuorum:
+		return p.Quorum
+	default:
+		return 1
+	}
+}
+
+// evaluate reports whether the answers settle the policy and, if so, whether
+// the prompt was approved. A policy is settled as soon as it is satisfied or
+// can no longer be satisfied by the recipients that have not answered.
+func (p *ApprovalPolicy) evaluate(recipients int, answers []Answer) (bool, bool) {
+	required := p.required(recipients)
+	approvals, rejections := 0, 0
+	for _, answer := range answers {
+		if answer.Approved {
+			approvals++
+		} else {
+			rejections++
+		}
+	}
+	if approvals >= required {
+		return true, true
+	}
+	if rejections > recipients-required {
+		return true, false
+	}
+	return false, false
+}
+
+// Answer is one recipient's response to a prompt.
+type Answer struct {
+	Key        string         `json:"key"`
+	Response   string         `json:"response"`
+	Approved   bool           `json:"approved"`
+	AnsweredAt time.Time      `json:"answered_at"`
+	Receipt    *utils.Receipt `json:"receipt,omitempty"`
+}
+
+// approves reports whether a response counts towards the policy. Only a
+// declined confirm prompt counts against it.
+func approves(input *InputSpec, response string) bool {
+	return input == nil || input.Type != InputConfirm || response != "false"
+}
+
+// answerResult is what the poster of a prompt with several recipients
+// receives.
+type answerResult struct {
+	Outcome string          `json:"outcome"`
+	Policy  *ApprovalPolicy `json:"policy"`
+	Answers []answerEntry   `json:"answers"`
+}
+
+type answerEntry struct {
+	Key        string         `json:"key"`
+	Response   interface{}    `json:"response"`
+	Approved   bool           `json:"approved"`
+	AnsweredAt time.Time      `json:"answered_at"`
+	Receipt    *utils.Receipt `json:"receipt,omitempty"`
+}
+
+// result renders the outcome and individual answers of a settled prompt with
+// several recipients as JSON.
+func (p *Prompt) result(approved bool) string {
+	result := answerResult{
+		Outcome: OutcomeRejected,
+		Policy:  p.Policy,
+		Answers: make([]answerEntry, 0, len(p.Answers)),
+	}
+	if approved {
+		result.Outcome = OutcomeApproved
+	}
+	for _, answer := range p.Answers {
+		var response interface{} = answer.Response
+		if p.Input.IsStructured() {
+			response = json.RawMessage(answer.Response)
+		}
+		result.Answers = append(result.Answers, answerEntry{
+			Key:        answer.Key,
+			Response:   response,
+			Approved:   answer.Approved,
+			AnsweredAt: answer.AnsweredAt,
+			Receipt:    answer.Receipt,
+		})
+	}
+	data, _ := json.Marshal(result)
+	return string(data)
+}
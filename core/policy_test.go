@@ -0,0 +1,150 @@
+package core
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApprovalPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy ApprovalPolicy
+		valid  bool
+	}{
+		{"any", ApprovalPolicy{Mode: PolicyAny}, true},
+		{"all", ApprovalPolicy{Mode: PolicyAll}, true},
+		{"quorum", ApprovalPolicy{Mode: PolicyQuorum, Quorum: 2}, true},
+		{"quorum of everyone", ApprovalPolicy{Mode: PolicyQuorum, Quorum: 3}, true},
+		{"quorum of nobody", ApprovalPolicy{Mode: PolicyQuorum}, false},
+		{"quorum above recipients", ApprovalPolicy{Mode: PolicyQuorum, Quorum: 4}, false},
+		{"unknown mode", ApprovalPolicy{Mode: "majority"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Validate(3)
+			if tt.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestApprovalPolicyEvaluate(t *testing.T) {
+	yes := Answer{Approved: true}
+	no := Answer{Approved: false}
+	tests := []struct {
+		name     string
+		policy   ApprovalPolicy
+		answers  []Answer
+		settled  bool
+		approved bool
+	}{
+		{"any without answers", ApprovalPolicy{Mode: PolicyAny}, nil, false, false},
+		{"any approved", ApprovalPolicy{Mode: PolicyAny}, []Answer{yes}, true, true},
+		{"any with one rejection", ApprovalPolicy{Mode: PolicyAny}, []Answer{no}, false, false},
+		{"any rejected by everyone", ApprovalPolicy{Mode: PolicyAny}, []Answer{no, no, no}, true, false},
+		{"all with one approval", ApprovalPolicy{Mode: PolicyAll}, []Answer{yes}, false, false},
+		{"all approved", ApprovalPolicy{Mode: PolicyAll}, []Answer{yes, yes, yes}, true, true},
+		{"all rejected by one", ApprovalPolicy{Mode: PolicyAll}, []Answer{yes, no}, true, false},
+		{"quorum reached", ApprovalPolicy{Mode: PolicyQuorum, Quorum: 2}, []Answer{yes, no, yes}, true, true},
+		{"quorum still possible", ApprovalPolicy{Mode: PolicyQuorum, Quorum: 2}, []Answer{no, yes}, false, false},
+		{"quorum out of reach", ApprovalPolicy{Mode: PolicyQuorum, Quorum: 2}, []Answer{no, no}, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settled, approved := tt.policy.evaluate(3, tt.answers)
+			assert.Equal(t, tt.settled, settled)
+			assert.Equal(t, tt.approved, approved)
+		})
+	}
+}
+
+func TestAnswerWithQuorum(t *testing.T) {
+	store := NewPromptStore()
+	w := &MockResponseWriter{}
+	store.AddSSEConnection("c", w, &MockFlusher{})
+
+	var received []string
+	prompt := &Prompt{
+		Key:        "a",
+		Recipients: []string{"a", "b", "c"},
+		Policy:     &ApprovalPolicy{Mode: PolicyQuorum, Quorum: 2},
+		Message:    "deploy?",
+		Input:      &InputSpec{Type: InputConfirm},
+		ExpiresAt:  time.Now().Add(time.Minute),
+		Callback: func(response string) {
+			received = append(received, response)
+		},
+	}
+	require.NoError(t, store.Submit(prompt))
+	assert.Contains(t, w.WaitFor(`"type":"new_prompt"`), `"type":"new_prompt"`)
+
+	_, err := store.Answer(prompt.Id, "a", "true")
+	require.NoError(t, err)
+	assert.True(t, prompt.IsPending())
+
+	// Every recipient answers at most once
+	snapshot, err := store.Answer(prompt.Id, "a", "true")
+	assert.Equal(t, ErrAlreadyAnswered, err)
+	conflict := snapshot.Conflict("a")
+	assert.Equal(t, StatusPending, conflict.Status)
+	assert.NotNil(t, conflict.AnsweredAt)
+	_, err = store.Answer(prompt.Id, "d", "true")
+	assert.Equal(t, ErrNotRecipient, err)
+
+	// Recipients only see their own answer
+	views := store.PromptsFor("a")
+	require.Len(t, views, 1)
+	assert.Equal(t, "true", views[0].Response)
+	assert.Empty(t, store.PromptsFor("b")[0].Response)
+
+	_, err = store.Answer(prompt.Id, "b", "true")
+	require.NoError(t, err)
+	assert.Equal(t, StatusAnswered, prompt.Status)
+	require.Len(t, received, 1)
+
+	var result struct {
+		Outcome string `json:"outcome"`
+		Answers []struct {
+			Key      string          `json:"key"`
+			Response json.RawMessage `json:"response"`
+			Approved bool            `json:"approved"`
+		} `json:"answers"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(received[0]), &result))
+	assert.Equal(t, OutcomeApproved, result.Outcome)
+	require.Len(t, result.Answers, 2)
+	assert.Equal(t, "a", result.Answers[0].Key)
+	assert.Equal(t, "b", result.Answers[1].Key)
+	assert.Equal(t, "true", string(result.Answers[1].Response))
+
+	// The recipient that did not answer is told the prompt is closed
+	assert.Contains(t, w.WaitFor(`"type":"prompt_closed"`), `"type":"prompt_closed"`)
+
+	_, err = store.Answer(prompt.Id, "c", "false")
+	assert.Equal(t, ErrPromptClosed, err)
+}
+
+func TestAnswerWithAllRejected(t *testing.T) {
+	store := NewPromptStore()
+	prompt := &Prompt{
+		Key:        "a",
+		Recipients: []string{"a", "b"},
+		Policy:     &ApprovalPolicy{Mode: PolicyAll},
+		Message:    "deploy?",
+		Input:      &InputSpec{Type: InputConfirm},
+	}
+	require.NoError(t, store.Submit(prompt))
+
+	_, err := store.Answer(prompt.Id, "b", "false")
+	require.NoError(t, err)
+	assert.Equal(t, StatusAnswered, prompt.Status)
+	assert.Contains(t, prompt.Response, `"outcome":"rejected"`)
+	assert.Contains(t, prompt.Response, `"key":"b"`)
+}
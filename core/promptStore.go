@@ -1,54 +1,544 @@
 package core
 
 import (
+	"container/list"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"prompt-service-server/logging"
+	"prompt-service-server/metrics"
+	"prompt-service-server/utils"
+	"slices"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 // PromptStore stores prompts and manages SSE connections
 type PromptStore struct {
-	prompts     map[string]*Prompt
+	storage     Storage
 	connections map[string][]*SSEConnection
+	timers      map[string]*time.Timer
+	retention   time.Duration
+	webhooks    *Webhooks
 	mutex       sync.RWMutex
-}
 
-type SSEConnection struct {
-	writer  http.ResponseWriter
-	flusher http.Flusher
-	key     string
+	// events holds the recent events of every key for replay, and
+	// eventLogs the same logs, least recently written first. eventMutex
+	// also orders sends, so a connection that joins mid-replay sees every
+	// event exactly once. It is taken before mutex, never after.
+	events       map[string]*list.Element
+	eventLogs    *list.List
+	eventBuffer  int
+	eventEpoch   uint64
+	eventsPruned time.Time
+	eventMutex   sync.Mutex
+	// shutdownRetry is set once the server shuts down. It is guarded by
+	// eventMutex.
+	shutdownRetry time.Duration
+
+	sseQueue int
+
+	// pending counts the pending prompts of every recipient key, and
+	// stored all of their prompts
+	pending    map[string]int
+	stored     map[string]int
+	maxPending int
+
+	metrics *metrics.Metrics
+	audit   *logging.Audit
 }
 
+// Prompt statuses. A prompt starts out pending and ends in exactly one of
+// the other statuses.
+const (
+	StatusPending   = "pending"
+	StatusAnswered  = "answered"
+	StatusExpired   = "expired"
+	StatusCancelled = "cancelled"
+)
+
+// Errors returned when a response cannot be recorded.
+var (
+	ErrPromptNotFound  = errors.New("prompt not found")
+	ErrNotRecipient    = errors.New("not a recipient of the prompt")
+	ErrAlreadyAnswered = errors.New("already answered")
+	ErrPromptClosed    = errors.New("prompt already closed")
+)
+
 type Prompt struct {
-	Id       string       `json:"id"`
-	Key      string       `json:"-"`
-	Message  string       `json:"message"`
-	Callback func(string) `json:"-"`
+	Id              string         `json:"id"`
+	Key             string         `json:"-"`
+	Message         string         `json:"message"`
+	Input           *InputSpec     `json:"input,omitempty"`     // Nil means free text
+	Encrypted       bool           `json:"encrypted,omitempty"` // Message and responses are sealed boxes
+	ReplyKey        string         `json:"reply_key,omitempty"` // X25519 key responses are sealed to
+	Status          string         `json:"status"`
+	Response        string         `json:"response,omitempty"`
+	Receipt         *utils.Receipt `json:"receipt,omitempty"` // Signed by the responder, if they did
+	CreatedAt       time.Time      `json:"created_at"`
+	ExpiresAt       time.Time      `json:"expires_at"` // Zero means the prompt never expires
+	ClosedAt        time.Time      `json:"closed_at"`
+	SenderKey       string         `json:"sender_key,omitempty"`  // Set if the poster signed the prompt
+	SenderHash      string         `json:"sender_hash,omitempty"` // Hash of SenderKey, as in API paths
+	PosterTokenHash string         `json:"-"`                     // Set for prompts whose result is fetched later
+	Callback        func(string)   `json:"-"`
+	CallbackURL     string         `json:"-"` // The result is posted here when the prompt closes
+	CallbackSecret  string         `json:"-"` // Signs the posted result
+	RequestId       string         `json:"-"` // Id of the request that posted the prompt
+
+	// Recipients lists every key a prompt with several recipients is sent
+	// to, Key being the first of them. Empty for a single recipient.
+	Recipients []string        `json:"-"`
+	Policy     *ApprovalPolicy `json:"policy,omitempty"` // Nil for a single recipient
+	Answers    []Answer        `json:"-"`
+
+	closed chan struct{}
+}
+
+// IsPending reports whether the prompt still accepts a response.
+func (p *Prompt) IsPending() bool {
+	return p.Status == StatusPending
+}
+
+// RecipientKeys returns the keys the prompt is sent to.
+func (p *Prompt) RecipientKeys() []string {
+	if len(p.Recipients) == 0 {
+		return []string{p.Key}
+	}
+	return p.Recipients
+}
+
+// HasRecipient reports whether key may answer the prompt.
+func (p *Prompt) HasRecipient(key string) bool {
+	return slices.Contains(p.RecipientKeys(), key)
+}
+
+// AnswerBy returns the answer given by key, or nil if it has not answered.
+func (p *Prompt) AnswerBy(key string) *Answer {
+	for i := range p.Answers {
+		if p.Answers[i].Key == key {
+			return &p.Answers[i]
+		}
+	}
+	return nil
+}
+
+// ResponseIsJSON reports whether the response is a JSON value rather than
+// free text. Prompts with several recipients always respond with JSON.
+func (p *Prompt) ResponseIsJSON() bool {
+	return p.Policy != nil || p.Input.IsStructured()
+}
+
+// Conflict describes the answer that got there first, for a responder who
+// was too late.
+type Conflict struct {
+	Id         string         `json:"id"`
+	Status     string         `json:"status"`
+	AnsweredAt *time.Time     `json:"answered_at,omitempty"`
+	Receipt    *utils.Receipt `json:"receipt,omitempty"`
+}
+
+// Conflict returns what a late response from key learns about the prompt:
+// key's own earlier answer if it gave one, from this or another device, or
+// else the answer that closed the prompt.
+func (p *Prompt) Conflict(key string) Conflict {
+	conflict := Conflict{Id: p.Id, Status: p.Status}
+	if answer := p.AnswerBy(key); answer != nil {
+		answeredAt := answer.AnsweredAt
+		conflict.AnsweredAt = &answeredAt
+		conflict.Receipt = answer.Receipt
+	} else if p.Status == StatusAnswered {
+		closedAt := p.ClosedAt
+		conflict.AnsweredAt = &closedAt
+		conflict.Receipt = p.Receipt
+	}
+	return conflict
+}
+
+// PromptResult is what a poster learns about its prompt.
+type PromptResult struct {
+	Id        string         `json:"id"`
+	Status    string         `json:"status"`
+	Response  interface{}    `json:"response,omitempty"`
+	Receipt   *utils.Receipt `json:"receipt,omitempty"`
+	ExpiresAt time.Time      `json:"expires_at"`
+	ClosedAt  *time.Time     `json:"closed_at,omitempty"`
+}
+
+// Result returns the prompt's result for its poster. The response is only
+// included once the prompt is answered, as JSON if it is a JSON value.
+func (p *Prompt) Result() PromptResult {
+	result := PromptResult{
+		Id:        p.Id,
+		Status:    p.Status,
+		ExpiresAt: p.ExpiresAt,
+	}
+	if !p.IsPending() {
+		closedAt := p.ClosedAt
+		result.ClosedAt = &closedAt
+	}
+	if p.Status == StatusAnswered {
+		if p.ResponseIsJSON() {
+			result.Response = json.RawMessage(p.Response)
+		} else {
+			result.Response = p.Response
+		}
+		result.Receipt = p.Receipt
+	}
+	return result
+}
+
+// StoreOptions configures a PromptStore. Zero values select the defaults.
+type StoreOptions struct {
+	// Storage holds the prompts. Defaults to in-memory storage.
+	Storage Storage
+	// ResultRetention is how long a closed prompt and its result are kept.
+	// Defaults to one hour.
+	ResultRetention time.Duration
+	// Webhooks delivers the results of prompts with a CallbackURL. Results
+	// are not delivered if it is nil.
+	Webhooks *Webhooks
+	// EventBuffer is how many SSE events are kept per key for clients that
+	// reconnect. Defaults to 100.
+	EventBuffer int
+	// SSEQueue is how many events may wait for a slow SSE connection before
+	// it is dropped. Defaults to 64.
+	SSEQueue int
+	// MaxPending is how many pending prompts a recipient may have. Zero
+	// means no limit.
+	MaxPending int
+	// Metrics records prompt and SSE connection metrics. Nothing is
+	// recorded if it is nil.
+	Metrics *metrics.Metrics
+	// Audit records the lifecycle of prompts. Nothing is recorded if it is
+	// nil.
+	Audit *logging.Audit
 }
 
 func NewPromptStore() *PromptStore {
-	return &PromptStore{
-		prompts:     make(map[string]*Prompt),
+	return NewPromptStoreWithOptions(StoreOptions{})
+}
+
+// NewPromptStoreWithOptions creates a PromptStore on top of the configured
+// storage. Prompts already in the storage are restored: pending prompts are
+// served again and closed ones are kept until their retention runs out.
+func NewPromptStoreWithOptions(opts StoreOptions) *PromptStore {
+	storage := opts.Storage
+	if storage == nil {
+		storage = NewMemoryStorage()
+	}
+	retention := opts.ResultRetention
+	if retention <= 0 {
+		retention = time.Hour
+	}
+	eventBuffer := opts.EventBuffer
+	if eventBuffer <= 0 {
+		eventBuffer = defaultEventBuffer
+	}
+	sseQueue := opts.SSEQueue
+	if sseQueue <= 0 {
+		sseQueue = defaultSSEQueue
+	}
+	s := &PromptStore{
+		storage:     storage,
 		connections: make(map[string][]*SSEConnection),
+		timers:      make(map[string]*time.Timer),
+		retention:   retention,
+		webhooks:    opts.Webhooks,
+		events:      make(map[string]*list.Element),
+		eventLogs:   list.New(),
+		eventBuffer: eventBuffer,
+		// Event ids continue from the clock, so ids from before a restart
+		// are older than any id handed out after it
+		eventEpoch: uint64(time.Now().UnixMicro()),
+		sseQueue:   sseQueue,
+		pending:    make(map[string]int),
+		stored:     make(map[string]int),
+		maxPending: opts.MaxPending,
+		metrics:    opts.Metrics,
+		audit:      opts.Audit,
 	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, prompt := range storage.List() {
+		// Journals written before statuses existed only hold pending prompts
+		if prompt.Status == "" {
+			prompt.Status = StatusPending
+		}
+		prompt.closed = make(chan struct{})
+		if !prompt.IsPending() {
+			close(prompt.closed)
+		} else {
+			s.countPending(prompt, 1)
+		}
+		s.countStored(prompt, 1)
+		s.scheduleTimer(prompt)
+	}
+	return s
 }
 
 func (s *PromptStore) AddPrompt(key string, message string, callback func(string)) string {
-	s.mutex.Lock()
-
 	prompt := &Prompt{
-		Id:       uuid.New().String(),
 		Key:      key,
 		Message:  message,
 		Callback: callback,
 	}
-	s.prompts[prompt.Id] = prompt
+	if err := s.Submit(prompt); err != nil {
+		slog.Error("Failed to store prompt", "prompt_id", prompt.Id, "error", err)
+	}
+	return prompt.Id
+}
+
+// Submit assigns the prompt an id, stores it and notifies the recipient.
+// The prompt is not announced if it could not be stored. Returns a
+// *QuotaError if a recipient already has MaxPending pending prompts.
+func (s *PromptStore) Submit(prompt *Prompt) error {
+	s.mutex.Lock()
+
+	if err := s.checkQuota(prompt); err != nil {
+		s.mutex.Unlock()
+		s.metrics.QuotaRejected()
+		return err
+	}
+	prompt.Id = uuid.New().String()
+	prompt.Status = StatusPending
+	prompt.CreatedAt = time.Now()
+	prompt.closed = make(chan struct{})
+	err := s.storage.Put(prompt)
+	if err == nil {
+		s.countPending(prompt, 1)
+		s.countStored(prompt, 1)
+		s.scheduleTimer(prompt)
+		s.metrics.PromptCreated()
+	}
 	s.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	s.audit.Record(logging.WithRequestID(context.Background(), prompt.RequestId), logging.AuditPromptCreated,
+		"prompt_id", prompt.Id,
+		"recipients", hashKeys(prompt.RecipientKeys()),
+		"sender_hash", prompt.SenderHash,
+		"encrypted", prompt.Encrypted,
+		"expires_at", prompt.ExpiresAt)
 	s.NotifySSEConnections(prompt)
-	return prompt.Id
+	return nil
+}
+
+// hashKeys returns the hashes of keys, which identify them in the audit
+// stream as in API paths.
+func hashKeys(keys []string) []string {
+	hashes := make([]string, len(keys))
+	for i, key := range keys {
+		hashes[i] = utils.HashPublicKey(key)
+	}
+	return hashes
+}
+
+// scheduleTimer arms the expiry timer of a pending prompt, or the purge
+// timer of a closed one. The caller must hold the write lock.
+func (s *PromptStore) scheduleTimer(prompt *Prompt) {
+	if timer, exists := s.timers[prompt.Id]; exists {
+		timer.Stop()
+		delete(s.timers, prompt.Id)
+	}
+	id := prompt.Id
+	if prompt.IsPending() {
+		if prompt.ExpiresAt.IsZero() {
+			return
+		}
+		s.timers[id] = time.AfterFunc(time.Until(prompt.ExpiresAt), func() {
+			s.ExpirePrompt(id)
+		})
+		return
+	}
+	s.timers[id] = time.AfterFunc(time.Until(prompt.ClosedAt.Add(s.retention)), func() {
+		s.RemovePrompt(id)
+	})
+}
+
+// close moves a pending prompt to a final status, persists it and schedules
+// its removal. The caller must hold the write lock.
+func (s *PromptStore) close(prompt *Prompt, status string, response string) {
+	s.countPending(prompt, -1)
+	prompt.Status = status
+	prompt.Response = response
+	prompt.ClosedAt = time.Now()
+	if err := s.storage.Put(prompt); err != nil {
+		slog.Error("Failed to store prompt", "prompt_id", prompt.Id, "error", err)
+	}
+	close(prompt.closed)
+	s.scheduleTimer(prompt)
+	s.metrics.PromptClosed(status, prompt.CreatedAt, prompt.ClosedAt)
+	if prompt.CallbackURL != "" && s.webhooks != nil {
+		s.webhooks.Deliver(*prompt)
+	}
+}
+
+// Answer records key's response to a pending prompt. A prompt with a single
+// recipient closes right away. A prompt with several recipients closes once
+// its policy is settled, with the outcome and every answer as its response.
+// The prompt's callback is called with the response when the prompt closes.
+// Checking and answering happen under one lock, so of two responses that
+// race only the first is recorded. Returns a snapshot of the prompt, or
+// ErrPromptNotFound, ErrNotRecipient, ErrAlreadyAnswered or ErrPromptClosed
+// with a snapshot describing the answer that got there first.
+func (s *PromptStore) Answer(id string, key string, response string) (Prompt, error) {
+	return s.AnswerWithReceipt(id, key, response, nil)
+}
+
+// AnswerWithReceipt is Answer for a response that comes with the receipt the
+// responder signed. The receipt is kept with the answer so the poster can
+// verify it.
+func (s *PromptStore) AnswerWithReceipt(id string, key string, response string, receipt *utils.Receipt) (Prompt, error) {
+	return s.AnswerContext(context.Background(), id, key, response, receipt)
+}
+
+// AnswerContext is AnswerWithReceipt for the request carried by ctx. Its
+// request id is recorded in the audit stream and the events sent.
+func (s *PromptStore) AnswerContext(ctx context.Context, id string, key string, response string, receipt *utils.Receipt) (Prompt, error) {
+	snapshot, err := s.answer(ctx, id, key, response, receipt)
+	if err != nil {
+		s.audit.Record(ctx, logging.AuditAnswerRejected,
+			"prompt_id", id,
+			"key_hash", utils.HashPublicKey(key),
+			"reason", err.Error())
+	} else {
+		s.audit.Record(ctx, logging.AuditPromptAnswered,
+			"prompt_id", id,
+			"key_hash", utils.HashPublicKey(key),
+			"status", snapshot.Status,
+			"receipt", receipt != nil)
+	}
+	return snapshot, err
+}
+
+func (s *PromptStore) answer(ctx context.Context, id string, key string, response string, receipt *utils.Receipt) (Prompt, error) {
+	s.mutex.Lock()
+	prompt, exists := s.storage.Get(id)
+	if !exists {
+		s.mutex.Unlock()
+		return Prompt{}, ErrPromptNotFound
+	}
+	var err error
+	switch {
+	case !prompt.HasRecipient(key):
+		err = ErrNotRecipient
+	case prompt.AnswerBy(key) != nil:
+		err = ErrAlreadyAnswered
+	case !prompt.IsPending():
+		err = ErrPromptClosed
+	}
+	if err != nil {
+		snapshot := *prompt
+		s.mutex.Unlock()
+		return snapshot, err
+	}
+	settled, result := true, response
+	if prompt.Policy != nil {
+		prompt.Answers = append(prompt.Answers, Answer{
+			Key:        key,
+			Response:   response,
+			Approved:   approves(prompt.Input, response),
+			AnsweredAt: time.Now(),
+			Receipt:    receipt,
+		})
+		var approved bool
+		settled, approved = prompt.Policy.evaluate(len(prompt.Recipients), prompt.Answers)
+		if settled {
+			result = prompt.result(approved)
+		} else if err := s.storage.Put(prompt); err != nil {
+			slog.Error("Failed to store prompt", "prompt_id", prompt.Id, "error", err)
+		}
+	}
+	if prompt.Policy == nil {
+		prompt.Receipt = receipt
+	}
+	var unanswered []string
+	if settled {
+		s.close(prompt, StatusAnswered, result)
+		for _, recipient := range prompt.RecipientKeys() {
+			if recipient != key && prompt.AnswerBy(recipient) == nil {
+				unanswered = append(unanswered, recipient)
+			}
+		}
+	}
+	callback := prompt.Callback
+	snapshot := *prompt
+	s.mutex.Unlock()
+
+	requestId := logging.RequestID(ctx)
+	s.sendEvent(key, event{eventType: "prompt_responded", data: response, id: id, requestId: requestId})
+	for _, recipient := range unanswered {
+		// The other recipients no longer need to answer
+		s.sendEvent(recipient, event{eventType: "prompt_closed", id: id, requestId: requestId})
+	}
+	if settled && callback != nil {
+		callback(result)
+	}
+	return snapshot, nil
+}
+
+// Result returns a snapshot of the prompt. If the prompt is still pending it
+// waits until the prompt closes or the context is done, whichever is first.
+func (s *PromptStore) Result(ctx context.Context, id string) (Prompt, bool) {
+	s.mutex.RLock()
+	prompt, exists := s.storage.Get(id)
+	s.mutex.RUnlock()
+	if !exists {
+		return Prompt{}, false
+	}
+
+	select {
+	case <-prompt.closed:
+	case <-ctx.Done():
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return *prompt, true
+}
+
+// ExpirePrompt closes a prompt whose time ran out and tells the recipient's
+// connections to drop it. Returns false if the prompt was not pending.
+func (s *PromptStore) ExpirePrompt(id string) bool {
+	return s.endPrompt(id, StatusExpired, "prompt_expired")
+}
+
+// CancelPrompt closes a prompt whose poster stopped waiting and tells the
+// recipient's connections to drop it. Returns false if the prompt was not
+// pending.
+func (s *PromptStore) CancelPrompt(id string) bool {
+	return s.endPrompt(id, StatusCancelled, "prompt_cancelled")
+}
+
+// endPrompt closes an unanswered prompt and broadcasts why it went away.
+func (s *PromptStore) endPrompt(id string, status string, eventType string) bool {
+	s.mutex.Lock()
+	prompt, exists := s.storage.Get(id)
+	pending := exists && prompt.IsPending()
+	if pending {
+		s.close(prompt, status, "")
+	}
+	s.mutex.Unlock()
+	if !pending {
+		return false
+	}
+	auditEvent := logging.AuditPromptExpired
+	if status == StatusCancelled {
+		auditEvent = logging.AuditPromptCancelled
+	}
+	s.audit.Record(logging.WithRequestID(context.Background(), prompt.RequestId), auditEvent, "prompt_id", prompt.Id)
+	for _, key := range prompt.RecipientKeys() {
+		s.SendEventToConnections(key, eventType, "", prompt.Id)
+	}
+	return true
 }
 
 func (s *PromptStore) GetPrompts(key string, id string) []*Prompt {
@@ -56,42 +546,149 @@ func (s *PromptStore) GetPrompts(key string, id string) []*Prompt {
 	defer s.mutex.RUnlock()
 
 	prompts := []*Prompt{}
-	for _, prompt := range s.prompts {
-		if prompt.Key == key || prompt.Id == id {
+	for _, prompt := range s.storage.List() {
+		if prompt.HasRecipient(key) || prompt.Id == id {
 			prompts = append(prompts, prompt)
 		}
 	}
 	return prompts
 }
 
-// Add this to PromptStore
+// PromptsFor returns the prompts sent to key as that recipient sees them.
+// The response of a prompt with several recipients is replaced by key's own
+// answer, so recipients do not see each other's answers.
+func (s *PromptStore) PromptsFor(key string) []Prompt {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	prompts := []Prompt{}
+	for _, prompt := range s.storage.List() {
+		if !prompt.HasRecipient(key) {
+			continue
+		}
+		view := *prompt
+		if prompt.Policy != nil {
+			view.Response = ""
+			if answer := prompt.AnswerBy(key); answer != nil {
+				view.Response = answer.Response
+			}
+		}
+		prompts = append(prompts, view)
+	}
+	return prompts
+}
+
+// RemovePrompt deletes a prompt along with the data its events carry.
 func (s *PromptStore) RemovePrompt(id string) {
+	s.eventMutex.Lock()
+	defer s.eventMutex.Unlock()
+
+	s.mutex.Lock()
+	prompt, exists := s.storage.Get(id)
+	s.removePrompt(id)
+	s.mutex.Unlock()
+	if exists {
+		s.forgetEvents(prompt)
+	}
+}
+
+// removePrompt deletes a prompt and its timer. The caller must hold the write
+// lock.
+func (s *PromptStore) removePrompt(id string) {
+	if timer, exists := s.timers[id]; exists {
+		timer.Stop()
+		delete(s.timers, id)
+	}
+	if prompt, exists := s.storage.Get(id); exists {
+		if prompt.IsPending() {
+			s.countPending(prompt, -1)
+		}
+		s.countStored(prompt, -1)
+	}
+	if err := s.storage.Delete(id); err != nil {
+		slog.Error("Failed to remove prompt", "prompt_id", id, "error", err)
+	}
+}
+
+// Close closes the underlying storage.
+func (s *PromptStore) Close() error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	delete(s.prompts, id)
+	for id, timer := range s.timers {
+		timer.Stop()
+		delete(s.timers, id)
+	}
+	return s.storage.Close()
 }
 
 func (s *PromptStore) NotifySSEConnections(prompt *Prompt) {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-	s.SendEventToConnections(prompt.Key, "new_prompt", prompt.Message, prompt.Id)
+	for _, key := range prompt.RecipientKeys() {
+		s.sendEvent(key, event{eventType: "new_prompt", data: prompt.Message, id: prompt.Id, sender: prompt.SenderHash, requestId: prompt.RequestId})
+	}
 }
 
 // Add this to PromptStore
 func (s *PromptStore) AddSSEConnection(key string, writer http.ResponseWriter, flusher http.Flusher) *SSEConnection {
+	connection := newSSEConnection(key, writer, flusher, s.sseQueue)
+	s.addSSEConnection(connection)
+	return connection
+}
+
+// addSSEConnection registers a connection and starts its writer.
+func (s *PromptStore) addSSEConnection(connection *SSEConnection) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	connection := &SSEConnection{
-		writer:  writer,
-		flusher: flusher,
-		key:     key,
+	s.connections[connection.key] = append(s.connections[connection.key], connection)
+	s.metrics.SSEConnectionsChanged(1)
+	go connection.run()
+}
+
+// ResumeSSEConnection adds a connection for a client that may be
+// reconnecting. If lastEventId is the id of a recent event for key, the
+// client gets a "reconnected" event followed by every event it missed.
+// Otherwise it gets a "connected" event and has to fetch its prompts again.
+func (s *PromptStore) ResumeSSEConnection(key string, writer http.ResponseWriter, flusher http.Flusher, lastEventId string) *SSEConnection {
+	s.eventMutex.Lock()
+	defer s.eventMutex.Unlock()
+
+	var missed []event
+	resumed := false
+	if seq, err := strconv.ParseUint(lastEventId, 10, 64); err == nil {
+		// Without a log, nothing that happened since is known
+		if element, exists := s.events[key]; exists {
+			missed, resumed = element.Value.(*eventLog).since(seq)
+		}
+	}
+	// The replay is queued before any live event, and always fits
+	connection := newSSEConnection(key, writer, flusher, max(s.sseQueue, len(missed)+1))
+	if s.shutdownRetry > 0 {
+		// Too late; come back to the next server
+		connection.finish(shutdownEvent(s.shutdownRetry))
+		go connection.run()
+		return connection
 	}
-	s.connections[key] = append(s.connections[key], connection)
+	if resumed {
+		connection.enqueue(formatEvent(event{eventType: "reconnected", data: "Connection resumed", id: key}))
+		for _, e := range missed {
+			connection.enqueue(formatEvent(e))
+		}
+	} else {
+		connection.enqueue(formatEvent(event{eventType: "connected", data: "Connection established", id: key}))
+	}
+	s.addSSEConnection(connection)
 	return connection
 }
 
+// RemoveSSEConnection unregisters a connection and waits for its writer to
+// stop, so the response writer can be released.
 func (s *PromptStore) RemoveSSEConnection(key string, connection *SSEConnection) {
+	s.unregisterSSEConnection(key, connection)
+	connection.close()
+	connection.wait()
+}
+
+func (s *PromptStore) unregisterSSEConnection(key string, connection *SSEConnection) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
@@ -99,31 +696,88 @@ func (s *PromptStore) RemoveSSEConnection(key string, connection *SSEConnection)
 		for i, conn := range connections {
 			if conn == connection {
 				s.connections[key] = append(connections[:i], connections[i+1:]...)
+				s.metrics.SSEConnectionsChanged(-1)
 				break
 			}
 		}
+		if len(s.connections[key]) == 0 {
+			delete(s.connections, key)
+		}
 	}
 }
 
+// dropSSEConnection closes a connection that cannot keep up. The handler
+// serving it notices through Done.
+func (s *PromptStore) dropSSEConnection(connection *SSEConnection, reason string) {
+	slog.Warn("Dropping SSE connection", "key_hash", utils.HashPublicKey(connection.key), "reason", reason)
+	s.unregisterSSEConnection(connection.key, connection)
+	connection.close()
+}
+
+// SendEventToConnections records an event for key and queues it for every
+// connection of key. It never waits for a connection to write.
 func (s *PromptStore) SendEventToConnections(key string, eventType string, data string, id string) {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
+	s.sendEvent(key, event{eventType: eventType, data: data, id: id})
+}
 
-	if connections, exists := s.connections[key]; exists {
-		for _, conn := range connections {
-			s.SendEvent(conn.writer, conn.flusher, eventType, data, id)
+// sendEvent is SendEventToConnections for an event with every field set.
+func (s *PromptStore) sendEvent(key string, e event) {
+	s.eventMutex.Lock()
+	defer s.eventMutex.Unlock()
+
+	message := formatEvent(s.eventLog(key).append(e))
+	s.mutex.RLock()
+	connections := append([]*SSEConnection(nil), s.connections[key]...)
+	s.mutex.RUnlock()
+	for _, conn := range connections {
+		if !conn.enqueue(message) {
+			s.dropSSEConnection(conn, "send queue full")
 		}
 	}
 }
 
+// SendEventToConnection queues an event that is not kept for replay, such
+// as a heartbeat, for a single connection.
+func (s *PromptStore) SendEventToConnection(connection *SSEConnection, eventType string, data string, id string) {
+	if !connection.enqueue(formatEvent(event{eventType: eventType, data: data, id: id})) {
+		s.dropSSEConnection(connection, "send queue full")
+	}
+}
+
+// SendEvent writes an event directly to a response writer that is not
+// registered as a connection.
 func (s *PromptStore) SendEvent(w http.ResponseWriter, flusher http.Flusher, eventType string, data string, id string) {
+	w.Write(formatEvent(event{eventType: eventType, data: data, id: id}))
+	flusher.Flush()
+}
+
+// formatEvent encodes an event for the wire. Recorded events carry their
+// sequence number as the SSE id, so the browser sends it back as
+// Last-Event-ID when it reconnects.
+func formatEvent(e event) []byte {
 	eventData := map[string]string{
-		"type":    eventType,
-		"content": data,
-		"id":      id,
+		"type":    e.eventType,
+		"content": e.data,
+		"id":      e.id,
+	}
+	if e.sender != "" {
+		eventData["sender"] = e.sender
+	}
+	if e.requestId != "" {
+		eventData["request_id"] = e.requestId
+	}
+	if e.retry > 0 {
+		eventData["retry"] = strconv.FormatInt(e.retry.Milliseconds(), 10)
 	}
 	jsonData, _ := json.Marshal(eventData)
-	event := fmt.Sprintf("data: %s\n\n", jsonData)
-	w.Write([]byte(event))
-	flusher.Flush()
+	var message string
+	if e.seq != 0 {
+		message = fmt.Sprintf("id: %d\n", e.seq)
+	}
+	if e.retry > 0 {
+		// Browsers wait this long before they reconnect
+		message += fmt.Sprintf("retry: %d\n", e.retry.Milliseconds())
+	}
+	message += fmt.Sprintf("data: %s\n\n", jsonData)
+	return []byte(message)
 }
@@ -1,9 +1,17 @@
 package core
 
 import (
+	"bytes"
+	"context"
 	"net/http"
+	"prompt-service-server/metrics"
+	"prompt-service-server/utils"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -12,7 +20,7 @@ import (
 func TestNewPromptStore(t *testing.T) {
 	store := NewPromptStore()
 	assert.NotNil(t, store)
-	assert.NotNil(t, store.prompts)
+	assert.NotNil(t, store.storage)
 	assert.NotNil(t, store.connections)
 }
 
@@ -87,7 +95,8 @@ func TestRemovePrompt(t *testing.T) {
 
 // MockResponseWriter is a mock http.ResponseWriter for testing
 type MockResponseWriter struct {
-	data []byte
+	data  []byte
+	mutex sync.Mutex
 }
 
 func (m *MockResponseWriter) Header() http.Header {
@@ -95,10 +104,30 @@ func (m *MockResponseWriter) Header() http.Header {
 }
 
 func (m *MockResponseWriter) Write(data []byte) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	m.data = append(m.data, data...)
 	return len(data), nil
 }
 
+// String returns everything written so far. Safe to call while events are
+// being written from other goroutines.
+func (m *MockResponseWriter) String() string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return string(m.data)
+}
+
+// WaitFor returns everything written once fragment shows up, or after a
+// second if it never does. Connections write from their own goroutine.
+func (m *MockResponseWriter) WaitFor(fragment string) string {
+	deadline := time.Now().Add(time.Second)
+	for !strings.Contains(m.String(), fragment) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	return m.String()
+}
+
 func (m *MockResponseWriter) WriteHeader(statusCode int) {
 	// No-op for testing
 }
@@ -156,9 +185,10 @@ func TestSendEventToConnections(t *testing.T) {
 	store.SendEventToConnections(key, "test_event", "test data", "test-id")
 
 	// Verify event was sent
-	assert.Contains(t, string(w.data), `"type":"test_event"`)
-	assert.Contains(t, string(w.data), `"content":"test data"`)
-	assert.Contains(t, string(w.data), `"id":"test-id"`)
+	data := w.WaitFor(`"type":"test_event"`)
+	assert.Contains(t, data, `"type":"test_event"`)
+	assert.Contains(t, data, `"content":"test data"`)
+	assert.Contains(t, data, `"id":"test-id"`)
 }
 
 func TestSendEvent(t *testing.T) {
@@ -196,6 +226,222 @@ func TestNotifySSEConnections(t *testing.T) {
 	store.NotifySSEConnections(prompt)
 
 	// Verify notification was sent
-	assert.Contains(t, string(w.data), `"type":"new_prompt"`)
-	assert.Contains(t, string(w.data), `"content":"test message"`)
+	data := w.WaitFor(`"type":"new_prompt"`)
+	assert.Contains(t, data, `"type":"new_prompt"`)
+	assert.Contains(t, data, `"content":"test message"`)
+}
+
+func TestExpirePrompt(t *testing.T) {
+	store := NewPromptStore()
+	key := "test-key"
+
+	w := &MockResponseWriter{}
+	flusher := &MockFlusher{}
+	store.AddSSEConnection(key, w, flusher)
+
+	prompt := &Prompt{
+		Key:       key,
+		Message:   "short lived",
+		ExpiresAt: time.Now().Add(20 * time.Millisecond),
+	}
+	require.NoError(t, store.Submit(prompt))
+	assert.Len(t, store.GetPrompts(key, ""), 1)
+
+	time.Sleep(100 * time.Millisecond)
+
+	// The timer closed the prompt and told the recipient
+	prompts := store.GetPrompts(key, "")
+	require.Len(t, prompts, 1)
+	assert.Equal(t, StatusExpired, prompts[0].Status)
+	assert.Contains(t, w.WaitFor(`"type":"prompt_expired"`), `"type":"prompt_expired"`)
+	assert.False(t, store.ExpirePrompt(prompt.Id))
+}
+
+func TestCancelPrompt(t *testing.T) {
+	store := NewPromptStore()
+	key := "test-key"
+
+	w := &MockResponseWriter{}
+	flusher := &MockFlusher{}
+	store.AddSSEConnection(key, w, flusher)
+
+	id := store.AddPrompt(key, "poster left", func(string) {})
+
+	assert.True(t, store.CancelPrompt(id))
+	prompts := store.GetPrompts(key, "")
+	require.Len(t, prompts, 1)
+	assert.Equal(t, StatusCancelled, prompts[0].Status)
+	assert.Contains(t, w.WaitFor(`"type":"prompt_cancelled"`), `"type":"prompt_cancelled"`)
+	assert.Contains(t, w.String(), `"id":"`+id+`"`)
+
+	// Cancelling twice is a no-op
+	assert.False(t, store.CancelPrompt(id))
+}
+
+func TestAnswer(t *testing.T) {
+	store := NewPromptStore()
+
+	var received []string
+	id := store.AddPrompt("key", "question", func(response string) {
+		received = append(received, response)
+	})
+
+	prompt, err := store.Answer(id, "key", "first")
+	require.NoError(t, err)
+	assert.Equal(t, StatusAnswered, prompt.Status)
+	assert.Equal(t, "first", prompt.Response)
+	assert.False(t, prompt.ClosedAt.IsZero())
+
+	// Closed prompts keep their answer and reject further responses
+	conflict, err := store.Answer(id, "key", "second")
+	assert.Equal(t, ErrPromptClosed, err)
+	assert.Equal(t, "first", conflict.Response)
+	assert.Equal(t, []string{"first"}, received)
+
+	_, err = store.Answer("unknown", "key", "response")
+	assert.Equal(t, ErrPromptNotFound, err)
+}
+
+func TestConcurrentAnswers(t *testing.T) {
+	store := NewPromptStore()
+
+	signal := utils.NewSignal()
+	var calls int32
+	id := store.AddPrompt("key", "question", func(response string) {
+		atomic.AddInt32(&calls, 1)
+		signal.Signal(response)
+	})
+
+	// Many devices answer at once; exactly one of them wins
+	const responders = 50
+	var wg sync.WaitGroup
+	var wins, conflicts int32
+	for i := 0; i < responders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := store.Answer(id, "key", strconv.Itoa(i))
+			switch err {
+			case nil:
+				atomic.AddInt32(&wins, 1)
+			case ErrPromptClosed:
+				atomic.AddInt32(&conflicts, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), wins)
+	assert.Equal(t, int32(responders-1), conflicts)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	prompt, _ := store.Result(context.Background(), id)
+	assert.Equal(t, prompt.Response, signal.Wait())
+}
+
+func TestConflict(t *testing.T) {
+	store := NewPromptStore()
+	receipt := &utils.Receipt{PromptId: "id", Signature: "signature"}
+	id := store.AddPrompt("key", "question", nil)
+	_, err := store.AnswerWithReceipt(id, "key", "yes", receipt)
+	require.NoError(t, err)
+
+	prompt, err := store.Answer(id, "key", "no")
+	require.Equal(t, ErrPromptClosed, err)
+	conflict := prompt.Conflict("key")
+	assert.Equal(t, id, conflict.Id)
+	assert.Equal(t, StatusAnswered, conflict.Status)
+	require.NotNil(t, conflict.AnsweredAt)
+	assert.Equal(t, prompt.ClosedAt, *conflict.AnsweredAt)
+	assert.Equal(t, receipt, conflict.Receipt)
+
+	// An expired prompt was never answered
+	id = store.AddPrompt("key", "question", nil)
+	store.ExpirePrompt(id)
+	prompt, err = store.Answer(id, "key", "yes")
+	require.Equal(t, ErrPromptClosed, err)
+	conflict = prompt.Conflict("key")
+	assert.Equal(t, StatusExpired, conflict.Status)
+	assert.Nil(t, conflict.AnsweredAt)
+}
+
+func TestAnswerFromNonRecipient(t *testing.T) {
+	store := NewPromptStore()
+	id := store.AddPrompt("key", "question", nil)
+
+	_, err := store.Answer(id, "other", "response")
+	assert.Equal(t, ErrNotRecipient, err)
+	assert.True(t, store.GetPrompts("", id)[0].IsPending())
+}
+
+func TestResult(t *testing.T) {
+	store := NewPromptStore()
+	id := store.AddPrompt("key", "question", nil)
+
+	// A pending prompt is returned as is once the wait runs out
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	result, exists := store.Result(ctx, id)
+	require.True(t, exists)
+	assert.Equal(t, StatusPending, result.Status)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		store.Answer(id, "key", "late answer")
+	}()
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	result, exists = store.Result(ctx, id)
+	require.True(t, exists)
+	assert.Equal(t, StatusAnswered, result.Status)
+	assert.Equal(t, "late answer", result.Response)
+
+	_, exists = store.Result(context.Background(), "unknown")
+	assert.False(t, exists)
+}
+
+func TestClosedPromptsArePurgedAfterRetention(t *testing.T) {
+	store := NewPromptStoreWithOptions(StoreOptions{ResultRetention: 20 * time.Millisecond})
+	id := store.AddPrompt("key", "question", nil)
+
+	_, err := store.Answer(id, "key", "answer")
+	require.NoError(t, err)
+	assert.Len(t, store.GetPrompts("", id), 1)
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, store.GetPrompts("", id), 0)
+}
+
+func TestStoreMetrics(t *testing.T) {
+	m := metrics.New()
+	store := NewPromptStoreWithOptions(StoreOptions{Metrics: m, MaxPending: 1})
+
+	answered := &Prompt{Key: "key", Message: "Deploy?"}
+	require.NoError(t, store.Submit(answered))
+	require.Error(t, store.Submit(&Prompt{Key: "key", Message: "Again?"}))
+	_, err := store.Answer(answered.Id, "key", "yes")
+	require.NoError(t, err)
+	expired := &Prompt{Key: "key", Message: "Still there?"}
+	require.NoError(t, store.Submit(expired))
+	store.ExpirePrompt(expired.Id)
+	require.NoError(t, store.Submit(&Prompt{Key: "key", Message: "Pending"}))
+
+	connection := store.AddSSEConnection("key", &MockResponseWriter{}, &MockFlusher{})
+
+	var out bytes.Buffer
+	m.Registry.Write(&out)
+	text := out.String()
+	assert.Contains(t, text, "prompt_service_prompts_created_total 3\n")
+	assert.Contains(t, text, "prompt_service_prompts_closed_total{status=\"answered\"} 1\n")
+	assert.Contains(t, text, "prompt_service_prompts_closed_total{status=\"expired\"} 1\n")
+	assert.Contains(t, text, "prompt_service_prompts_pending 1\n")
+	assert.Contains(t, text, "prompt_service_time_to_answer_seconds_count 1\n")
+	assert.Contains(t, text, "prompt_service_pending_quota_rejections_total 1\n")
+	assert.Contains(t, text, "prompt_service_sse_connections 1\n")
+
+	store.RemoveSSEConnection("key", connection)
+	out.Reset()
+	m.Registry.Write(&out)
+	assert.Contains(t, out.String(), "prompt_service_sse_connections 0\n")
 }
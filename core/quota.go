@@ -0,0 +1,67 @@
+package core
+
+import "time"
+
+// QuotaError is returned by Submit when a recipient already has as many
+// pending prompts as it may have.
+type QuotaError struct {
+	Key string
+	// RetryAfter is how long until the recipient's oldest pending prompt
+	// expires, or zero if none of them expire.
+	RetryAfter time.Duration
+}
+
+func (e *QuotaError) Error() string {
+	return "recipient has too many pending prompts"
+}
+
+// checkQuota returns a *QuotaError if a recipient of prompt is at its
+// pending limit. The caller must hold the lock.
+func (s *PromptStore) checkQuota(prompt *Prompt) error {
+	if s.maxPending <= 0 {
+		return nil
+	}
+	for _, key := range prompt.RecipientKeys() {
+		if s.pending[key] >= s.maxPending {
+			return &QuotaError{Key: key, RetryAfter: s.nextExpiry(key)}
+		}
+	}
+	return nil
+}
+
+// nextExpiry returns how long until the first pending prompt of key
+// expires. The caller must hold the lock.
+func (s *PromptStore) nextExpiry(key string) time.Duration {
+	var next time.Time
+	for _, prompt := range s.storage.List() {
+		if !prompt.IsPending() || prompt.ExpiresAt.IsZero() || !prompt.HasRecipient(key) {
+			continue
+		}
+		if next.IsZero() || prompt.ExpiresAt.Before(next) {
+			next = prompt.ExpiresAt
+		}
+	}
+	if next.IsZero() {
+		return 0
+	}
+	return max(time.Until(next), 0)
+}
+
+// countPending adds delta to the pending count of every recipient of
+// prompt. The caller must hold the write lock.
+func (s *PromptStore) countPending(prompt *Prompt, delta int) {
+	for _, key := range prompt.RecipientKeys() {
+		s.pending[key] += delta
+		if s.pending[key] <= 0 {
+			delete(s.pending, key)
+		}
+	}
+	s.metrics.PendingChanged(delta)
+}
+
+// Pending returns how many pending prompts key has.
+func (s *PromptStore) Pending(key string) int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.pending[key]
+}
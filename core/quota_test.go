@@ -0,0 +1,56 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPendingQuota(t *testing.T) {
+	store := NewPromptStoreWithOptions(StoreOptions{MaxPending: 2})
+	expiresAt := time.Now().Add(time.Minute)
+
+	first := &Prompt{Key: "key", Message: "one", ExpiresAt: expiresAt}
+	require.NoError(t, store.Submit(first))
+	require.NoError(t, store.Submit(&Prompt{Key: "key", Message: "two", ExpiresAt: expiresAt.Add(time.Minute)}))
+	assert.Equal(t, 2, store.Pending("key"))
+
+	err := store.Submit(&Prompt{Key: "key", Message: "three"})
+	var quota *QuotaError
+	require.True(t, errors.As(err, &quota))
+	assert.Equal(t, "key", quota.Key)
+	assert.True(t, quota.RetryAfter > 50*time.Second && quota.RetryAfter <= time.Minute, quota.RetryAfter)
+
+	// Other recipients are not affected
+	require.NoError(t, store.Submit(&Prompt{Key: "other", Message: "one"}))
+
+	// Closing a prompt frees its slot
+	_, err = store.Answer(first.Id, "key", "done")
+	require.NoError(t, err)
+	assert.Equal(t, 1, store.Pending("key"))
+	require.NoError(t, store.Submit(&Prompt{Key: "key", Message: "three"}))
+}
+
+func TestPendingQuotaCountsEveryRecipient(t *testing.T) {
+	store := NewPromptStoreWithOptions(StoreOptions{MaxPending: 1})
+	shared := &Prompt{
+		Key:        "a",
+		Recipients: []string{"a", "b"},
+		Policy:     &ApprovalPolicy{Mode: PolicyAll},
+		Message:    "release?",
+	}
+	require.NoError(t, store.Submit(shared))
+
+	var quota *QuotaError
+	require.True(t, errors.As(store.Submit(&Prompt{Key: "b", Message: "hi"}), &quota))
+	assert.Equal(t, "b", quota.Key)
+	assert.Equal(t, time.Duration(0), quota.RetryAfter) // Nothing pending expires
+
+	require.True(t, store.ExpirePrompt(shared.Id))
+	assert.Equal(t, 0, store.Pending("a"))
+	assert.Equal(t, 0, store.Pending("b"))
+	assert.NoError(t, store.Submit(&Prompt{Key: "b", Message: "hi"}))
+}
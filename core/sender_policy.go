@@ -0,0 +1,107 @@
+package core
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Sender policy modes. A recipient's policy decides whose prompts reach it.
+const (
+	SenderPolicyOpen      = "open"      // Everyone, signed or not
+	SenderPolicyAllowlist = "allowlist" // Only signed prompts from the listed senders
+	SenderPolicyBlocklist = "blocklist" // Everyone but the listed senders
+)
+
+// MaxDifficulty is the most proof of work a policy may ask for, in leading
+// zero bits. Each bit doubles the poster's work, and 24 bits already take a
+// browser seconds.
+const MaxDifficulty = 32
+
+// ErrSenderRejected is returned when a recipient's sender policy does not
+// accept a prompt.
+var ErrSenderRejected = errors.New("recipient does not accept prompts from this sender")
+
+// SenderPolicy is a recipient's rule for which posters may send it prompts.
+// Keys without a stored policy are open.
+type SenderPolicy struct {
+	Mode    string   `json:"mode"`
+	Senders []string `json:"senders,omitempty"` // Base64 encoded Ed25519 public keys
+	// Difficulty is the proof of work, in leading zero bits, that unsigned
+	// prompts must come with. Zero asks for none.
+	Difficulty int `json:"difficulty,omitempty"`
+}
+
+// Validate checks the mode, the difficulty and that every sender is a
+// public key.
+func (p *SenderPolicy) Validate() error {
+	switch p.Mode {
+	case SenderPolicyOpen, SenderPolicyAllowlist, SenderPolicyBlocklist:
+	default:
+		return errors.New("mode must be open, allowlist or blocklist")
+	}
+	if p.Difficulty < 0 || p.Difficulty > MaxDifficulty {
+		return fmt.Errorf("difficulty must be between 0 and %d", MaxDifficulty)
+	}
+	for _, sender := range p.Senders {
+		key, err := base64.StdEncoding.DecodeString(sender)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return fmt.Errorf("sender %q is not a base64 encoded Ed25519 public key", sender)
+		}
+	}
+	return nil
+}
+
+// Allows reports whether a prompt signed by senderKey may be delivered. An
+// empty senderKey is an unsigned prompt.
+func (p *SenderPolicy) Allows(senderKey string) bool {
+	switch p.Mode {
+	case SenderPolicyAllowlist:
+		return senderKey != "" && slices.Contains(p.Senders, senderKey)
+	case SenderPolicyBlocklist:
+		return senderKey == "" || !slices.Contains(p.Senders, senderKey)
+	default:
+		return true
+	}
+}
+
+// SetSenderPolicy stores the sender policy of a recipient key. The store is
+// locked, as a compaction the write triggers reads every prompt.
+func (s *PromptStore) SetSenderPolicy(key string, policy SenderPolicy) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.storage.PutSenderPolicy(key, policy)
+}
+
+// SenderPolicy returns the sender policy of a recipient key. Keys that never
+// stored one are open.
+func (s *PromptStore) SenderPolicy(key string) SenderPolicy {
+	if policy, exists := s.storage.SenderPolicy(key); exists {
+		return policy
+	}
+	return SenderPolicy{Mode: SenderPolicyOpen}
+}
+
+// CheckSender returns ErrSenderRejected if the policy of any of the
+// recipients rejects prompts signed by senderKey, or unsigned prompts if
+// senderKey is empty.
+func (s *PromptStore) CheckSender(recipients []string, senderKey string) error {
+	for _, key := range recipients {
+		if policy := s.SenderPolicy(key); !policy.Allows(senderKey) {
+			return ErrSenderRejected
+		}
+	}
+	return nil
+}
+
+// Difficulty returns the proof of work an unsigned prompt for recipients
+// needs: the highest difficulty any of their policies asks for.
+func (s *PromptStore) Difficulty(recipients []string) int {
+	difficulty := 0
+	for _, key := range recipients {
+		difficulty = max(difficulty, s.SenderPolicy(key).Difficulty)
+	}
+	return difficulty
+}
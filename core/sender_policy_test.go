@@ -0,0 +1,132 @@
+package core
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	friendKey   = "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+	strangerKey = "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="
+)
+
+func TestSenderPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  SenderPolicy
+		wantErr bool
+	}{
+		{"open", SenderPolicy{Mode: SenderPolicyOpen}, false},
+		{"allowlist", SenderPolicy{Mode: SenderPolicyAllowlist, Senders: []string{friendKey}}, false},
+		{"empty allowlist", SenderPolicy{Mode: SenderPolicyAllowlist}, false},
+		{"blocklist", SenderPolicy{Mode: SenderPolicyBlocklist, Senders: []string{strangerKey}}, false},
+		{"unknown mode", SenderPolicy{Mode: "friends"}, true},
+		{"missing mode", SenderPolicy{}, true},
+		{"not base64", SenderPolicy{Mode: SenderPolicyBlocklist, Senders: []string{"not a key"}}, true},
+		{"wrong length", SenderPolicy{Mode: SenderPolicyBlocklist, Senders: []string{"a2V5"}}, true},
+		{"difficulty", SenderPolicy{Mode: SenderPolicyOpen, Difficulty: 20}, false},
+		{"negative difficulty", SenderPolicy{Mode: SenderPolicyOpen, Difficulty: -1}, true},
+		{"difficulty too high", SenderPolicy{Mode: SenderPolicyOpen, Difficulty: MaxDifficulty + 1}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestSenderPolicyAllows(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy SenderPolicy
+		sender string
+		want   bool
+	}{
+		{"open allows anonymous", SenderPolicy{Mode: SenderPolicyOpen}, "", true},
+		{"open allows anyone", SenderPolicy{Mode: SenderPolicyOpen}, strangerKey, true},
+		{"allowlist allows listed", SenderPolicy{Mode: SenderPolicyAllowlist, Senders: []string{friendKey}}, friendKey, true},
+		{"allowlist rejects others", SenderPolicy{Mode: SenderPolicyAllowlist, Senders: []string{friendKey}}, strangerKey, false},
+		{"allowlist rejects anonymous", SenderPolicy{Mode: SenderPolicyAllowlist, Senders: []string{friendKey}}, "", false},
+		{"blocklist rejects listed", SenderPolicy{Mode: SenderPolicyBlocklist, Senders: []string{strangerKey}}, strangerKey, false},
+		{"blocklist allows others", SenderPolicy{Mode: SenderPolicyBlocklist, Senders: []string{strangerKey}}, friendKey, true},
+		{"blocklist allows anonymous", SenderPolicy{Mode: SenderPolicyBlocklist, Senders: []string{strangerKey}}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.policy.Allows(tt.sender))
+		})
+	}
+}
+
+func TestCheckSender(t *testing.T) {
+	store := NewPromptStore()
+	assert.Equal(t, SenderPolicyOpen, store.SenderPolicy("a").Mode)
+
+	require.NoError(t, store.SetSenderPolicy("b", SenderPolicy{Mode: SenderPolicyAllowlist, Senders: []string{friendKey}}))
+	assert.NoError(t, store.CheckSender([]string{"a", "b"}, friendKey))
+	assert.Equal(t, ErrSenderRejected, store.CheckSender([]string{"a", "b"}, strangerKey))
+	assert.NoError(t, store.CheckSender([]string{"a"}, strangerKey))
+}
+
+func TestDifficulty(t *testing.T) {
+	store := NewPromptStore()
+	assert.Equal(t, 0, store.Difficulty([]string{"a"}))
+
+	require.NoError(t, store.SetSenderPolicy("b", SenderPolicy{Mode: SenderPolicyOpen, Difficulty: 12}))
+	require.NoError(t, store.SetSenderPolicy("c", SenderPolicy{Mode: SenderPolicyOpen, Difficulty: 8}))
+	assert.Equal(t, 12, store.Difficulty([]string{"a", "b", "c"}))
+}
+
+func TestFileStorageSenderPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	storage, err := OpenFileStorage(path)
+	require.NoError(t, err)
+	policy := SenderPolicy{Mode: SenderPolicyBlocklist, Senders: []string{strangerKey}}
+	require.NoError(t, storage.PutSenderPolicy("key", policy))
+	require.NoError(t, storage.Close())
+
+	// Policies survive a restart and compaction
+	storage, err = OpenFileStorage(path)
+	require.NoError(t, err)
+	defer storage.Close()
+	restored, exists := storage.SenderPolicy("key")
+	require.True(t, exists)
+	assert.Equal(t, policy, restored)
+	_, exists = storage.SenderPolicy("other")
+	assert.False(t, exists)
+}
+
+func TestSetSenderPolicy_WhilePromptsClose(t *testing.T) {
+	storage, err := OpenFileStorage(filepath.Join(t.TempDir(), "journal"))
+	require.NoError(t, err)
+	store := NewPromptStoreWithOptions(StoreOptions{Storage: storage})
+	defer store.Close()
+
+	// Policy writes compact the journal while prompts are being answered,
+	// which go test -race checks
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 2*compactMinEntries; i++ {
+			assert.NoError(t, store.SetSenderPolicy("key", SenderPolicy{Mode: SenderPolicyOpen, Difficulty: i % 8}))
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		id := store.AddPrompt("key", "Continue?", func(string) {})
+		_, err := store.Answer(id, "key", "yes")
+		assert.NoError(t, err)
+	}
+	wg.Wait()
+}
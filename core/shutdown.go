@@ -0,0 +1,76 @@
+package core
+
+import (
+	"errors"
+	"prompt-service-server/utils"
+	"time"
+)
+
+// ErrPosterTokenInvalid is returned for a poster token that does not match
+// the prompt's.
+var ErrPosterTokenInvalid = errors.New("invalid poster token")
+
+// Durable reports whether prompts outlive a restart of the server.
+func (s *PromptStore) Durable() bool {
+	return s.storage.Durable()
+}
+
+// HandOff turns a prompt whose poster is waiting on a held connection into
+// one the poster fetches later with a poster token, so that it can be
+// answered after a restart. Returns ErrPromptNotFound or ErrPromptClosed if
+// the prompt is no longer pending.
+func (s *PromptStore) HandOff(id string, posterTokenHash string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	prompt, exists := s.storage.Get(id)
+	if !exists {
+		return ErrPromptNotFound
+	}
+	if !prompt.IsPending() {
+		return ErrPromptClosed
+	}
+	prompt.PosterTokenHash = posterTokenHash
+	return s.storage.Put(prompt)
+}
+
+// VerifyPosterToken checks token against the poster token of the prompt,
+// which HandOff may set at any time. Returns ErrPromptNotFound or
+// ErrPosterTokenInvalid.
+func (s *PromptStore) VerifyPosterToken(id string, token string) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	prompt, exists := s.storage.Get(id)
+	if !exists {
+		return ErrPromptNotFound
+	}
+	if !utils.VerifyToken(token, prompt.PosterTokenHash) {
+		return ErrPosterTokenInvalid
+	}
+	return nil
+}
+
+// Shutdown sends every SSE client a server_shutdown event that asks it to
+// reconnect after retry, and closes the connections once it is written.
+// Clients that connect after this get the same event right away.
+func (s *PromptStore) Shutdown(retry time.Duration) {
+	s.eventMutex.Lock()
+	defer s.eventMutex.Unlock()
+
+	s.shutdownRetry = retry
+	s.mutex.RLock()
+	var connections []*SSEConnection
+	for _, keyConnections := range s.connections {
+		connections = append(connections, keyConnections...)
+	}
+	s.mutex.RUnlock()
+	for _, connection := range connections {
+		s.unregisterSSEConnection(connection.key, connection)
+		connection.finish(shutdownEvent(retry))
+	}
+}
+
+func shutdownEvent(retry time.Duration) []byte {
+	return formatEvent(event{eventType: "server_shutdown", data: "Server is restarting", retry: retry})
+}
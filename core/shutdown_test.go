@@ -0,0 +1,80 @@
+package core
+
+import (
+	"path/filepath"
+	"prompt-service-server/utils"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShutdownTellsClientsToRetry(t *testing.T) {
+	store := NewPromptStore()
+	w := &MockResponseWriter{}
+	connection := store.AddSSEConnection("test-key", w, &MockFlusher{})
+
+	store.Shutdown(5 * time.Second)
+
+	output := w.WaitFor("server_shutdown")
+	assert.Contains(t, output, `"type":"server_shutdown"`)
+	assert.Contains(t, output, "retry: 5000")
+	select {
+	case <-connection.Done():
+	case <-time.After(time.Second):
+		t.Fatal("connection was not closed after shutdown")
+	}
+	store.mutex.RLock()
+	assert.Empty(t, store.connections["test-key"])
+	store.mutex.RUnlock()
+
+	// Clients that reconnect during shutdown are told the same and let go
+	late := &MockResponseWriter{}
+	lateConnection := store.ResumeSSEConnection("test-key", late, &MockFlusher{}, "")
+	assert.Contains(t, late.WaitFor("server_shutdown"), "retry: 5000")
+	select {
+	case <-lateConnection.Done():
+	case <-time.After(time.Second):
+		t.Fatal("connection opened during shutdown was not closed")
+	}
+}
+
+// durableStorage stands in for a persistent backend other than the file.
+type durableStorage struct {
+	*MemoryStorage
+}
+
+func (durableStorage) Durable() bool {
+	return true
+}
+
+func TestDurable(t *testing.T) {
+	assert.False(t, NewPromptStore().Durable())
+	assert.True(t, NewPromptStoreWithOptions(StoreOptions{Storage: durableStorage{NewMemoryStorage()}}).Durable())
+}
+
+func TestHandOff(t *testing.T) {
+	assert.False(t, NewPromptStore().Durable())
+
+	storage, err := OpenFileStorage(filepath.Join(t.TempDir(), "prompts.journal"))
+	require.NoError(t, err)
+	store := NewPromptStoreWithOptions(StoreOptions{Storage: storage})
+	defer store.Close()
+	assert.True(t, store.Durable())
+
+	id := store.AddPrompt("key", "held", func(string) {})
+	require.NoError(t, store.HandOff(id, "token-hash"))
+	prompt, exists := storage.Get(id)
+	require.True(t, exists)
+	assert.Equal(t, "token-hash", prompt.PosterTokenHash)
+
+	assert.Equal(t, ErrPromptNotFound, store.HandOff("missing", "token-hash"))
+	assert.Equal(t, ErrPromptNotFound, store.VerifyPosterToken("missing", "token"))
+	assert.Equal(t, ErrPosterTokenInvalid, store.VerifyPosterToken(id, "token"))
+	require.NoError(t, store.HandOff(id, utils.HashToken("token")))
+	assert.NoError(t, store.VerifyPosterToken(id, "token"))
+	assert.Equal(t, ErrPosterTokenInvalid, store.VerifyPosterToken(id, "other"))
+	require.True(t, store.CancelPrompt(id))
+	assert.Equal(t, ErrPromptClosed, store.HandOff(id, "token-hash"))
+}
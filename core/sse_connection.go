@@ -0,0 +1,104 @@
+package core
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultSSEQueue is how many events may wait for a slow connection before
+// it is dropped, unless StoreOptions says otherwise.
+const defaultSSEQueue = 64
+
+// SSEConnection is one open event stream. Events are queued and written by
+// the connection's own goroutine, so a slow browser never holds up the
+// store or other connections. A connection whose queue fills up is dropped;
+// the browser reconnects and catches up with Last-Event-ID.
+type SSEConnection struct {
+	writer  http.ResponseWriter
+	flusher http.Flusher
+	key     string
+
+	queue     chan []byte
+	done      chan struct{} // Closed when the connection is removed or dropped
+	stopped   chan struct{} // Closed when the writer goroutine has returned
+	closeOnce sync.Once
+}
+
+func newSSEConnection(key string, writer http.ResponseWriter, flusher http.Flusher, queueSize int) *SSEConnection {
+	return &SSEConnection{
+		writer:  writer,
+		flusher: flusher,
+		key:     key,
+		queue:   make(chan []byte, queueSize),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// Done is closed when the connection was removed or dropped. The handler
+// serving the stream should return once it is.
+func (c *SSEConnection) Done() <-chan struct{} {
+	return c.done
+}
+
+// enqueue queues a message without blocking. Returns false if the queue is
+// full or the connection is closed.
+func (c *SSEConnection) enqueue(message []byte) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	select {
+	case c.queue <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+// finish queues a last message, after which the connection closes. If the
+// queue is full the connection closes right away.
+func (c *SSEConnection) finish(message []byte) {
+	if !c.enqueue(message) || !c.enqueue(nil) {
+		c.close()
+	}
+}
+
+// run writes queued messages until the connection is closed or a write
+// fails. A nil message closes the connection.
+func (c *SSEConnection) run() {
+	defer close(c.stopped)
+	for {
+		select {
+		case message := <-c.queue:
+			if message == nil {
+				c.close()
+				return
+			}
+			if _, err := c.writer.Write(message); err != nil {
+				c.close()
+				return
+			}
+			c.flusher.Flush()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// close stops the connection. A write that is stuck on a stalled client is
+// interrupted where the writer supports deadlines.
+func (c *SSEConnection) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		http.NewResponseController(c.writer).SetWriteDeadline(time.Now())
+	})
+}
+
+// wait blocks until the writer goroutine has returned, after which the
+// response writer is no longer touched.
+func (c *SSEConnection) wait() {
+	<-c.stopped
+}
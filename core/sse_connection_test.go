@@ -0,0 +1,109 @@
+package core
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stalledWriter blocks every write until it is released, like a browser
+// that stopped reading.
+type stalledWriter struct {
+	MockResponseWriter
+	release chan struct{}
+}
+
+func (w *stalledWriter) Write(data []byte) (int, error) {
+	<-w.release
+	return w.MockResponseWriter.Write(data)
+}
+
+func TestSlowConnectionIsDropped(t *testing.T) {
+	store := NewPromptStoreWithOptions(StoreOptions{SSEQueue: 4})
+	key := "test-key"
+
+	fast := &MockResponseWriter{}
+	store.AddSSEConnection(key, fast, &MockFlusher{})
+	slow := &stalledWriter{release: make(chan struct{})}
+	slowConnection := store.AddSSEConnection(key, slow, &MockFlusher{})
+
+	// The fast connection gets every event while the stalled one falls
+	// behind, and sending never waits for it
+	for i := 0; i < 20; i++ {
+		store.SendEventToConnections(key, "new_prompt", fmt.Sprint(i), "id")
+		content := fmt.Sprintf(`"content":"%d"`, i)
+		require.Contains(t, fast.WaitFor(content), content)
+	}
+	select {
+	case <-slowConnection.Done():
+	case <-time.After(time.Second):
+		t.Fatal("stalled connection was not dropped")
+	}
+	store.mutex.RLock()
+	assert.Len(t, store.connections[key], 1)
+	store.mutex.RUnlock()
+
+	close(slow.release)
+	store.RemoveSSEConnection(key, slowConnection)
+}
+
+func TestRemoveSSEConnectionStopsWriter(t *testing.T) {
+	store := NewPromptStore()
+	w := &MockResponseWriter{}
+	connection := store.AddSSEConnection("test-key", w, &MockFlusher{})
+
+	store.RemoveSSEConnection("test-key", connection)
+	store.SendEventToConnections("test-key", "new_prompt", "late", "id")
+
+	// Nothing is written once the connection is removed
+	time.Sleep(10 * time.Millisecond)
+	assert.Empty(t, w.String())
+	require.NotNil(t, connection.Done())
+}
+
+// countingWriter marks every write it gets on a wait group.
+type countingWriter struct {
+	delivered *sync.WaitGroup
+}
+
+func (w *countingWriter) Header() http.Header        { return http.Header{} }
+func (w *countingWriter) WriteHeader(statusCode int) {}
+func (w *countingWriter) Write(data []byte) (int, error) {
+	w.delivered.Done()
+	return len(data), nil
+}
+
+// BenchmarkSendEventToConnections measures how long it takes until an event
+// has been written to every connection of a key, with and without a stalled
+// connection among them.
+func BenchmarkSendEventToConnections(b *testing.B) {
+	for _, connections := range []int{100, 500, 1000} {
+		for _, stalled := range []bool{false, true} {
+			name := fmt.Sprintf("connections=%d/stalled=%t", connections, stalled)
+			b.Run(name, func(b *testing.B) {
+				store := NewPromptStore()
+				var delivered sync.WaitGroup
+				for i := 0; i < connections; i++ {
+					store.AddSSEConnection("key", &countingWriter{&delivered}, &MockFlusher{})
+				}
+				if stalled {
+					slow := &stalledWriter{release: make(chan struct{})}
+					defer close(slow.release)
+					store.AddSSEConnection("key", slow, &MockFlusher{})
+				}
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					delivered.Add(connections)
+					store.SendEventToConnections("key", "new_prompt", "message", "id")
+					delivered.Wait()
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package core
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Storage persists prompts for a PromptStore. Implementations must be safe
+// for concurrent use.
+type Storage interface {
+	// Put inserts or replaces a prompt.
+	Put(prompt *Prompt) error
+	// Delete removes a prompt. Deleting an unknown id is not an error.
+	Delete(id string) error
+	// Get returns the prompt with the given id.
+	Get(id string) (*Prompt, bool)
+	// List returns all stored prompts in no particular order.
+	List() []*Prompt
+	// PutSenderPolicy inserts or replaces the sender policy of a recipient
+	// key.
+	PutSenderPolicy(key string, policy SenderPolicy) error
+	// SenderPolicy returns the sender policy of a recipient key.
+	SenderPolicy(key string) (SenderPolicy, bool)
+	// Durable reports whether stored prompts outlive a restart of the
+	// server, so held prompts can be handed off instead of cancelled.
+	Durable() bool
+	// Close releases any resources held by the storage.
+	Close() error
+}
+
+const (
+	StorageMemory = "memory"
+	StorageFile   = "file"
+)
+
+// OpenStorage returns the storage backend with the given name. The path is
+// only used by backends that persist to disk.
+func OpenStorage(backend string, path string) (Storage, error) {
+	switch backend {
+	case "", StorageMemory:
+		return NewMemoryStorage(), nil
+	case StorageFile:
+		if path == "" {
+			return nil, fmt.Errorf("storage backend %q requires a path", backend)
+		}
+		return OpenFileStorage(path)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
+
+// MemoryStorage keeps prompts in memory only. Everything is lost on restart.
+type MemoryStorage struct {
+	prompts  map[string]*Prompt
+	policies map[string]SenderPolicy
+	mutex    sync.RWMutex
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		prompts:  make(map[string]*Prompt),
+		policies: make(map[string]SenderPolicy),
+	}
+}
+
+func (m *MemoryStorage) Put(prompt *Prompt) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.prompts[prompt.Id] = prompt
+	return nil
+}
+
+func (m *MemoryStorage) Delete(id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.prompts, id)
+	return nil
+}
+
+func (m *MemoryStorage) Get(id string) (*Prompt, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	prompt, ok := m.prompts[id]
+	return prompt, ok
+}
+
+func (m *MemoryStorage) List() []*Prompt {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	prompts := make([]*Prompt, 0, len(m.prompts))
+	for _, prompt := range m.prompts {
+		prompts = append(prompts, prompt)
+	}
+	return prompts
+}
+
+func (m *MemoryStorage) PutSenderPolicy(key string, policy SenderPolicy) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.policies[key] = policy
+	return nil
+}
+
+func (m *MemoryStorage) SenderPolicy(key string) (SenderPolicy, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	policy, ok := m.policies[key]
+	return policy, ok
+}
+
+func (m *MemoryStorage) Durable() bool {
+	return false
+}
+
+func (m *MemoryStorage) Close() error {
+	return nil
+}
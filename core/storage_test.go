@@ -0,0 +1,124 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenStorage(t *testing.T) {
+	storage, err := OpenStorage("", "")
+	require.NoError(t, err)
+	assert.IsType(t, &MemoryStorage{}, storage)
+
+	_, err = OpenStorage(StorageFile, "")
+	assert.Error(t, err)
+
+	_, err = OpenStorage("redis", "")
+	assert.Error(t, err)
+}
+
+func TestFileStorage_RestoresPrompts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prompts.journal")
+
+	storage, err := OpenFileStorage(path)
+	require.NoError(t, err)
+	require.NoError(t, storage.Put(&Prompt{Id: "1", Key: "key1", Message: "first"}))
+	require.NoError(t, storage.Put(&Prompt{Id: "2", Key: "key2", Message: "second"}))
+	require.NoError(t, storage.Delete("1"))
+	require.NoError(t, storage.Close())
+
+	storage, err = OpenFileStorage(path)
+	require.NoError(t, err)
+	defer storage.Close()
+
+	_, exists := storage.Get("1")
+	assert.False(t, exists)
+	prompt, exists := storage.Get("2")
+	require.True(t, exists)
+	assert.Equal(t, "key2", prompt.Key)
+	assert.Equal(t, "second", prompt.Message)
+	assert.Nil(t, prompt.Callback)
+}
+
+func TestFileStorage_IgnoresTornWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prompts.journal")
+
+	storage, err := OpenFileStorage(path)
+	require.NoError(t, err)
+	require.NoError(t, storage.Put(&Prompt{Id: "1", Key: "key", Message: "kept"}))
+	require.NoError(t, storage.Close())
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"op":"put","prompt":{"id":"2","mess`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	storage, err = OpenFileStorage(path)
+	require.NoError(t, err)
+	defer storage.Close()
+	assert.Len(t, storage.List(), 1)
+}
+
+func TestFileStorage_Compacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prompts.journal")
+
+	storage, err := OpenFileStorage(path)
+	require.NoError(t, err)
+	defer storage.Close()
+
+	require.NoError(t, storage.Put(&Prompt{Id: "live", Key: "key", Message: "live"}))
+	for i := 0; i < compactMinEntries; i++ {
+		require.NoError(t, storage.Put(&Prompt{Id: "churn", Key: "key", Message: "churn"}))
+		require.NoError(t, storage.Delete("churn"))
+	}
+
+	assert.True(t, storage.entries <= compactMinEntries, "journal should have been compacted")
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"id":"live"`)
+}
+
+func TestFileStorage_PutThatCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prompts.journal")
+
+	storage, err := OpenFileStorage(path)
+	require.NoError(t, err)
+	// Updates fill the journal up to the point where the next entry compacts
+	for storage.entries < compactMinEntries {
+		require.NoError(t, storage.Put(&Prompt{Id: "updated", Key: "key", Message: "updated"}))
+	}
+	require.NoError(t, storage.Put(&Prompt{Id: "new", Key: "key", Message: "new"}))
+	assert.Equal(t, 2, storage.entries, "journal should have been compacted")
+	require.NoError(t, storage.Close())
+
+	storage, err = OpenFileStorage(path)
+	require.NoError(t, err)
+	defer storage.Close()
+	_, exists := storage.Get("new")
+	assert.True(t, exists, "the prompt that triggered compaction is kept")
+}
+
+func TestPromptStore_ServesRestoredPrompts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prompts.journal")
+
+	storage, err := OpenFileStorage(path)
+	require.NoError(t, err)
+	store := NewPromptStoreWithOptions(StoreOptions{Storage: storage})
+	id := store.AddPrompt("key", "survives restart", func(string) {})
+	require.NoError(t, store.Close())
+
+	storage, err = OpenFileStorage(path)
+	require.NoError(t, err)
+	store = NewPromptStoreWithOptions(StoreOptions{Storage: storage})
+	defer store.Close()
+
+	prompts := store.GetPrompts("key", "")
+	require.Len(t, prompts, 1)
+	assert.Equal(t, id, prompts[0].Id)
+	assert.Equal(t, "survives restart", prompts[0].Message)
+}
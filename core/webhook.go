@@ -0,0 +1,240 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"prompt-service-server/utils"
+	"sync"
+	"time"
+)
+
+// maxDeadLetters is how many failed deliveries are kept in memory. Anyone can
+// post prompts whose callback fails, so older ones are only kept in the dead
+// letter file.
+const maxDeadLetters = 100
+
+// WebhookOptions configures webhook delivery. Zero values select the
+// defaults.
+type WebhookOptions struct {
+	// Client sends the deliveries. Defaults to a client with a 10 second
+	// timeout that only connects to public addresses.
+	Client *http.Client
+	// AllowPrivate lets the default client deliver to loopback, private
+	// and link-local addresses. Anyone can post a prompt with a callback
+	// URL, so this lets anyone make the server send requests inside its
+	// network.
+	AllowPrivate bool
+	// MaxAttempts is how often a delivery is tried before it is dead
+	// lettered. Defaults to 8.
+	MaxAttempts int
+	// InitialBackoff is the wait after the first failed attempt. It doubles
+	// after every further failure. Defaults to one second.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between attempts. Defaults to five minutes.
+	MaxBackoff time.Duration
+	// DeadLetterPath is a file that failed deliveries are appended to as
+	// JSON lines. Optional.
+	DeadLetterPath string
+}
+
+// DeadLetter records a delivery that failed on every attempt.
+type DeadLetter struct {
+	PromptId  string          `json:"prompt_id"`
+	URL       string          `json:"url"`
+	Payload   json.RawMessage `json:"payload"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"last_error"`
+	FailedAt  time.Time       `json:"failed_at"`
+}
+
+// Webhooks delivers the results of prompts to their callback URLs.
+type Webhooks struct {
+	opts        WebhookOptions
+	deadLetters []DeadLetter
+	pending     sync.WaitGroup
+	mutex       sync.Mutex
+
+	// stopping is cancelled by Shutdown, which ends the waits between
+	// attempts. abort is cancelled when the grace period is over, which
+	// ends attempts in flight.
+	stopping context.Context
+	stop     context.CancelFunc
+	abort    context.Context
+	cancel   context.CancelFunc
+}
+
+func NewWebhooks(opts WebhookOptions) *Webhooks {
+	if opts.Client == nil {
+		opts.Client = newWebhookClient(opts.AllowPrivate)
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 8
+	}
+	if opts.InitialBackoff <= 0 {
+		opts.InitialBackoff = time.Second
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 5 * time.Minute
+	}
+	webhooks := &Webhooks{opts: opts}
+	webhooks.stopping, webhooks.stop = context.WithCancel(context.Background())
+	webhooks.abort, webhooks.cancel = context.WithCancel(context.Background())
+	return webhooks
+}
+
+// newWebhookClient returns the default delivery client. Unless private
+// addresses are allowed, the address is checked when connecting, after
+// the host name was resolved and on every redirect. Proxies from the
+// environment are not used, as the check would only see the proxy.
+func newWebhookClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if !allowPrivate {
+		dialer.Control = utils.RefuseNonPublic
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: 10 * time.Second, Transport: transport}
+}
+
+// Deliver posts the result of a closed prompt to its callback URL in the
+// background, retrying with exponential backoff.
+func (w *Webhooks) Deliver(prompt Prompt) {
+	payload, err := json.Marshal(prompt.Result())
+	if err != nil {
+		slog.Error("Failed to encode webhook", "prompt_id", prompt.Id, "error", err)
+		return
+	}
+	w.pending.Add(1)
+	go func() {
+		defer w.pending.Done()
+		w.deliver(prompt.Id, prompt.CallbackURL, prompt.CallbackSecret, payload)
+	}()
+}
+
+func (w *Webhooks) deliver(id string, url string, secret string, payload []byte) {
+	backoff := w.opts.InitialBackoff
+	var err error
+	attempt := 1
+	for ; ; attempt++ {
+		if err = w.post(url, secret, payload); err == nil {
+			return
+		}
+		slog.Warn("Webhook delivery failed", "prompt_id", id, "attempt", attempt, "max_attempts", w.opts.MaxAttempts, "error", err)
+		if attempt == w.opts.MaxAttempts {
+			break
+		}
+		// Retries are given up on shutdown rather than lost with the process
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-w.stopping.Done():
+			timer.Stop()
+			err = fmt.Errorf("server shut down before the delivery succeeded: %w", err)
+		}
+		if w.stopping.Err() != nil {
+			break
+		}
+		backoff = min(2*backoff, w.opts.MaxBackoff)
+	}
+	w.deadLetter(DeadLetter{
+		PromptId:  id,
+		URL:       url,
+		Payload:   payload,
+		Attempts:  attempt,
+		LastError: err.Error(),
+		FailedAt:  time.Now(),
+	})
+}
+
+func (w *Webhooks) post(url string, secret string, payload []byte) error {
+	req, err := http.NewRequestWithContext(w.abort, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(utils.WebhookSignatureHeader, utils.SignWebhook(secret, time.Now(), payload))
+	resp, err := w.opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func (w *Webhooks) deadLetter(letter DeadLetter) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.writeDeadLetter(letter) {
+		// The file has the payload, which can be large
+		letter.Payload = nil
+	}
+	if len(w.deadLetters) == maxDeadLetters {
+		copy(w.deadLetters, w.deadLetters[1:])
+		w.deadLetters = w.deadLetters[:maxDeadLetters-1]
+	}
+	w.deadLetters = append(w.deadLetters, letter)
+}
+
+// writeDeadLetter appends a letter to the dead letter file, if there is
+// one. Returns whether it was written. The caller must hold the mutex.
+func (w *Webhooks) writeDeadLetter(letter DeadLetter) bool {
+	if w.opts.DeadLetterPath == "" {
+		return false
+	}
+	file, err := os.OpenFile(w.opts.DeadLetterPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		slog.Error("Failed to open dead letter file", "error", err)
+		return false
+	}
+	defer file.Close()
+	if err := json.NewEncoder(file).Encode(letter); err != nil {
+		slog.Error("Failed to write dead letter", "error", err)
+		return false
+	}
+	return true
+}
+
+// DeadLetters returns the latest deliveries that failed, up to
+// maxDeadLetters. When they were written to the dead letter file, their
+// payload is only kept there.
+func (w *Webhooks) DeadLetters() []DeadLetter {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return append([]DeadLetter(nil), w.deadLetters...)
+}
+
+// Wait blocks until every delivery in progress has succeeded or been dead
+// lettered.
+func (w *Webhooks) Wait() {
+	w.pending.Wait()
+}
+
+// Shutdown stops retrying. Attempts in flight may finish until ctx is done
+// and are then cut off. Every delivery that did not succeed is dead
+// lettered, so none is lost with the process.
+func (w *Webhooks) Shutdown(ctx context.Context) error {
+	w.stop()
+	done := make(chan struct{})
+	go func() {
+		w.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		w.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,180 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"prompt-service-server/utils"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhooksDeliverAnsweredPrompt(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	var body []byte
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		received <- r
+	}))
+	defer receiver.Close()
+
+	webhooks := NewWebhooks(WebhookOptions{AllowPrivate: true})
+	store := NewPromptStoreWithOptions(StoreOptions{Webhooks: webhooks})
+	prompt := &Prompt{
+		Key:            "key",
+		Message:        "deploy?",
+		CallbackURL:    receiver.URL,
+		CallbackSecret: "secret",
+	}
+	require.NoError(t, store.Submit(prompt))
+	_, err := store.Answer(prompt.Id, "key", "yes")
+	require.NoError(t, err)
+	webhooks.Wait()
+
+	r := <-received
+	assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+	assert.NoError(t, utils.VerifyWebhook("secret", r.Header.Get(utils.WebhookSignatureHeader), body, time.Minute))
+
+	var result PromptResult
+	require.NoError(t, json.Unmarshal(body, &result))
+	assert.Equal(t, prompt.Id, result.Id)
+	assert.Equal(t, StatusAnswered, result.Status)
+	assert.Equal(t, "yes", result.Response)
+}
+
+func TestWebhooksRetryWithBackoff(t *testing.T) {
+	var attempts int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer receiver.Close()
+
+	webhooks := NewWebhooks(WebhookOptions{AllowPrivate: true, InitialBackoff: time.Millisecond})
+	webhooks.Deliver(Prompt{Id: "id", Status: StatusExpired, CallbackURL: receiver.URL})
+	webhooks.Wait()
+
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+	assert.Empty(t, webhooks.DeadLetters())
+}
+
+func TestWebhooksDeadLetter(t *testing.T) {
+	var attempts int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	path := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	webhooks := NewWebhooks(WebhookOptions{
+		AllowPrivate:   true,
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		DeadLetterPath: path,
+	})
+	webhooks.Deliver(Prompt{Id: "id", Status: StatusExpired, CallbackURL: receiver.URL})
+	webhooks.Wait()
+
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+	letters := webhooks.DeadLetters()
+	require.Len(t, letters, 1)
+	assert.Equal(t, "id", letters[0].PromptId)
+	assert.Equal(t, 3, letters[0].Attempts)
+	assert.Contains(t, letters[0].LastError, "500")
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var stored DeadLetter
+	require.NoError(t, json.Unmarshal(data, &stored))
+	assert.Equal(t, receiver.URL, stored.URL)
+	assert.Contains(t, string(stored.Payload), `"id":"id"`)
+	// Only the file keeps the payload
+	assert.Nil(t, letters[0].Payload)
+}
+
+func TestWebhooksKeepRecentDeadLetters(t *testing.T) {
+	webhooks := NewWebhooks(WebhookOptions{})
+	for i := 0; i < maxDeadLetters+2; i++ {
+		webhooks.deadLetter(DeadLetter{PromptId: strconv.Itoa(i), Payload: json.RawMessage(`{}`)})
+	}
+	letters := webhooks.DeadLetters()
+	require.Len(t, letters, maxDeadLetters)
+	assert.Equal(t, "2", letters[0].PromptId)
+	assert.Equal(t, strconv.Itoa(maxDeadLetters+1), letters[maxDeadLetters-1].PromptId)
+	// Without a file the payload is kept
+	assert.NotNil(t, letters[0].Payload)
+}
+
+func TestWebhooksRefusePrivateAddresses(t *testing.T) {
+	var attempts int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+	}))
+	defer receiver.Close()
+
+	webhooks := NewWebhooks(WebhookOptions{MaxAttempts: 2, InitialBackoff: time.Millisecond})
+	// The name resolves to loopback, so only the dial time check catches it
+	url := strings.Replace(receiver.URL, "127.0.0.1", "localhost", 1)
+	webhooks.Deliver(Prompt{Id: "id", Status: StatusExpired, CallbackURL: url})
+	webhooks.Wait()
+
+	assert.Equal(t, int32(0), atomic.LoadInt32(&attempts))
+	letters := webhooks.DeadLetters()
+	require.Len(t, letters, 1)
+	assert.Contains(t, letters[0].LastError, utils.ErrNonPublicAddress.Error())
+}
+
+func TestWebhooksShutdownDeadLettersRetries(t *testing.T) {
+	attempted := make(chan struct{}, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempted <- struct{}{}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer receiver.Close()
+
+	path := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	webhooks := NewWebhooks(WebhookOptions{AllowPrivate: true, InitialBackoff: time.Hour, DeadLetterPath: path})
+	webhooks.Deliver(Prompt{Id: "id", Status: StatusExpired, CallbackURL: receiver.URL})
+	<-attempted
+
+	// The retry an hour from now is given up on, and recorded
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, webhooks.Shutdown(ctx))
+	letters := webhooks.DeadLetters()
+	require.Len(t, letters, 1)
+	assert.Equal(t, 1, letters[0].Attempts)
+	assert.Contains(t, letters[0].LastError, "shut down")
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"prompt_id":"id"`)
+}
+
+func TestWebhooksShutdownCutsOffAttempts(t *testing.T) {
+	release := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer receiver.Close()
+	defer close(release)
+
+	webhooks := NewWebhooks(WebhookOptions{AllowPrivate: true})
+	webhooks.Deliver(Prompt{Id: "id", Status: StatusExpired, CallbackURL: receiver.URL})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, webhooks.Shutdown(ctx))
+	require.Len(t, webhooks.DeadLetters(), 1)
+}
@@ -16,7 +16,7 @@ in
   services.prompt-service-server = {
     enable = true;
     port = 3000;  # Change from default 8080 if needed
-    csrfTokenSecret = "your-csrf-secret-here";     # Generate a secure random key
+    csrfTokenSecret = "your-csrf-secret-here";     # Generate one with `openssl rand -hex 32`
     allowedOrigins = "https://your-domain.com";    # Optional: comma-separated list of allowed origins for CORS
   };
 
@@ -1,8 +1,6 @@
 package handlers
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"net/http"
 	"prompt-service-server/utils"
 	"time"
@@ -10,41 +8,35 @@ import (
 	"github.com/gorilla/mux"
 )
 
-type AuthHandler struct{}
+type AuthHandler struct {
+	tokens *utils.TokenIssuer
+}
 
-func NewAuthHandler() *AuthHandler {
-	return &AuthHandler{}
+func NewAuthHandler(tokens *utils.TokenIssuer) *AuthHandler {
+	return &AuthHandler{tokens: tokens}
 }
 
 func (h *AuthHandler) Get(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	keyHash := vars["id"]
 
-	// Check if cookie contains matching public key
-	cookie, err := r.Cookie("publicKey")
-	if err != nil {
-		http.Error(w, "Invalid publicKey cookie", http.StatusBadRequest)
-		return
-	}
-
-	// Verify the cookie's public key matches the hash
-	cookieKey := cookie.Value
-	hashedKey := sha256.Sum256([]byte(cookieKey))
-	if hex.EncodeToString(hashedKey[:]) != keyHash {
-		http.Error(w, "Invalid publicKey cookie", http.StatusBadRequest)
+	// Check the cookie contains the public key matching the hash
+	if _, err := VerifyKeyHash(r, keyHash); err != nil {
+		writeKeyProblem(w, err)
 		return
 	}
 
 	// If we get here, we have a valid key
 	// Generate CSRF token
-	csrfToken, err := utils.GenerateCSRFToken(keyHash)
+	csrfToken, err := h.tokens.GenerateCSRFToken(keyHash)
 	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		writeProblem(w, http.StatusInternalServerError, CodeInternal, "Failed to generate token")
 		return
 	}
 
-	expiration := time.Now().Add(5 * time.Minute)
-	csrfCookie := http.Cookie{Name: "CSRFToken", Value: csrfToken, Expires: expiration, Path: "/api"}
+	expiration := time.Now().Add(h.tokens.CSRFTokenExpiry())
+	// Over HTTPS the cookie is never sent in plain text
+	csrfCookie := http.Cookie{Name: "CSRFToken", Value: csrfToken, Expires: expiration, Path: "/api", Secure: r.TLS != nil}
 	http.SetCookie(w, &csrfCookie)
 
 	// Return the challenge
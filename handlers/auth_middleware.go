@@ -1,68 +1,101 @@
 package handlers
 
 import (
-	"crypto/ed25519"
 	"crypto/sha256"
-	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"net/http"
+	"prompt-service-server/logging"
+	"prompt-service-server/metrics"
 	"prompt-service-server/utils"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Errors returned by VerifyKeyHash.
+var (
+	ErrMissingKey  = errors.New("missing publicKey cookie")
+	ErrKeyMismatch = errors.New("publicKey cookie does not match the key hash")
 )
 
-// VerifyKeyHash checks the publicKey cookie, verifies it matches the keyHash,
-func VerifyKeyHash(w http.ResponseWriter, r *http.Request, keyHash string) (string, error) {
+// VerifyKeyHash checks the publicKey cookie and verifies it matches the
+// keyHash. It writes nothing, so pages can redirect and the API can answer
+// with a problem.
+func VerifyKeyHash(r *http.Request, keyHash string) (string, error) {
 	cookie, err := r.Cookie("publicKey")
 	if err != nil {
-		http.Redirect(w, r, "/", http.StatusFound)
-		return "", err
+		return "", ErrMissingKey
 	}
 	cookieKey := cookie.Value
 	hashedKey := sha256.Sum256([]byte(cookieKey))
 	if hex.EncodeToString(hashedKey[:]) != keyHash {
-		http.Redirect(w, r, "/", http.StatusFound)
-		return cookieKey, http.ErrNoCookie
+		return cookieKey, ErrKeyMismatch
 	}
 	return cookieKey, nil
 }
 
+// writeKeyProblem reports why VerifyKeyHash failed.
+func writeKeyProblem(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrMissingKey) {
+		writeProblem(w, http.StatusUnauthorized, CodeMissingKey, "Missing publicKey cookie")
+		return
+	}
+	writeProblem(w, http.StatusForbidden, CodeKeyMismatch, "The publicKey cookie does not match this key")
+}
+
 // AuthenticateAndVerifyCSRF checks the publicKey cookie, verifies it matches the keyHash,
-// and validates the CSRF token and signature. Returns the decoded public key if valid, or writes an error/redirect and returns error.
-func AuthenticateAndVerifyCSRF(w http.ResponseWriter, r *http.Request, keyHash string) (string, error) {
-	cookieKey, err := VerifyKeyHash(w, r, keyHash)
+// and validates the CSRF token and signature. Returns the decoded public key if valid, or writes a problem and returns the error.
+// Every decision is recorded in the audit stream, and failures are counted
+// in the metrics by problem code.
+func AuthenticateAndVerifyCSRF(w http.ResponseWriter, r *http.Request, tokens *utils.TokenIssuer, keyHash string) (string, error) {
+	audit := logging.AuditFrom(r)
+	failed := func(code string) {
+		metrics.FromRequest(r).AuthFailed(code)
+		audit.Record(r.Context(), logging.AuditAuthFailed, "reason", code, "key_hash", keyHash, "path", r.URL.Path)
+	}
+	fail := func(code string, detail string) {
+		failed(code)
+		writeProblem(w, http.StatusUnauthorized, code, detail)
+	}
+	cookieKey, err := VerifyKeyHash(r, keyHash)
 	if err != nil {
+		if errors.Is(err, ErrMissingKey) {
+			failed(CodeMissingKey)
+		} else {
+			failed(CodeKeyMismatch)
+		}
+		writeKeyProblem(w, err)
 		return "", err
 	}
 	signature, err := r.Cookie("CSRFChallenge")
 	if err != nil {
-		http.Error(w, "Missing signature", http.StatusUnauthorized)
+		fail(CodeMissingSignature, "Missing signature")
 		return cookieKey, err
 	}
 	token, err := r.Cookie("CSRFToken")
 	if err != nil {
-		http.Error(w, "Missing token", http.StatusUnauthorized)
+		fail(CodeMissingToken, "Missing token")
 		return cookieKey, err
 	}
 	// Authenticate CSRF token
-	jwtError := utils.VerifyJWT(token.Value)
+	jwtError := tokens.VerifyJWT(token.Value)
+	if errors.Is(jwtError, jwt.ErrTokenExpired) {
+		fail(CodeTokenExpired, "Token expired")
+		return cookieKey, jwtError
+	}
 	if jwtError != nil {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		fail(CodeTokenInvalid, "Invalid token")
 		return cookieKey, jwtError
 	}
 	// Verify signature
-	publicKey, err := base64.StdEncoding.DecodeString(cookieKey)
-	if err != nil {
-		http.Error(w, "Failed to decode", http.StatusUnauthorized)
+	if err := utils.VerifySignature(cookieKey, []byte(token.Value), signature.Value); err != nil {
+		if errors.Is(err, utils.ErrInvalidSignature) {
+			fail(CodeSignatureInvalid, "Invalid signature")
+		} else {
+			fail(CodeSignatureMalformed, "Failed to decode")
+		}
 		return cookieKey, err
 	}
-	signatureBytes, err := base64.StdEncoding.DecodeString(signature.Value)
-	if err != nil {
-		http.Error(w, "Failed to decode", http.StatusUnauthorized)
-		return cookieKey, err
-	}
-	valid := ed25519.Verify(publicKey, []byte(token.Value), signatureBytes)
-	if !valid {
-		http.Error(w, "Invalid signature", http.StatusUnauthorized)
-		return cookieKey, http.ErrNoCookie
-	}
+	audit.Record(r.Context(), logging.AuditAuthSucceeded, "key_hash", keyHash, "path", r.URL.Path)
 	return cookieKey, nil
 }
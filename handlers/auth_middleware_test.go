@@ -10,12 +10,22 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"prompt-service-server/config"
 	"prompt-service-server/utils"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+// testConfig returns valid settings for handler tests.
+func testConfig() *config.Config {
+	cfg := config.Default()
+	cfg.CSRFTokenSecret = "0123456789abcdef0123456789abcdef"
+	return cfg
+}
+
+var testTokens = utils.NewTokenIssuer(testConfig())
+
 func TestVerifyKeyHash_ValidCookie(t *testing.T) {
 	// Generate a test public key
 	pub, _, err := ed25519.GenerateKey(rand.Reader)
@@ -29,9 +39,7 @@ func TestVerifyKeyHash_ValidCookie(t *testing.T) {
 	req := httptest.NewRequest("GET", "/test", nil)
 	req.AddCookie(&http.Cookie{Name: "publicKey", Value: pubKeyB64})
 
-	w := httptest.NewRecorder()
-
-	key, err := VerifyKeyHash(w, req, keyHash)
+	key, err := VerifyKeyHash(req, keyHash)
 	assert.NoError(t, err)
 	assert.Equal(t, pubKeyB64, key)
 }
@@ -47,48 +55,38 @@ func TestVerifyKeyHash_InvalidHash(t *testing.T) {
 	req := httptest.NewRequest("GET", "/test", nil)
 	req.AddCookie(&http.Cookie{Name: "publicKey", Value: pubKeyB64})
 
-	w := httptest.NewRecorder()
-
-	key, err := VerifyKeyHash(w, req, "wrong-hash")
-	assert.Error(t, err)
+	key, err := VerifyKeyHash(req, "wrong-hash")
+	assert.Equal(t, ErrKeyMismatch, err)
 	assert.Equal(t, pubKeyB64, key) // Function returns the key even on hash mismatch
-
-	// Verify redirect was issued
-	assert.Equal(t, http.StatusFound, w.Code)
-	assert.Equal(t, "/", w.Header().Get("Location"))
 }
 
 func TestVerifyKeyHash_NoCookie(t *testing.T) {
 	// Create request without cookie
 	req := httptest.NewRequest("GET", "/test", nil)
-	w := httptest.NewRecorder()
-
-	key, err := VerifyKeyHash(w, req, "some-hash")
-	assert.Error(t, err)
+	key, err := VerifyKeyHash(req, "some-hash")
+	assert.Equal(t, ErrMissingKey, err)
 	assert.Empty(t, key)
-
-	// Verify redirect was issued
-	assert.Equal(t, http.StatusFound, w.Code)
-	assert.Equal(t, "/", w.Header().Get("Location"))
 }
 
 func TestAuthenticateAndVerifyCSRF_Valid(t *testing.T) {
 	// This test checks behavior when cookies are missing
-	// It should redirect due to missing publicKey cookie
+	// It should fail due to missing publicKey cookie
 
 	req := httptest.NewRequest("GET", "/test", nil)
 	w := httptest.NewRecorder()
 
-	key, err := AuthenticateAndVerifyCSRF(w, req, "some-hash")
+	key, err := AuthenticateAndVerifyCSRF(w, req, testTokens, "some-hash")
 	assert.Error(t, err) // Should fail due to missing cookies
 	assert.Empty(t, key)
-	assert.Equal(t, http.StatusFound, w.Code) // Redirect due to missing publicKey
+	assert.Equal(t, http.StatusUnauthorized, w.Code) // Never redirects
+	assert.Equal(t, ProblemContentType, w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), `"code":"missing_key"`)
 }
 
 // Helper function to create a signed JWT for testing
 func createTestJWTAndSignature(keyHash string, pubKey ed25519.PublicKey, privKey ed25519.PrivateKey) (string, string, error) {
 	// Generate JWT token
-	token, err := utils.GenerateCSRFToken(keyHash)
+	token, err := testTokens.GenerateCSRFToken(keyHash)
 	if err != nil {
 		return "", "", err
 	}
@@ -121,7 +119,7 @@ func TestAuthenticateAndVerifyCSRF_FullFlow(t *testing.T) {
 
 	w := httptest.NewRecorder()
 
-	key, err := AuthenticateAndVerifyCSRF(w, req, keyHash)
+	key, err := AuthenticateAndVerifyCSRF(w, req, testTokens, keyHash)
 	assert.NoError(t, err)
 	assert.Equal(t, pubKeyB64, key)
 }
@@ -143,8 +141,9 @@ func TestAuthenticateAndVerifyCSRF_InvalidSignature(t *testing.T) {
 
 	w := httptest.NewRecorder()
 
-	key, err := AuthenticateAndVerifyCSRF(w, req, keyHash)
+	key, err := AuthenticateAndVerifyCSRF(w, req, testTokens, keyHash)
 	assert.Error(t, err)
 	assert.Equal(t, pubKeyB64, key) // Function returns the key even on signature failure
 	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), `"code":"token_invalid"`)
 }
@@ -20,15 +20,17 @@ func (m *CORSMiddleware) Handler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		origin := r.Header.Get("Origin")
 
-		// Check if this is the POST /api/prompts endpoint (unrestricted CORS)
-		if r.URL.Path == "/api/prompts" && (r.Method == "POST" || r.Method == "OPTIONS") {
-			// Allow any origin for POST /api/prompts
+		// Check if this is a poster endpoint (unrestricted CORS)
+		if methods := posterEndpointMethods(r); methods != "" {
+			// Allow any origin for POST /api/prompts, GET /api/challenge and
+			// GET /api/prompts/{id}/result
 			if origin != "" {
 				w.Header().Set("Access-Control-Allow-Origin", origin)
 				w.Header().Set("Access-Control-Allow-Credentials", "false")
 			}
-			w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+			w.Header().Set("Access-Control-Allow-Methods", methods)
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Prefer, X-Sender-Key, X-Sender-Signature, X-Sender-Timestamp")
+			w.Header().Set("Access-Control-Expose-Headers", "Location, Preference-Applied, Retry-After, X-Receipt, X-Request-ID")
 
 			// Handle preflight OPTIONS request
 			if r.Method == "OPTIONS" {
@@ -55,7 +57,7 @@ func (m *CORSMiddleware) Handler(next http.Handler) http.Handler {
 
 			if allowed {
 				w.Header().Set("Access-Control-Allow-Credentials", "true")
-				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, OPTIONS")
 				w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Cookie")
 
 				// Handle preflight OPTIONS request
@@ -69,3 +71,21 @@ func (m *CORSMiddleware) Handler(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// posterEndpointMethods returns the allowed methods if the request targets an
+// endpoint used by prompt posters, or "" otherwise. Posters authenticate with
+// a poster token rather than cookies, so these endpoints are open to any
+// origin.
+func posterEndpointMethods(r *http.Request) string {
+	if r.URL.Path == "/api/prompts" && (r.Method == "POST" || r.Method == "OPTIONS") {
+		return "POST, OPTIONS"
+	}
+	if r.URL.Path == "/api/challenge" && (r.Method == "GET" || r.Method == "OPTIONS") {
+		return "GET, OPTIONS"
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/prompts/") && strings.HasSuffix(r.URL.Path, "/result") &&
+		(r.Method == "GET" || r.Method == "OPTIONS") {
+		return "GET, OPTIONS"
+	}
+	return ""
+}
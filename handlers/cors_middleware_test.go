@@ -199,3 +199,31 @@ func TestCORSMiddleware_NoOriginHeader(t *testing.T) {
 	// Should not set CORS headers when no origin is present
 	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
 }
+
+func TestCORSMiddleware_ResultEndpointUnrestricted(t *testing.T) {
+	cfg := &config.Config{
+		AllowedOrigins: "https://example.com",
+	}
+
+	corsMiddleware := NewCORSMiddleware(cfg)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	r := mux.NewRouter()
+	r.Use(corsMiddleware.Handler)
+	r.HandleFunc("/api/prompts/{id}/result", handler).Methods("GET", "OPTIONS")
+
+	// Posters poll for results from any origin using their poster token
+	req := httptest.NewRequest("OPTIONS", "/api/prompts/123/result", nil)
+	req.Header.Set("Origin", "https://poster.example.org")
+	w := httptest.NewRecorder()
+
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "https://poster.example.org", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "false", w.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Contains(t, w.Header().Get("Access-Control-Allow-Headers"), "Authorization")
+}
@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// HealthHandler answers liveness and readiness probes.
+type HealthHandler struct {
+	ready func() bool
+}
+
+// NewHealthHandler returns probes that report ready while ready returns
+// true.
+func NewHealthHandler(ready func() bool) *HealthHandler {
+	return &HealthHandler{ready: ready}
+}
+
+// Healthz reports that the process is up and serving.
+func (h *HealthHandler) Healthz(w http.ResponseWriter, r *http.Request) {
+	writeStatus(w, http.StatusOK, "ok")
+}
+
+// Readyz reports whether the server takes new work. It fails once the
+// server starts shutting down, so load balancers move traffic elsewhere.
+func (h *HealthHandler) Readyz(w http.ResponseWriter, r *http.Request) {
+	if !h.ready() {
+		writeStatus(w, http.StatusServiceUnavailable, "shutting_down")
+		return
+	}
+	writeStatus(w, http.StatusOK, "ready")
+}
+
+func writeStatus(w http.ResponseWriter, code int, status string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"status": status})
+}
@@ -20,7 +20,11 @@ func NewKeyHandler(staticFiles embed.FS) *KeyHandler {
 func (h *KeyHandler) Get(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	keyHash := vars["id"]
-	VerifyKeyHash(w, r, keyHash) // Ensure the publicKey cookie matches the keyHash
+	// Ensure the publicKey cookie matches the keyHash
+	if _, err := VerifyKeyHash(r, keyHash); err != nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
 
 	// Set security headers
 	w.Header().Set("Content-Security-Policy", buildCSP(getCSPConfig()))
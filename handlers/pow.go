@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"prompt-service-server/utils"
+	"sync"
+	"time"
+)
+
+// Challenge hands out a proof-of-work challenge for the recipients given as
+// recipient query parameters. Unsigned prompts for recipients whose policy
+// asks for proof of work must carry a solution.
+func (h *PromptHandler) Challenge(w http.ResponseWriter, r *http.Request) {
+	recipients := r.URL.Query()["recipient"]
+	if len(recipients) == 0 {
+		writeProblem(w, http.StatusBadRequest, CodeMissingField, "Missing recipient")
+		return
+	}
+	if len(recipients) > h.cfg.MaxRecipients {
+		writeProblem(w, http.StatusBadRequest, CodeTooManyRecipients, fmt.Sprintf("A prompt may have at most %d recipients", h.cfg.MaxRecipients))
+		return
+	}
+	for _, key := range recipients {
+		if !isPublicKey(key) {
+			writeProblem(w, http.StatusBadRequest, CodeInvalidPublicKey, "Invalid recipient format")
+			return
+		}
+	}
+
+	difficulty := h.store.Difficulty(recipients)
+	challenge, expires, err := h.tokens.GenerateChallenge(difficulty)
+	if err != nil {
+		writeProblem(w, http.StatusInternalServerError, CodeInternal, "Failed to generate challenge")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"challenge":  challenge,
+		"difficulty": difficulty,
+		"expires_at": expires,
+	})
+}
+
+// checkProofOfWork makes unsigned prompts for recipients that ask for proof
+// of work come with a fresh solution. The challenge is marked as spent and
+// its id returned, so the caller can release it if the prompt is not taken
+// after all. If the prompt may not pass a problem is written and false
+// returned.
+func (h *PromptHandler) checkProofOfWork(w http.ResponseWriter, r *http.Request, recipients []string, message string, proof *utils.ProofOfWork) (string, bool) {
+	difficulty := h.store.Difficulty(recipients)
+	if difficulty == 0 {
+		return "", true
+	}
+	if proof == nil || proof.Challenge == "" {
+		writeProblemWith(w, http.StatusForbidden, CodeProofOfWorkRequired, "Unsigned prompts for this recipient need proof of work", map[string]interface{}{
+			"difficulty": difficulty,
+		})
+		return "", false
+	}
+	claims, err := h.tokens.VerifyProofOfWork(proof.Challenge, message, proof.Nonce, difficulty)
+	if err != nil {
+		auditRejected(r, CodeProofOfWorkInvalid, "")
+		writeProblemWith(w, http.StatusForbidden, CodeProofOfWorkInvalid, "Invalid proof of work: "+err.Error(), map[string]interface{}{
+			"difficulty": difficulty,
+		})
+		return "", false
+	}
+	if !h.spent.spend(claims.ID, claims.ExpiresAt.Time) {
+		auditRejected(r, CodeProofOfWorkInvalid, "")
+		writeProblemWith(w, http.StatusForbidden, CodeProofOfWorkInvalid, "Invalid proof of work: challenge was already used", map[string]interface{}{
+			"difficulty": difficulty,
+		})
+		return "", false
+	}
+	return claims.ID, true
+}
+
+// spentChallenges remembers the challenges that were redeemed until they
+// expire, so one solution can't be used for several prompts. Challenges are
+// stateless until then.
+type spentChallenges struct {
+	mutex   sync.Mutex
+	expires map[string]time.Time
+	pruned  time.Time
+}
+
+func newSpentChallenges() *spentChallenges {
+	return &spentChallenges{expires: make(map[string]time.Time)}
+}
+
+// spend marks a challenge as used. It returns false if it already was.
+func (s *spentChallenges) spend(id string, expires time.Time) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.pruned) > utils.ChallengeExpiry {
+		for spent, at := range s.expires {
+			if now.After(at) {
+				delete(s.expires, spent)
+			}
+		}
+		s.pruned = now
+	}
+	if _, exists := s.expires[id]; exists {
+		return false
+	}
+	s.expires[id] = expires
+	return true
+}
+
+// release makes a spent challenge usable again, for a prompt that was
+// refused after its proof of work was checked.
+func (s *spentChallenges) release(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.expires, id)
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"prompt-service-server/config"
+	"prompt-service-server/core"
+	"prompt-service-server/utils"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func postPrompt(h *PromptHandler, prompt map[string]interface{}) *httptest.ResponseRecorder {
+	prompt["message"] = "Continue?"
+	prompt["async"] = true
+	body, _ := json.Marshal(prompt)
+	req := httptest.NewRequest("POST", "/api/prompts", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	h.Post(w, req)
+	return w
+}
+
+func TestPromptHandler_ProofOfWork(t *testing.T) {
+	store := core.NewPromptStore()
+	h := NewPromptHandler(testConfig(), store, testTokens)
+	h.limits = NewRateLimits(&config.Config{})
+	key := newTestKey(t)
+	require.NoError(t, store.SetSenderPolicy(key, core.SenderPolicy{Mode: core.SenderPolicyOpen, Difficulty: 8}))
+
+	w := postPrompt(h, map[string]interface{}{"public_key": key})
+	require.Equal(t, http.StatusForbidden, w.Code)
+	var problem map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &problem))
+	assert.Equal(t, CodeProofOfWorkRequired, problem["code"])
+	assert.Equal(t, float64(8), problem["difficulty"])
+
+	req := httptest.NewRequest("GET", "/api/challenge?recipient="+url.QueryEscape(key), nil)
+	w = httptest.NewRecorder()
+	h.Challenge(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var challenge struct {
+		Challenge  string `json:"challenge"`
+		Difficulty int    `json:"difficulty"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &challenge))
+	assert.Equal(t, 8, challenge.Difficulty)
+
+	nonce, err := utils.SolveProofOfWork(context.Background(), challenge.Challenge, "Continue?", challenge.Difficulty)
+	require.NoError(t, err)
+	proof := &utils.ProofOfWork{Challenge: challenge.Challenge, Nonce: nonce}
+
+	// A prompt refused after the check does not use up the solution
+	assert.Equal(t, http.StatusBadRequest, postPrompt(h, map[string]interface{}{"public_key": key, "proof_of_work": proof, "timeout": -1}).Code)
+	assert.Equal(t, http.StatusAccepted, postPrompt(h, map[string]interface{}{"public_key": key, "proof_of_work": proof}).Code)
+
+	// A solution is only good for one prompt
+	w = postPrompt(h, map[string]interface{}{"public_key": key, "proof_of_work": proof})
+	require.Equal(t, http.StatusForbidden, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &problem))
+	assert.Equal(t, CodeProofOfWorkInvalid, problem["code"])
+
+	// Signed prompts skip the gate
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	sender := &utils.Sender{PublicKey: base64.StdEncoding.EncodeToString(pub), Timestamp: time.Now().Unix()}
+	sender.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(priv, utils.SenderPayload(sender.Timestamp, []string{key}, "Continue?")))
+	assert.Equal(t, http.StatusAccepted, postPrompt(h, map[string]interface{}{"public_key": key, "sender": sender}).Code)
+}
+
+func TestPromptHandler_Challenge_MissingRecipient(t *testing.T) {
+	h := NewPromptHandler(testConfig(), core.NewPromptStore(), testTokens)
+	w := httptest.NewRecorder()
+	h.Challenge(w, httptest.NewRequest("GET", "/api/challenge", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
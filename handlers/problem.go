@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Error codes returned in the code member of a problem. Clients switch on
+// these, so they never change once released.
+const (
+	CodeBodyTooLarge           = "body_too_large"
+	CodeInvalidBody            = "invalid_body"
+	CodeMissingField           = "missing_field"
+	CodeInvalidPublicKey       = "invalid_public_key"
+	CodeTooManyRecipients      = "too_many_recipients"
+	CodeInvalidPolicy          = "invalid_policy"
+	CodeInvalidInput           = "invalid_input"
+	CodeInvalidEncryption      = "invalid_encryption"
+	CodeInvalidCallbackURL     = "invalid_callback_url"
+	CodeInvalidTimeout         = "invalid_timeout"
+	CodeInvalidSender          = "invalid_sender"
+	CodeSenderSignatureInvalid = "sender_signature_invalid"
+	CodeSenderRejected         = "sender_rejected"
+	CodeInvalidSenderPolicy    = "invalid_sender_policy"
+	CodeProofOfWorkRequired    = "proof_of_work_required"
+	CodeProofOfWorkInvalid     = "proof_of_work_invalid"
+	CodeInvalidWait            = "invalid_wait"
+	CodeRateLimited            = "rate_limited"
+	CodeTooManyPending         = "too_many_pending"
+	CodeMissingKey             = "missing_key"
+	CodeKeyMismatch            = "key_mismatch"
+	CodeMissingToken           = "missing_token"
+	CodeTokenExpired           = "token_expired"
+	CodeTokenInvalid           = "token_invalid"
+	CodeMissingSignature       = "missing_signature"
+	CodeSignatureMalformed     = "signature_malformed"
+	CodeSignatureInvalid       = "signature_invalid"
+	CodeMissingPosterToken     = "missing_poster_token"
+	CodePosterTokenInvalid     = "poster_token_invalid"
+	CodePromptNotFound         = "prompt_not_found"
+	CodeNotRecipient           = "not_recipient"
+	CodePromptClosed           = "prompt_closed"
+	CodeAlreadyAnswered        = "already_answered"
+	CodePromptExpired          = "prompt_expired"
+	CodeInvalidReceipt         = "invalid_receipt"
+	CodeInvalidResponse        = "invalid_response"
+	CodeNotFound               = "not_found"
+	CodeMethodNotAllowed       = "method_not_allowed"
+	CodeServiceRestarting      = "service_restarting"
+	CodeInternal               = "internal_error"
+)
+
+// ProblemContentType is the media type of problem details (RFC 9457).
+const ProblemContentType = "application/problem+json"
+
+// Problem is an RFC 9457 problem details object. Code is a stable, machine
+// readable error code; Detail is meant for people and may change. Extra
+// members are merged into the object.
+type Problem struct {
+	Type   string
+	Title  string
+	Status int
+	Code   string
+	Detail string
+	Extra  map[string]interface{}
+}
+
+func (p Problem) MarshalJSON() ([]byte, error) {
+	members := map[string]interface{}{}
+	for name, value := range p.Extra {
+		members[name] = value
+	}
+	members["type"] = p.Type
+	members["title"] = p.Title
+	members["status"] = p.Status
+	members["code"] = p.Code
+	if p.Detail != "" {
+		members["detail"] = p.Detail
+	}
+	return json.Marshal(members)
+}
+
+// writeProblem writes an error response as problem details.
+func writeProblem(w http.ResponseWriter, status int, code string, detail string) {
+	writeProblemWith(w, status, code, detail, nil)
+}
+
+// writeProblemWith writes an error response as problem details with extra
+// members, such as the id of the prompt it is about.
+func writeProblemWith(w http.ResponseWriter, status int, code string, detail string, extra map[string]interface{}) {
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Code:   code,
+		Detail: detail,
+		Extra:  extra,
+	})
+}
+
+// isAPI reports whether the request is for the JSON API rather than a page.
+func isAPI(r *http.Request) bool {
+	return r.URL.Path == "/api" || strings.HasPrefix(r.URL.Path, "/api/")
+}
+
+// NotFound answers unknown API routes with a problem and anything else
+// with the usual plain text 404.
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	if !isAPI(r) {
+		http.NotFound(w, r)
+		return
+	}
+	writeProblem(w, http.StatusNotFound, CodeNotFound, "No such endpoint")
+}
+
+// MethodNotAllowed answers API routes called with the wrong method with a
+// problem and anything else with plain text.
+func MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	if !isAPI(r) {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	writeProblem(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "Method "+r.Method+" is not allowed")
+}
@@ -1,78 +1,468 @@
 package handlers
 
 import (
+	"context"
+	"crypto/ed25519"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"prompt-service-server/config"
 	"prompt-service-server/core"
+	"prompt-service-server/logging"
 	"prompt-service-server/utils"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
-var cfg = config.LoadConfig()
-
 type PromptHandler struct {
-	store *core.PromptStore
+	cfg    *config.Config
+	store  *core.PromptStore
+	tokens *utils.TokenIssuer
+	limits *RateLimits
+	spent  *spentChallenges
+
+	// drain is cancelled when the server starts shutting down. held counts
+	// the posters waiting on their connection.
+	drain     context.Context
+	stopDrain context.CancelFunc
+	held      atomic.Int64
 }
 
-func NewPromptHandler(store *core.PromptStore) *PromptHandler {
+func NewPromptHandler(cfg *config.Config, store *core.PromptStore, tokens *utils.TokenIssuer) *PromptHandler {
+	drain, stopDrain := context.WithCancel(context.Background())
 	return &PromptHandler{
-		store: store,
+		cfg:       cfg,
+		store:     store,
+		tokens:    tokens,
+		limits:    NewRateLimits(cfg),
+		spent:     newSpentChallenges(),
+		drain:     drain,
+		stopDrain: stopDrain,
 	}
 }
 
+// RateLimits returns the limiters that throttle posting prompts.
+func (h *PromptHandler) RateLimits() *RateLimits {
+	return h.limits
+}
+
 func (h *PromptHandler) Post(w http.ResponseWriter, r *http.Request) {
-	if r.ContentLength > cfg.MaxRequestBodySize {
-		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+	if h.Draining() {
+		writeRestarting(w, "The server is restarting and takes no new prompts", nil)
+		return
+	}
+	if !h.limits.allowClient(w, r) {
+		return
+	}
+	if r.ContentLength > h.cfg.MaxRequestBodySize {
+		writeProblem(w, http.StatusRequestEntityTooLarge, CodeBodyTooLarge, "Request body too large")
 		return
 	}
 
 	// Parse request body
 	var req struct {
-		PublicKey string `json:"public_key"`
-		Message   string `json:"message"`
+		PublicKey  string               `json:"public_key"`
+		Recipients []string             `json:"recipients"`
+		Policy     *core.ApprovalPolicy `json:"policy"`
+		Message    string               `json:"message"`
+		Input      *core.InputSpec      `json:"input"`
+		Timeout    float64              `json:"timeout"` // Seconds, defaults to the server setting
+		Async      bool                 `json:"async"`
+		Encrypted  bool                 `json:"encrypted"` // Message is sealed to the recipient
+		ReplyKey   string               `json:"reply_key"` // X25519 key to seal the response to
+		// The result is posted to CallbackURL instead of the held connection
+		CallbackURL string `json:"callback_url"`
+		// Sender signs the prompt. It may be sent in headers instead.
+		Sender *utils.Sender `json:"sender"`
+		// ProofOfWork solves a challenge from /api/challenge. Only unsigned
+		// prompts for recipients that ask for it need one.
+		ProofOfWork *utils.ProofOfWork `json:"proof_of_work"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	body := http.MaxBytesReader(w, r.Body, h.cfg.MaxRequestBodySize)
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		writeBodyProblem(w, err)
 		return
 	}
 
+	// public_key and recipients together name everyone the prompt goes to
+	recipients := recipientKeys(req.PublicKey, req.Recipients)
+
 	// Validate required fields
-	if req.PublicKey == "" || req.Message == "" {
-		http.Error(w, "Missing public_key or message", http.StatusBadRequest)
+	if len(recipients) == 0 || req.Message == "" {
+		writeProblem(w, http.StatusBadRequest, CodeMissingField, "Missing public_key or message")
+		return
+	}
+
+	// Every recipient costs an event log, a rate limit bucket and a send
+	if len(recipients) > h.cfg.MaxRecipients {
+		writeProblem(w, http.StatusBadRequest, CodeTooManyRecipients, fmt.Sprintf("A prompt may have at most %d recipients", h.cfg.MaxRecipients))
+		return
+	}
+
+	// Validate every key is an Ed25519 public key
+	for _, key := range recipients {
+		if !isPublicKey(key) {
+			writeProblem(w, http.StatusBadRequest, CodeInvalidPublicKey, "Invalid public_key format")
+			return
+		}
+	}
+
+	if len(recipients) > 1 && req.Policy == nil {
+		req.Policy = &core.ApprovalPolicy{Mode: core.PolicyAny}
+	}
+	if req.Policy != nil {
+		if err := req.Policy.Validate(len(recipients)); err != nil {
+			writeProblem(w, http.StatusBadRequest, CodeInvalidPolicy, "Invalid policy: "+err.Error())
+			return
+		}
+	}
+
+	if err := req.Input.Validate(); err != nil {
+		writeProblem(w, http.StatusBadRequest, CodeInvalidInput, "Invalid input: "+err.Error())
 		return
 	}
 
-	// Validate PublicKey is valid base64
-	if _, err := base64.StdEncoding.DecodeString(req.PublicKey); err != nil {
-		http.Error(w, "Invalid public_key format", http.StatusBadRequest)
+	if req.Encrypted {
+		// The server cannot read the message, so it can only be relayed as is
+		if req.Policy != nil {
+			writeProblem(w, http.StatusBadRequest, CodeInvalidEncryption, "Encrypted prompts must have a single recipient")
+			return
+		}
+		if req.Input.IsStructured() {
+			writeProblem(w, http.StatusBadRequest, CodeInvalidEncryption, "Encrypted prompts only support free text input")
+			return
+		}
+		if !utils.IsSealed(req.Message) {
+			writeProblem(w, http.StatusBadRequest, CodeInvalidEncryption, "Encrypted message must be a sealed box")
+			return
+		}
+		if _, err := utils.ParseReplyKey(req.ReplyKey); err != nil {
+			writeProblem(w, http.StatusBadRequest, CodeInvalidEncryption, "Invalid reply_key")
+			return
+		}
+	}
+
+	sender, err := readSender(r, req.Sender)
+	if err == nil && sender != nil {
+		err = sender.Verify(recipients, req.Message)
+	}
+	if err != nil {
+		if errors.Is(err, utils.ErrInvalidSignature) {
+			auditRejected(r, CodeSenderSignatureInvalid, sender.PublicKey)
+			writeProblem(w, http.StatusUnauthorized, CodeSenderSignatureInvalid, "Invalid sender signature")
+		} else {
+			writeProblem(w, http.StatusBadRequest, CodeInvalidSender, "Invalid sender: "+err.Error())
+		}
+		return
+	}
+
+	// Recipients decide whose prompts reach them
+	senderKey := ""
+	if sender != nil {
+		senderKey = sender.PublicKey
+	}
+	if err := h.store.CheckSender(recipients, senderKey); err != nil {
+		auditRejected(r, CodeSenderRejected, senderKey)
+		writeProblem(w, http.StatusForbidden, CodeSenderRejected, "A recipient does not accept prompts from this sender")
+		return
+	}
+	taken := false
+	if sender == nil {
+		challenge, ok := h.checkProofOfWork(w, r, recipients, req.Message, req.ProofOfWork)
+		if !ok {
+			return
+		}
+		// A prompt that is refused further on does not use up the solution
+		defer func() {
+			if !taken && challenge != "" {
+				h.spent.release(challenge)
+			}
+		}()
+	}
+	if !h.limits.allowPrompt(w, senderKey, recipients) {
+		return
+	}
+
+	if req.CallbackURL != "" && !isWebhookURL(req.CallbackURL, h.cfg.WebhookAllowPrivate) {
+		writeProblem(w, http.StatusBadRequest, CodeInvalidCallbackURL, "Invalid callback_url")
+		return
+	}
+
+	if req.Timeout < 0 {
+		writeProblem(w, http.StatusBadRequest, CodeInvalidTimeout, "Invalid timeout")
+		return
+	}
+
+	prompt := &core.Prompt{
+		Key:       recipients[0],
+		Message:   req.Message,
+		Input:     req.Input,
+		Encrypted: req.Encrypted,
+		ExpiresAt: time.Now().Add(h.promptTimeout(req.Timeout)),
+		RequestId: logging.RequestID(r.Context()),
+	}
+	if req.Encrypted {
+		prompt.ReplyKey = req.ReplyKey
+	}
+	if sender != nil {
+		prompt.SenderKey = senderKey
+		prompt.SenderHash = utils.HashPublicKey(senderKey)
+	}
+	if req.Policy != nil {
+		prompt.Recipients = recipients
+		prompt.Policy = req.Policy
+	}
+
+	if req.CallbackURL != "" {
+		secret, err := utils.GenerateToken()
+		if err != nil {
+			writeProblem(w, http.StatusInternalServerError, CodeInternal, "Failed to generate webhook secret")
+			return
+		}
+		prompt.CallbackURL = req.CallbackURL
+		prompt.CallbackSecret = secret
+	}
+
+	if req.Async || req.CallbackURL != "" || prefersAsync(r) {
+		taken = h.postAsync(w, r, prompt)
 		return
 	}
 
 	signal := utils.NewSignal()
+	prompt.Callback = func(response string) {
+		signal.Signal(response)
+	}
+	h.held.Add(1)
+	defer h.held.Add(-1)
+	if err := h.store.Submit(prompt); err != nil {
+		writeSubmitProblem(w, r, err)
+		return
+	}
+	taken = true
 
-	defer h.store.RemovePrompt(h.store.AddPrompt(
-		req.PublicKey,
-		req.Message,
-		func(response string) {
-			signal.Signal(response)
-		},
-	))
-	response := signal.Wait()
+	// Stop waiting when the prompt expires, the poster goes away or the
+	// server shuts down
+	ctx, cancel := context.WithDeadline(r.Context(), prompt.ExpiresAt)
+	defer cancel()
+	defer context.AfterFunc(h.drain, cancel)()
+	response, err := signal.WaitContext(ctx)
+	if err != nil && h.Draining() && r.Context().Err() == nil {
+		if h.handOff(w, prompt) {
+			return
+		}
+		// Closed while shutting down. The prompt is no longer pending, so
+		// this returns right away.
+		if result, _ := h.store.Result(context.Background(), prompt.Id); result.Status == core.StatusAnswered {
+			response, err = result.Response, nil
+		}
+	}
+	if err != nil {
+		if r.Context().Err() != nil {
+			// Nobody is left to read the answer
+			h.store.CancelPrompt(prompt.Id)
+			return
+		}
+		// An answer that closed the prompt just before the deadline may
+		// not have reached the callback yet
+		if !h.store.ExpirePrompt(prompt.Id) {
+			if result, _ := h.store.Result(context.Background(), prompt.Id); result.Status == core.StatusAnswered {
+				response, err = result.Response, nil
+			}
+		}
+	}
+	if err != nil {
+		writeProblemWith(w, http.StatusRequestTimeout, CodePromptExpired, "Nobody answered in time", map[string]interface{}{
+			"id": prompt.Id,
+		})
+		return
+	}
+	if prompt.ResponseIsJSON() {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	// The prompt is closed, so this returns right away
+	if result, _ := h.store.Result(r.Context(), prompt.Id); result.Receipt != nil {
+		receipt, _ := json.Marshal(result.Receipt)
+		w.Header().Set("X-Receipt", base64.StdEncoding.EncodeToString(receipt))
+	}
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(response))
 }
 
+// auditRejected records a prompt that was refused for who sent it. reason
+// is the problem code.
+func auditRejected(r *http.Request, reason string, senderKey string) {
+	attrs := []any{"reason", reason}
+	if senderKey != "" {
+		attrs = append(attrs, "sender_hash", utils.HashPublicKey(senderKey))
+	}
+	logging.AuditFrom(r).Record(r.Context(), logging.AuditPromptRejected, attrs...)
+}
+
+// isPublicKey reports whether key is a base64 encoded Ed25519 public key.
+func isPublicKey(key string) bool {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	return err == nil && len(decoded) == ed25519.PublicKeySize
+}
+
+// recipientKeys merges public_key and recipients into one list without
+// duplicates, keeping the order they were given in.
+func recipientKeys(publicKey string, recipients []string) []string {
+	keys := []string{}
+	for _, key := range append([]string{publicKey}, recipients...) {
+		if key != "" && !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// postAsync stores the prompt and returns right away with a poster token
+// that can be used to fetch the result later. Returns whether the prompt
+// was stored.
+func (h *PromptHandler) postAsync(w http.ResponseWriter, r *http.Request, prompt *core.Prompt) bool {
+	token, err := utils.GenerateToken()
+	if err != nil {
+		writeProblem(w, http.StatusInternalServerError, CodeInternal, "Failed to generate poster token")
+		return false
+	}
+	prompt.PosterTokenHash = utils.HashToken(token)
+	if err := h.store.Submit(prompt); err != nil {
+		writeSubmitProblem(w, r, err)
+		return false
+	}
+
+	resultURL := "/api/prompts/" + prompt.Id + "/result"
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", resultURL)
+	w.Header().Set("Preference-Applied", "respond-async")
+	w.WriteHeader(http.StatusAccepted)
+	accepted := map[string]interface{}{
+		"id":           prompt.Id,
+		"poster_token": token,
+		"result_url":   resultURL,
+		"expires_at":   prompt.ExpiresAt,
+	}
+	if prompt.CallbackSecret != "" {
+		accepted["webhook_secret"] = prompt.CallbackSecret
+	}
+	json.NewEncoder(w).Encode(accepted)
+	return true
+}
+
+// isWebhookURL reports whether u is an absolute http or https URL. Unless
+// private addresses are allowed, hosts that are plainly internal are
+// refused here; names that resolve to internal addresses are refused when
+// the webhook is delivered.
+func isWebhookURL(u string, allowPrivate bool) bool {
+	parsed, err := url.Parse(u)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return false
+	}
+	if allowPrivate {
+		return true
+	}
+	if ip, err := netip.ParseAddr(parsed.Hostname()); err == nil {
+		return utils.IsPublicAddress(ip)
+	}
+	host := strings.ToLower(strings.TrimSuffix(parsed.Hostname(), "."))
+	return host != "localhost" && !strings.HasSuffix(host, ".localhost")
+}
+
+// prefersAsync reports whether the request carries "Prefer: respond-async".
+func prefersAsync(r *http.Request) bool {
+	for _, header := range r.Header.Values("Prefer") {
+		for _, preference := range strings.Split(header, ",") {
+			if strings.EqualFold(strings.TrimSpace(preference), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// maxResultWait caps how long a long-poll for a result is held open.
+const maxResultWait = 60 * time.Second
+
+// Result returns the outcome of an asynchronous prompt to its poster. With
+// ?wait=<seconds> the request is held until the prompt closes or the wait
+// runs out.
+func (h *PromptHandler) Result(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || token == "" {
+		logging.AuditFrom(r).Record(r.Context(), logging.AuditAuthFailed, "reason", CodeMissingPosterToken, "prompt_id", id)
+		writeProblem(w, http.StatusUnauthorized, CodeMissingPosterToken, "Missing poster token")
+		return
+	}
+
+	switch h.store.VerifyPosterToken(id, token) {
+	case nil:
+	case core.ErrPromptNotFound:
+		writeProblem(w, http.StatusNotFound, CodePromptNotFound, "Prompt not found")
+		return
+	default:
+		logging.AuditFrom(r).Record(r.Context(), logging.AuditAuthFailed, "reason", CodePosterTokenInvalid, "prompt_id", id)
+		writeProblem(w, http.StatusForbidden, CodePosterTokenInvalid, "Invalid poster token")
+		return
+	}
+
+	wait := time.Duration(0)
+	if value := r.URL.Query().Get("wait"); value != "" {
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil || seconds < 0 {
+			writeProblem(w, http.StatusBadRequest, CodeInvalidWait, "Invalid wait")
+			return
+		}
+		wait = min(time.Duration(seconds*float64(time.Second)), maxResultWait)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+	defer context.AfterFunc(h.drain, cancel)()
+	prompt, exists := h.store.Result(ctx, id)
+	if !exists {
+		writeProblem(w, http.StatusNotFound, CodePromptNotFound, "Prompt not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(prompt.Result())
+}
+
+// promptTimeout resolves the requested timeout in seconds against the
+// server default and maximum.
+func (h *PromptHandler) promptTimeout(seconds float64) time.Duration {
+	if seconds == 0 {
+		seconds = float64(h.cfg.PromptTimeoutSeconds)
+	}
+	if seconds > float64(h.cfg.MaxPromptTimeoutSeconds) {
+		seconds = float64(h.cfg.MaxPromptTimeoutSeconds)
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
 func (h *PromptHandler) Get(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	keyHash := vars["id"]
 	// Authenticate and verify CSRF for this request
-	key, err := AuthenticateAndVerifyCSRF(w, r, keyHash)
+	key, err := AuthenticateAndVerifyCSRF(w, r, h.tokens, keyHash)
 	if err != nil {
 		// Error response already written by helper
 		return
@@ -84,12 +474,12 @@ func (h *PromptHandler) Get(w http.ResponseWriter, r *http.Request) {
 	// Return list of prompts
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(h.store.GetPrompts(key, ""))
+	json.NewEncoder(w).Encode(h.store.PromptsFor(key))
 }
 
 func (h *PromptHandler) Respond(w http.ResponseWriter, r *http.Request) {
-	if r.ContentLength > cfg.MaxRequestBodySize {
-		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+	if r.ContentLength > h.cfg.MaxRequestBodySize {
+		writeProblem(w, http.StatusRequestEntityTooLarge, CodeBodyTooLarge, "Request body too large")
 		return
 	}
 
@@ -100,23 +490,167 @@ func (h *PromptHandler) Respond(w http.ResponseWriter, r *http.Request) {
 	for _, p := range h.store.GetPrompts("", id) {
 		if p.Id == id {
 			prompt = p
-			hashedKey := sha256.Sum256([]byte(prompt.Key))
+			// Any recipient may answer, so authenticate the one in the cookie
+			key := prompt.Key
+			if cookie, err := r.Cookie("publicKey"); err == nil && prompt.HasRecipient(cookie.Value) {
+				key = cookie.Value
+			}
+			hashedKey := sha256.Sum256([]byte(key))
 			keyHash = hex.EncodeToString(hashedKey[:])
 			break
 		}
 	}
+	if prompt == nil {
+		writeProblem(w, http.StatusNotFound, CodePromptNotFound, "Prompt not found")
+		return
+	}
 
 	// Authenticate and verify CSRF for this request
-	if _, err := AuthenticateAndVerifyCSRF(w, r, keyHash); err != nil {
+	key, err := AuthenticateAndVerifyCSRF(w, r, h.tokens, keyHash)
+	if err != nil {
 		// Error response already written by helper
-		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	response := make([]byte, r.ContentLength)
-	r.Body.Read(response)
-	prompt.Callback(string(response))
-	h.store.SendEventToConnections(prompt.Key, "prompt_responded", string(response), prompt.Id)
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, h.cfg.MaxRequestBodySize))
+	if err != nil {
+		writeBodyProblem(w, err)
+		return
+	}
+	if prompt.Encrypted && !utils.IsSealed(string(body)) {
+		writeProblem(w, http.StatusUnprocessableEntity, CodeInvalidResponse, "Response to an encrypted prompt must be a sealed box")
+		return
+	}
+	response, err := prompt.Input.ParseAnswer(string(body))
+	if err != nil {
+		writeProblem(w, http.StatusUnprocessableEntity, CodeInvalidResponse, err.Error())
+		return
+	}
+	// The receipt covers the response as it is stored and handed to the
+	// poster, so a signed answer has to be sent in that form
+	receipt, err := readReceipt(r, prompt, key, response)
+	if receipt != nil || errors.Is(err, utils.ErrInvalidSignature) {
+		if response != string(body) {
+			err = errors.New("the signed answer must be in canonical form, compact JSON with sorted keys")
+		}
+	}
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, utils.ErrInvalidSignature) {
+			status = http.StatusUnauthorized
+		}
+		writeProblem(w, status, CodeInvalidReceipt, "Invalid receipt: "+err.Error())
+		return
+	}
+	snapshot, err := h.store.AnswerContext(r.Context(), prompt.Id, key, response, receipt)
+	switch err {
+	case nil:
+	case core.ErrPromptNotFound:
+		// Removed since it was looked up
+		writeProblem(w, http.StatusNotFound, CodePromptNotFound, "Prompt not found")
+		return
+	case core.ErrNotRecipient:
+		writeProblem(w, http.StatusForbidden, CodeNotRecipient, "Not a recipient of this prompt")
+		return
+	case core.ErrAlreadyAnswered:
+		writeConflict(w, CodeAlreadyAnswered, "You already answered this prompt", snapshot.Conflict(key))
+		return
+	default:
+		// Someone got there first. Tell the responder who won and when.
+		writeConflict(w, CodePromptClosed, "Prompt already closed", snapshot.Conflict(key))
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(prompt.Id))
 }
+
+// maxSenderSkew is how far a sender timestamp may be from the server clock.
+const maxSenderSkew = 5 * time.Minute
+
+// readSender returns the sender block of a prompt, or builds it from the
+// X-Sender-Key, X-Sender-Signature and X-Sender-Timestamp headers. Returns
+// nil if the prompt is not signed. The signature is not checked here.
+func readSender(r *http.Request, sender *utils.Sender) (*utils.Sender, error) {
+	if r.Header.Get("X-Sender-Key") != "" || r.Header.Get("X-Sender-Signature") != "" {
+		if sender != nil {
+			return nil, errors.New("sender given in both the body and headers")
+		}
+		timestamp, err := strconv.ParseInt(r.Header.Get("X-Sender-Timestamp"), 10, 64)
+		if err != nil {
+			return nil, errors.New("missing or malformed timestamp")
+		}
+		sender = &utils.Sender{
+			PublicKey: r.Header.Get("X-Sender-Key"),
+			Signature: r.Header.Get("X-Sender-Signature"),
+			Timestamp: timestamp,
+		}
+	}
+	if sender == nil {
+		return nil, nil
+	}
+	if sender.PublicKey == "" || sender.Signature == "" {
+		return nil, errors.New("missing public_key or signature")
+	}
+	if skew := time.Since(time.Unix(sender.Timestamp, 0)); skew > maxSenderSkew || skew < -maxSenderSkew {
+		return nil, errors.New("timestamp is too far from the server time")
+	}
+	return sender, nil
+}
+
+// writeBodyProblem reports a request body that could not be read.
+func writeBodyProblem(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeProblem(w, http.StatusRequestEntityTooLarge, CodeBodyTooLarge, "Request body too large")
+		return
+	}
+	writeProblem(w, http.StatusBadRequest, CodeInvalidBody, "Invalid request body")
+}
+
+// writeConflict reports a response that came too late, with what is known
+// about the answer that got there first.
+func writeConflict(w http.ResponseWriter, code string, detail string, conflict core.Conflict) {
+	extra := map[string]interface{}{
+		"id":            conflict.Id,
+		"prompt_status": conflict.Status,
+	}
+	if conflict.AnsweredAt != nil {
+		extra["answered_at"] = conflict.AnsweredAt
+	}
+	if conflict.Receipt != nil {
+		extra["receipt"] = conflict.Receipt
+	}
+	writeProblemWith(w, http.StatusConflict, code, detail, extra)
+}
+
+// maxReceiptSkew is how far a receipt timestamp may be from the server clock.
+const maxReceiptSkew = 5 * time.Minute
+
+// readReceipt builds the receipt for a response from the X-Receipt-Signature
+// and X-Receipt-Timestamp headers and verifies it the same way the CSRF
+// challenge is verified. Returns nil if the responder did not sign.
+func readReceipt(r *http.Request, prompt *core.Prompt, key string, response string) (*utils.Receipt, error) {
+	signature := r.Header.Get("X-Receipt-Signature")
+	if signature == "" {
+		return nil, nil
+	}
+	timestamp, err := strconv.ParseInt(r.Header.Get("X-Receipt-Timestamp"), 10, 64)
+	if err != nil {
+		return nil, errors.New("missing or malformed timestamp")
+	}
+	if skew := time.Since(time.Unix(timestamp, 0)); skew > maxReceiptSkew || skew < -maxReceiptSkew {
+		return nil, errors.New("timestamp is too far from the server time")
+	}
+	receipt := &utils.Receipt{
+		PromptId:    prompt.Id,
+		MessageHash: utils.HashMessage(prompt.Message),
+		Response:    response,
+		Timestamp:   timestamp,
+		PublicKey:   key,
+		Signature:   signature,
+	}
+	if err := utils.VerifyReceipt(receipt, prompt.Message); err != nil {
+		return nil, err
+	}
+	return receipt, nil
+}
@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"prompt-service-server/config"
+	"prompt-service-server/core"
+	"prompt-service-server/logging"
+	"prompt-service-server/utils"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RateLimits throttles posting prompts per client IP, per signing sender
+// and per recipient. Any of them may be nil to turn that limit off.
+type RateLimits struct {
+	IP         *utils.RateLimiter
+	Sender     *utils.RateLimiter
+	Recipient  *utils.RateLimiter
+	trustProxy bool
+}
+
+// NewRateLimits creates the limiters described by cfg.
+func NewRateLimits(cfg *config.Config) *RateLimits {
+	return &RateLimits{
+		IP:         utils.NewRateLimiter(cfg.RateLimitIPPerMinute, cfg.RateLimitIPBurst),
+		Sender:     utils.NewRateLimiter(cfg.RateLimitSenderPerMinute, cfg.RateLimitSenderBurst),
+		Recipient:  utils.NewRateLimiter(cfg.RateLimitRecipientPerMinute, cfg.RateLimitRecipientBurst),
+		trustProxy: cfg.TrustProxy,
+	}
+}
+
+// allowClient takes a token for the client that sent r. If the client is
+// over its limit a problem is written and false returned.
+func (l *RateLimits) allowClient(w http.ResponseWriter, r *http.Request) bool {
+	if ok, wait := l.IP.Allow(l.clientIP(r)); !ok {
+		writeRateLimited(w, wait, "ip", "Too many prompts from this address")
+		return false
+	}
+	return true
+}
+
+// allowPrompt takes a token for the sender, if the prompt is signed, and
+// for every recipient. If any of them is over its limit a problem is
+// written and false returned. Every bucket is checked before any token is
+// taken, so a refused prompt does not use up the others.
+func (l *RateLimits) allowPrompt(w http.ResponseWriter, senderKey string, recipients []string) bool {
+	type limit struct {
+		limiter *utils.RateLimiter
+		key     string
+		scope   string
+		detail  string
+	}
+	var limits []limit
+	if senderKey != "" {
+		limits = append(limits, limit{l.Sender, senderKey, "sender", "Too many prompts from this sender"})
+	}
+	for _, key := range recipients {
+		limits = append(limits, limit{l.Recipient, key, "recipient", "Too many prompts for this recipient"})
+	}
+	// Taking can still fail if a concurrent prompt took the last token
+	for _, take := range []func(*utils.RateLimiter, string) (bool, time.Duration){
+		(*utils.RateLimiter).Check,
+		(*utils.RateLimiter).Allow,
+	} {
+		for _, limit := range limits {
+			if ok, wait := take(limit.limiter, limit.key); !ok {
+				writeRateLimited(w, wait, limit.scope, limit.detail)
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// clientIP returns the address r came from. Behind a trusted proxy that is
+// the last address the proxy appended to X-Forwarded-For; earlier entries
+// are set by the client and can't be trusted.
+func (l *RateLimits) clientIP(r *http.Request) string {
+	if l.trustProxy {
+		forwarded := r.Header.Values("X-Forwarded-For")
+		if len(forwarded) > 0 {
+			hops := strings.Split(forwarded[len(forwarded)-1], ",")
+			if ip := strings.TrimSpace(hops[len(hops)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// writeRateLimited answers a request that went over a rate limit. scope
+// says which limit it was: ip, sender or recipient.
+func writeRateLimited(w http.ResponseWriter, wait time.Duration, scope string, detail string) {
+	w.Header().Set("Retry-After", retryAfter(wait))
+	writeProblemWith(w, http.StatusTooManyRequests, CodeRateLimited, detail, map[string]interface{}{
+		"scope": scope,
+	})
+}
+
+// writeSubmitProblem answers a prompt that the store refused to take.
+func writeSubmitProblem(w http.ResponseWriter, r *http.Request, err error) {
+	var quota *core.QuotaError
+	if errors.As(err, &quota) {
+		wait := quota.RetryAfter
+		if wait <= 0 {
+			// None of the pending prompts expire; try again later
+			wait = time.Minute
+		}
+		w.Header().Set("Retry-After", retryAfter(wait))
+		writeProblem(w, http.StatusTooManyRequests, CodeTooManyPending, "A recipient has too many pending prompts")
+		return
+	}
+	logging.FromContext(r.Context()).Error("Failed to store prompt", "error", err)
+	writeProblem(w, http.StatusInternalServerError, CodeInternal, "Failed to store prompt")
+}
+
+// retryAfter formats wait as whole seconds for the Retry-After header,
+// rounding up so that clients don't come back too early.
+func retryAfter(wait time.Duration) string {
+	return strconv.Itoa(max(int(math.Ceil(wait.Seconds())), 1))
+}
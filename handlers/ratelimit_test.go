@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"prompt-service-server/config"
+	"prompt-service-server/core"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestKey(t *testing.T) string {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func postAsyncPrompt(h *PromptHandler, key string, remoteAddr string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(map[string]interface{}{
+		"public_key": key,
+		"message":    "Continue?",
+		"async":      true,
+	})
+	req := httptest.NewRequest("POST", "/api/prompts", bytes.NewReader(body))
+	req.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	h.Post(w, req)
+	return w
+}
+
+func assertTooManyRequests(t *testing.T, w *httptest.ResponseRecorder, code string) map[string]interface{} {
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	var problem map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &problem))
+	assert.Equal(t, code, problem["code"])
+	return problem
+}
+
+func TestPromptHandler_RateLimits(t *testing.T) {
+	h := NewPromptHandler(testConfig(), core.NewPromptStore(), testTokens)
+	h.limits = NewRateLimits(&config.Config{
+		RateLimitIPPerMinute:        1,
+		RateLimitIPBurst:            2,
+		RateLimitRecipientPerMinute: 1,
+		RateLimitRecipientBurst:     1,
+	})
+
+	// The IP limit applies across recipients
+	assert.Equal(t, http.StatusAccepted, postAsyncPrompt(h, newTestKey(t), "192.0.2.1:1234").Code)
+	assert.Equal(t, http.StatusAccepted, postAsyncPrompt(h, newTestKey(t), "192.0.2.1:1234").Code)
+	problem := assertTooManyRequests(t, postAsyncPrompt(h, newTestKey(t), "192.0.2.1:1234"), CodeRateLimited)
+	assert.Equal(t, "ip", problem["scope"])
+
+	// The recipient limit applies across IPs
+	key := newTestKey(t)
+	assert.Equal(t, http.StatusAccepted, postAsyncPrompt(h, key, "192.0.2.2:1234").Code)
+	problem = assertTooManyRequests(t, postAsyncPrompt(h, key, "192.0.2.3:1234"), CodeRateLimited)
+	assert.Equal(t, "recipient", problem["scope"])
+
+	assert.Equal(t, uint64(1), h.RateLimits().IP.Rejected())
+	assert.Equal(t, uint64(1), h.RateLimits().Recipient.Rejected())
+}
+
+func TestRateLimits_AllowPromptTakesAllOrNothing(t *testing.T) {
+	limits := NewRateLimits(&config.Config{
+		RateLimitSenderPerMinute:    1,
+		RateLimitSenderBurst:        1,
+		RateLimitRecipientPerMinute: 1,
+		RateLimitRecipientBurst:     1,
+	})
+	sender, busy, idle := newTestKey(t), newTestKey(t), newTestKey(t)
+	require.True(t, limits.allowPrompt(httptest.NewRecorder(), "", []string{busy}))
+
+	// The busy recipient refuses, so the sender and the idle recipient keep
+	// their tokens
+	w := httptest.NewRecorder()
+	assert.False(t, limits.allowPrompt(w, sender, []string{idle, busy}))
+	problem := assertTooManyRequests(t, w, CodeRateLimited)
+	assert.Equal(t, "recipient", problem["scope"])
+	assert.True(t, limits.allowPrompt(httptest.NewRecorder(), sender, []string{idle}))
+	assert.Equal(t, uint64(0), limits.Sender.Rejected())
+	assert.Equal(t, uint64(1), limits.Recipient.Rejected())
+}
+
+func TestPromptHandler_PendingQuota(t *testing.T) {
+	h := NewPromptHandler(testConfig(), core.NewPromptStoreWithOptions(core.StoreOptions{MaxPending: 1}), testTokens)
+	h.limits = NewRateLimits(&config.Config{})
+	key := newTestKey(t)
+
+	assert.Equal(t, http.StatusAccepted, postAsyncPrompt(h, key, "192.0.2.1:1234").Code)
+	assertTooManyRequests(t, postAsyncPrompt(h, key, "192.0.2.1:1234"), CodeTooManyPending)
+
+	// Other recipients are not affected
+	assert.Equal(t, http.StatusAccepted, postAsyncPrompt(h, newTestKey(t), "192.0.2.1:1234").Code)
+}
+
+func TestRateLimits_ClientIP(t *testing.T) {
+	req := httptest.NewRequest("POST", "/api/prompts", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Add("X-Forwarded-For", "203.0.113.9, 198.51.100.7")
+
+	direct := NewRateLimits(&config.Config{})
+	assert.Equal(t, "192.0.2.1", direct.clientIP(req))
+
+	// Only the hop added by the proxy is trusted
+	proxied := NewRateLimits(&config.Config{TrustProxy: true})
+	assert.Equal(t, "198.51.100.7", proxied.clientIP(req))
+}
+
+func TestRetryAfter(t *testing.T) {
+	assert.Equal(t, "1", retryAfter(0))
+	assert.Equal(t, "2", retryAfter(1500*time.Millisecond))
+	assert.Equal(t, "60", retryAfter(time.Minute))
+}
@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// RedirectToHTTPS answers plain HTTP requests with a permanent redirect to
+// the same URL over HTTPS on port. The method and body are kept, so posts
+// are redirected too.
+func RedirectToHTTPS(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hostname := r.Host
+		if host, _, err := net.SplitHostPort(r.Host); err == nil {
+			hostname = host
+		}
+		hostname = strings.Trim(hostname, "[]")
+		if hostname == "" {
+			http.Error(w, "Missing Host header", http.StatusBadRequest)
+			return
+		}
+		host := net.JoinHostPort(hostname, port)
+		if port == "443" {
+			host = strings.TrimSuffix(host, ":443")
+		}
+		target := url.URL{
+			Scheme:   "https",
+			Host:     host,
+			Path:     r.URL.Path,
+			RawPath:  r.URL.RawPath,
+			RawQuery: r.URL.RawQuery,
+		}
+		http.Redirect(w, r, target.String(), http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedirectToHTTPS(t *testing.T) {
+	for _, test := range []struct {
+		port     string
+		host     string
+		target   string
+		expected string
+	}{
+		{"443", "example.com", "/key/abc?x=1", "https://example.com/key/abc?x=1"},
+		{"443", "example.com:80", "/", "https://example.com/"},
+		{"8443", "example.com:8080", "/api/prompts", "https://example.com:8443/api/prompts"},
+		{"8443", "[::1]:8080", "/", "https://[::1]:8443/"},
+		{"443", "[::1]", "/", "https://[::1]/"},
+	} {
+		req := httptest.NewRequest("POST", test.target, nil)
+		req.Host = test.host
+		w := httptest.NewRecorder()
+		RedirectToHTTPS(test.port).ServeHTTP(w, req)
+		assert.Equal(t, http.StatusPermanentRedirect, w.Code, test.host)
+		assert.Equal(t, test.expected, w.Header().Get("Location"), test.host)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Host = ""
+	w := httptest.NewRecorder()
+	RedirectToHTTPS("443").ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"prompt-service-server/config"
+	"prompt-service-server/core"
+	"prompt-service-server/utils"
+
+	"github.com/gorilla/mux"
+)
+
+// SenderPolicyHandler lets a key holder decide whose prompts reach it.
+type SenderPolicyHandler struct {
+	cfg    *config.Config
+	store  *core.PromptStore
+	tokens *utils.TokenIssuer
+}
+
+func NewSenderPolicyHandler(cfg *config.Config, store *core.PromptStore, tokens *utils.TokenIssuer) *SenderPolicyHandler {
+	return &SenderPolicyHandler{cfg: cfg, store: store, tokens: tokens}
+}
+
+// Get returns the sender policy of the authenticated key.
+func (h *SenderPolicyHandler) Get(w http.ResponseWriter, r *http.Request) {
+	key, err := AuthenticateAndVerifyCSRF(w, r, h.tokens, mux.Vars(r)["id"])
+	if err != nil {
+		// Error response already written by helper
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(h.store.SenderPolicy(key))
+}
+
+// Put replaces the sender policy of the authenticated key.
+func (h *SenderPolicyHandler) Put(w http.ResponseWriter, r *http.Request) {
+	if r.ContentLength > h.cfg.MaxRequestBodySize {
+		writeProblem(w, http.StatusRequestEntityTooLarge, CodeBodyTooLarge, "Request body too large")
+		return
+	}
+	key, err := AuthenticateAndVerifyCSRF(w, r, h.tokens, mux.Vars(r)["id"])
+	if err != nil {
+		// Error response already written by helper
+		return
+	}
+
+	var policy core.SenderPolicy
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, h.cfg.MaxRequestBodySize)).Decode(&policy); err != nil {
+		writeBodyProblem(w, err)
+		return
+	}
+	if err := policy.Validate(); err != nil {
+		writeProblem(w, http.StatusBadRequest, CodeInvalidSenderPolicy, "Invalid sender policy: "+err.Error())
+		return
+	}
+	if err := h.store.SetSenderPolicy(key, policy); err != nil {
+		writeProblem(w, http.StatusInternalServerError, CodeInternal, "Failed to store sender policy")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(policy)
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"prompt-service-server/core"
+	"prompt-service-server/utils"
+	"strconv"
+	"time"
+)
+
+// RestartRetryAfter is how long clients are asked to wait before they come
+// back while the server restarts.
+const RestartRetryAfter = 5 * time.Second
+
+// Drain starts shutting down. New prompts are refused with 503, posters
+// waiting on their connection get their prompt handed over or cancelled,
+// and long-polls for results return what is known now.
+func (h *PromptHandler) Drain() {
+	h.stopDrain()
+}
+
+// Draining reports whether Drain was called.
+func (h *PromptHandler) Draining() bool {
+	return h.drain.Err() != nil
+}
+
+// WaitHeld waits until every poster that was waiting on its connection got
+// an answer, or ctx is done.
+func (h *PromptHandler) WaitHeld(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for h.held.Load() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// handOff answers a poster that is waiting on its connection while the
+// server shuts down. With durable storage the prompt is kept and the
+// poster gets a poster token to fetch the result after the restart.
+// Otherwise the prompt is cancelled. Returns false if the prompt closed in
+// the meantime, in which case nothing was written.
+func (h *PromptHandler) handOff(w http.ResponseWriter, prompt *core.Prompt) bool {
+	if h.store.Durable() {
+		if token, err := utils.GenerateToken(); err == nil && h.store.HandOff(prompt.Id, utils.HashToken(token)) == nil {
+			resultURL := "/api/prompts/" + prompt.Id + "/result"
+			w.Header().Set("Location", resultURL)
+			writeRestarting(w, "The server is restarting. Fetch the result with the poster token once it is back.", map[string]interface{}{
+				"id":           prompt.Id,
+				"poster_token": token,
+				"result_url":   resultURL,
+				"expires_at":   prompt.ExpiresAt,
+			})
+			return true
+		}
+	}
+	if !h.store.CancelPrompt(prompt.Id) {
+		return false
+	}
+	writeRestarting(w, "The server is restarting and the prompt was cancelled. Post it again.", map[string]interface{}{
+		"id": prompt.Id,
+	})
+	return true
+}
+
+// writeRestarting answers with 503 and a hint when to come back.
+func writeRestarting(w http.ResponseWriter, detail string, extra map[string]interface{}) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(RestartRetryAfter.Seconds())))
+	writeProblemWith(w, http.StatusServiceUnavailable, CodeServiceRestarting, detail, extra)
+}
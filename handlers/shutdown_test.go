@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"prompt-service-server/core"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// drainHeldPost posts a prompt that waits on its connection, starts
+// draining once it is held and returns the response the poster got.
+func drainHeldPost(t *testing.T, h *PromptHandler) (*httptest.ResponseRecorder, map[string]interface{}) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"public_key": newTestKey(t),
+		"message":    "Continue?",
+	})
+	req := httptest.NewRequest("POST", "/api/prompts", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		h.Post(w, req)
+		close(done)
+	}()
+	for h.held.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	h.Drain()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, h.WaitHeld(ctx))
+	<-done
+
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "5", w.Header().Get("Retry-After"))
+	var problem map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &problem))
+	assert.Equal(t, CodeServiceRestarting, problem["code"])
+	return w, problem
+}
+
+func TestPromptHandler_DrainRefusesNewPrompts(t *testing.T) {
+	h := NewPromptHandler(testConfig(), core.NewPromptStore(), testTokens)
+	assert.False(t, h.Draining())
+	h.Drain()
+	assert.True(t, h.Draining())
+
+	w := postAsyncPrompt(h, newTestKey(t), "192.0.2.1:1234")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+}
+
+func TestPromptHandler_DrainCancelsHeldPrompt(t *testing.T) {
+	h := NewPromptHandler(testConfig(), core.NewPromptStore(), testTokens)
+
+	_, problem := drainHeldPost(t, h)
+	require.NotEmpty(t, problem["id"])
+	assert.Nil(t, problem["poster_token"])
+	result, exists := h.store.Result(context.Background(), problem["id"].(string))
+	require.True(t, exists)
+	assert.Equal(t, core.StatusCancelled, result.Status)
+}
+
+func TestPromptHandler_DrainHandsOffHeldPrompt(t *testing.T) {
+	storage, err := core.OpenFileStorage(filepath.Join(t.TempDir(), "prompts.journal"))
+	require.NoError(t, err)
+	store := core.NewPromptStoreWithOptions(core.StoreOptions{Storage: storage})
+	defer store.Close()
+	h := NewPromptHandler(testConfig(), store, testTokens)
+
+	w, problem := drainHeldPost(t, h)
+	id := problem["id"].(string)
+	assert.Equal(t, "/api/prompts/"+id+"/result", w.Header().Get("Location"))
+	assert.NotEmpty(t, problem["poster_token"])
+
+	// The prompt stays open for the recipient to answer after the restart
+	peek, cancel := context.WithCancel(context.Background())
+	cancel()
+	result, exists := store.Result(peek, id)
+	require.True(t, exists)
+	assert.Equal(t, core.StatusPending, result.Status)
+}
+
+func TestHealthHandler(t *testing.T) {
+	ready := true
+	h := NewHealthHandler(func() bool { return ready })
+
+	w := httptest.NewRecorder()
+	h.Healthz(w, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	h.Readyz(w, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	ready = false
+	w = httptest.NewRecorder()
+	h.Readyz(w, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.JSONEq(t, `{"status":"shutting_down"}`, w.Body.String())
+
+	// Liveness does not depend on readiness
+	w = httptest.NewRecorder()
+	h.Healthz(w, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
@@ -3,17 +3,19 @@ package handlers
 import (
 	"net/http"
 	"prompt-service-server/core"
+	"prompt-service-server/utils"
 	"time"
 
 	"github.com/gorilla/mux"
 )
 
 type SSEHandler struct {
-	store *core.PromptStore
+	store  *core.PromptStore
+	tokens *utils.TokenIssuer
 }
 
-func NewSSEHandler(store *core.PromptStore) *SSEHandler {
-	return &SSEHandler{store: store}
+func NewSSEHandler(store *core.PromptStore, tokens *utils.TokenIssuer) *SSEHandler {
+	return &SSEHandler{store: store, tokens: tokens}
 }
 
 func (h *SSEHandler) Get(w http.ResponseWriter, r *http.Request) {
@@ -21,7 +23,7 @@ func (h *SSEHandler) Get(w http.ResponseWriter, r *http.Request) {
 	keyHash := vars["id"]
 
 	// Authenticate and verify CSRF for this request
-	if _, err := AuthenticateAndVerifyCSRF(w, r, keyHash); err != nil {
+	if _, err := AuthenticateAndVerifyCSRF(w, r, h.tokens, keyHash); err != nil {
 		// Error response already written by helper
 		return
 	}
@@ -43,11 +45,9 @@ func (h *SSEHandler) Get(w http.ResponseWriter, r *http.Request) {
 	// Create connection object
 	flusher := w.(http.Flusher)
 
-	// Add connection to store (this would track connections by keyHash)
-	connection := h.store.AddSSEConnection(cookieKey, w, flusher)
-
-	// Send initial connection confirmation
-	h.store.SendEvent(w, flusher, "connected", "Connection established", cookieKey)
+	// Add connection to store and confirm it. A browser that reconnects
+	// sends the id of the last event it saw and gets what it missed.
+	connection := h.store.ResumeSSEConnection(cookieKey, w, flusher, r.Header.Get("Last-Event-ID"))
 
 	// Keep connection alive
 	ticker := time.NewTicker(60 * time.Second)
@@ -57,7 +57,12 @@ func (h *SSEHandler) Get(w http.ResponseWriter, r *http.Request) {
 		select {
 		case <-ticker.C:
 			// Send heartbeat
-			h.store.SendEvent(w, flusher, "heartbeat", "alive", cookieKey)
+			h.store.SendEventToConnection(connection, "heartbeat", "alive", cookieKey)
+		case <-connection.Done():
+			// Dropped for falling behind. The browser reconnects and
+			// catches up with Last-Event-ID.
+			h.store.RemoveSSEConnection(cookieKey, connection)
+			return
 		case <-r.Context().Done():
 			// Remove connection
 			h.store.RemoveSSEConnection(cookieKey, connection)
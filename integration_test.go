@@ -9,23 +9,45 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	"prompt-service-server/config"
+	"prompt-service-server/logging"
+	"prompt-service-server/metrics"
 	"prompt-service-server/utils"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+// testConfig returns valid settings for integration tests.
+func testConfig() *config.Config {
+	cfg := config.Default()
+	cfg.CSRFTokenSecret = "0123456789abcdef0123456789abcdef"
+	return cfg
+}
+
+// Public keys of recipients nobody answers for.
+var (
+	testPublicKey  = base64.StdEncoding.EncodeToString([]byte("test-public-key-of-32-bytes-long"))
+	otherPublicKey = base64.StdEncoding.EncodeToString([]byte("other-public-key-of-32-bytes-lon"))
+)
+
+// testTokens issues tokens the routers of testConfig accept.
+var testTokens = utils.NewTokenIssuer(testConfig())
+
 func setupTestRouter() *mux.Router {
-	cfg := config.LoadConfig()
-	return InitializeRouter(cfg)
+	return InitializeRouter(testConfig(), metrics.New(), nil)
 }
 
 func TestIndexHandler_Get(t *testing.T) {
@@ -68,13 +90,34 @@ func TestAuthHandler_Get(t *testing.T) {
 	}
 	assert.NotNil(t, csrfCookie)
 	assert.NotEmpty(t, csrfCookie.Value)
+	assert.False(t, csrfCookie.Secure)
+}
+
+func TestAuthHandler_Get_TLS(t *testing.T) {
+	server := httptest.NewUnstartedServer(setupTestRouter())
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	hashedKey := "c88e80202a4d650841e48649b4c3f553e48131b415db680476fd0d65632ff2b0" // sha256 of "test-public-key"
+	req, err := http.NewRequest("GET", server.URL+"/api/auth/"+hashedKey, nil)
+	require.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: "publicKey", Value: "test-public-key"})
+	res, err := server.Client().Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, 2, res.ProtoMajor)
+	require.Len(t, res.Cookies(), 1)
+	assert.True(t, res.Cookies()[0].Secure)
 }
 
 func TestPromptHandler_Post_Success(t *testing.T) {
 	router := setupTestRouter()
 
 	reqBody := map[string]string{
-		"public_key": "dGVzdC1wdWJsaWMta2V5", // base64 encoded "test-public-key"
+		"public_key": testPublicKey,
 		"message":    "Test prompt message",
 	}
 	body, _ := json.Marshal(reqBody)
@@ -134,6 +177,78 @@ func TestPromptHandler_Post_MissingFields(t *testing.T) {
 	assert.Contains(t, w.Body.String(), "Missing public_key or message")
 }
 
+func TestPromptHandler_Post_Timeout(t *testing.T) {
+	router := setupTestRouter()
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"public_key": testPublicKey,
+		"message":    "Nobody will answer this",
+		"timeout":    0.05,
+	})
+
+	req := httptest.NewRequest("POST", "/api/prompts", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusRequestTimeout, w.Code)
+	assert.Equal(t, "application/problem+json", w.Header().Get("Content-Type"))
+
+	var result map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, "prompt_expired", result["code"])
+	assert.NotEmpty(t, result["id"])
+}
+
+func TestPromptHandler_Post_PosterDisconnects(t *testing.T) {
+	router := setupTestRouter()
+
+	reqBody := map[string]string{
+		"public_key": testPublicKey,
+		"message":    "Poster will hang up",
+	}
+	body, _ := json.Marshal(reqBody)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("POST", "/api/prompts", bytes.NewReader(body)).WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	w := httptest.NewRecorder()
+	done := make(chan bool, 1)
+	go func() {
+		router.ServeHTTP(w, req)
+		done <- true
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+		// Handler stopped waiting once the poster went away
+	case <-time.After(time.Second):
+		t.Fatal("Handler should return when the poster disconnects")
+	}
+}
+
+func TestPromptHandler_Post_NegativeTimeout(t *testing.T) {
+	router := setupTestRouter()
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"public_key": testPublicKey,
+		"message":    "Test prompt message",
+		"timeout":    -1,
+	})
+
+	req := httptest.NewRequest("POST", "/api/prompts", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "Invalid timeout")
+}
+
 func TestPromptHandler_Get_Unauthenticated(t *testing.T) {
 	router := setupTestRouter()
 
@@ -142,21 +257,67 @@ func TestPromptHandler_Get_Unauthenticated(t *testing.T) {
 
 	router.ServeHTTP(w, req)
 
-	// Should redirect due to missing authentication
-	assert.Equal(t, http.StatusFound, w.Code)
-	assert.Equal(t, "/", w.Header().Get("Location"))
+	// Should fail due to missing authentication, without redirecting
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Empty(t, w.Header().Get("Location"))
 }
 
 func TestPromptHandler_Respond_Unauthenticated(t *testing.T) {
 	router := setupTestRouter()
+	pubKeyB64, _ := newTestIdentity(t)
+	id, _ := postAsyncPrompt(t, router, map[string]interface{}{
+		"public_key": pubKeyB64,
+		"message":    "Approve?",
+	})
 
-	req := httptest.NewRequest("POST", "/api/prompts/test-id", bytes.NewReader([]byte("response")))
+	req := httptest.NewRequest("POST", "/api/prompts/"+id, bytes.NewReader([]byte("response")))
 	w := httptest.NewRecorder()
 
 	router.ServeHTTP(w, req)
 
-	// Should redirect due to missing authentication (VerifyKeyHash redirects)
-	assert.Equal(t, http.StatusFound, w.Code)
+	// Should fail due to missing authentication
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestPromptHandler_Respond_UnknownPrompt(t *testing.T) {
+	router := setupTestRouter()
+	_, cookies := newTestIdentity(t)
+
+	w := respondToPrompt(router, "test-id", "response", cookies)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestPromptHandler_Respond_Conflict(t *testing.T) {
+	router := setupTestRouter()
+	pubKeyB64, cookies := newTestIdentity(t)
+	id, token := postAsyncPrompt(t, router, map[string]interface{}{
+		"public_key": pubKeyB64,
+		"message":    "Approve?",
+	})
+
+	// Two devices of the same recipient answer at once
+	codes := make(chan int, 2)
+	for _, response := range []string{"yes", "no"} {
+		go func(response string) {
+			codes <- respondToPrompt(router, id, response, cookies).Code
+		}(response)
+	}
+	first, second := <-codes, <-codes
+	assert.ElementsMatch(t, []int{http.StatusOK, http.StatusConflict}, []int{first, second})
+
+	result := fetchResult(t, router, id, token)
+	assert.Equal(t, "answered", result["status"])
+
+	// Late responders learn when the winning answer was given
+	w := respondToPrompt(router, id, "maybe", cookies)
+	require.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, "application/problem+json", w.Header().Get("Content-Type"))
+	var conflict map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &conflict))
+	assert.Equal(t, "prompt_closed", conflict["code"])
+	assert.Equal(t, id, conflict["id"])
+	assert.Equal(t, "answered", conflict["prompt_status"])
+	assert.Equal(t, result["closed_at"], conflict["answered_at"])
 }
 
 // Test the key handler
@@ -168,8 +329,8 @@ func TestSSEHandler_Get_Unauthenticated(t *testing.T) {
 
 	router.ServeHTTP(w, req)
 
-	// Should redirect due to missing authentication
-	assert.Equal(t, http.StatusFound, w.Code)
+	// Should fail due to missing authentication
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
 }
 
 func TestSSEHandler_Get_Authenticated(t *testing.T) {
@@ -184,7 +345,7 @@ func TestSSEHandler_Get_Authenticated(t *testing.T) {
 	keyHash := hex.EncodeToString(hashedKey[:])
 
 	// Create JWT and signature using the same pattern as auth tests
-	token, err := utils.GenerateCSRFToken(keyHash)
+	token, err := testTokens.GenerateCSRFToken(keyHash)
 	require.NoError(t, err)
 
 	signature := ed25519.Sign(priv, []byte(token))
@@ -243,7 +404,7 @@ func TestSSE_PromptNotification_Integration(t *testing.T) {
 	keyHash := hex.EncodeToString(hashedKey[:])
 
 	// Create JWT and signature
-	token, err := utils.GenerateCSRFToken(keyHash)
+	token, err := testTokens.GenerateCSRFToken(keyHash)
 	require.NoError(t, err)
 
 	signature := ed25519.Sign(priv, []byte(token))
@@ -385,7 +546,7 @@ func TestCORS_Integration(t *testing.T) {
 		router := setupTestRouter()
 
 		reqBody := map[string]string{
-			"public_key": "dGVzdC1wdWJsaWMta2V5", // base64 encoded "test-public-key"
+			"public_key": testPublicKey,
 			"message":    "Test CORS message",
 		}
 		body, _ := json.Marshal(reqBody)
@@ -424,3 +585,1081 @@ func TestCORS_Integration(t *testing.T) {
 		assert.Contains(t, w.Header().Get("Access-Control-Allow-Methods"), "POST")
 	})
 }
+
+// newTestIdentity creates a keypair and the cookies a browser holding it
+// would send after completing the CSRF challenge.
+func newTestIdentity(t *testing.T) (string, []*http.Cookie) {
+	pubKeyB64, _, cookies := newTestSigner(t)
+	return pubKeyB64, cookies
+}
+
+// newTestSigner is newTestIdentity that also returns the private key, for
+// tests that sign receipts.
+func newTestSigner(t *testing.T) (string, ed25519.PrivateKey, []*http.Cookie) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	pubKeyB64 := base64.StdEncoding.EncodeToString(pub)
+	hashedKey := sha256.Sum256([]byte(pubKeyB64))
+	keyHash := hex.EncodeToString(hashedKey[:])
+
+	token, err := testTokens.GenerateCSRFToken(keyHash)
+	require.NoError(t, err)
+	signature := ed25519.Sign(priv, []byte(token))
+
+	return pubKeyB64, priv, []*http.Cookie{
+		{Name: "publicKey", Value: pubKeyB64},
+		{Name: "CSRFToken", Value: token},
+		{Name: "CSRFChallenge", Value: base64.StdEncoding.EncodeToString(signature)},
+	}
+}
+
+func TestPromptHandler_Post_Async(t *testing.T) {
+	router := setupTestRouter()
+	pubKeyB64, cookies := newTestIdentity(t)
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"public_key": pubKeyB64,
+		"message":    "Approve the deploy?",
+		"async":      true,
+	})
+	req := httptest.NewRequest("POST", "/api/prompts", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	require.Equal(t, http.StatusAccepted, w.Code)
+	var accepted map[string]string
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &accepted))
+	id := accepted["id"]
+	token := accepted["poster_token"]
+	require.NotEmpty(t, id)
+	require.NotEmpty(t, token)
+	assert.Equal(t, "/api/prompts/"+id+"/result", w.Header().Get("Location"))
+
+	getResult := func(token string, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/prompts/"+id+"/result"+query, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, getResult("", "").Code)
+	assert.Equal(t, http.StatusForbidden, getResult("wrong-token", "").Code)
+
+	w = getResult(token, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var result map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, "pending", result["status"])
+
+	// Long-poll while the recipient answers
+	polled := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		polled <- getResult(token, "?wait=5")
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	respondReq := httptest.NewRequest("POST", "/api/prompts/"+id, bytes.NewReader([]byte("yes")))
+	for _, cookie := range cookies {
+		respondReq.AddCookie(cookie)
+	}
+	respondW := httptest.NewRecorder()
+	router.ServeHTTP(respondW, respondReq)
+	require.Equal(t, http.StatusOK, respondW.Code)
+
+	select {
+	case w = <-polled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Long-poll did not return after the prompt was answered")
+	}
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, "answered", result["status"])
+	assert.Equal(t, "yes", result["response"])
+
+	// The answer stays available for a poster that reconnects
+	w = getResult(token, "")
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, "yes", result["response"])
+}
+
+func TestPromptHandler_Post_PreferRespondAsync(t *testing.T) {
+	router := setupTestRouter()
+
+	body, _ := json.Marshal(map[string]string{
+		"public_key": testPublicKey,
+		"message":    "Test prompt message",
+	})
+	req := httptest.NewRequest("POST", "/api/prompts", bytes.NewReader(body))
+	req.Header.Set("Prefer", "wait=10, respond-async")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Equal(t, "respond-async", w.Header().Get("Preference-Applied"))
+	assert.Contains(t, w.Body.String(), `"poster_token"`)
+}
+
+// postAsyncPrompt posts an asynchronous prompt and returns its id and
+// poster token.
+func postAsyncPrompt(t *testing.T, router *mux.Router, prompt map[string]interface{}) (string, string) {
+	prompt["async"] = true
+	body, _ := json.Marshal(prompt)
+	req := httptest.NewRequest("POST", "/api/prompts", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+
+	var accepted map[string]string
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &accepted))
+	return accepted["id"], accepted["poster_token"]
+}
+
+// respondToPrompt answers a prompt as the browser holding the cookies would.
+func respondToPrompt(router *mux.Router, id string, response string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/api/prompts/"+id, strings.NewReader(response))
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// fetchResult returns the decoded result of an asynchronous prompt.
+func fetchResult(t *testing.T, router *mux.Router, id string, token string) map[string]interface{} {
+	req := httptest.NewRequest("GET", "/api/prompts/"+id+"/result", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var result map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	return result
+}
+
+func TestPromptHandler_StructuredInput(t *testing.T) {
+	router := setupTestRouter()
+	pubKeyB64, cookies := newTestIdentity(t)
+
+	id, token := postAsyncPrompt(t, router, map[string]interface{}{
+		"public_key": pubKeyB64,
+		"message":    "Which environment?",
+		"input": map[string]interface{}{
+			"type":    "multi_choice",
+			"options": []string{"staging", "production"},
+		},
+	})
+
+	w := respondToPrompt(router, id, `["qa"]`, cookies)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	w = respondToPrompt(router, id, `["staging", "production"]`, cookies)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	result := fetchResult(t, router, id, token)
+	assert.Equal(t, "answered", result["status"])
+	assert.Equal(t, []interface{}{"staging", "production"}, result["response"])
+}
+
+func TestPromptHandler_Post_InvalidInput(t *testing.T) {
+	router := setupTestRouter()
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"public_key": testPublicKey,
+		"message":    "Pick one",
+		"input":      map[string]interface{}{"type": "single_choice"},
+	})
+	req := httptest.NewRequest("POST", "/api/prompts", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "needs options")
+}
+
+func TestPromptHandler_MultiRecipientQuorum(t *testing.T) {
+	router := setupTestRouter()
+	alice, aliceCookies := newTestIdentity(t)
+	bob, bobCookies := newTestIdentity(t)
+	carol, _ := newTestIdentity(t)
+	_, strangerCookies := newTestIdentity(t)
+
+	id, token := postAsyncPrompt(t, router, map[string]interface{}{
+		"recipients": []string{alice, bob, carol},
+		"policy":     map[string]interface{}{"mode": "quorum", "quorum": 2},
+		"message":    "Release 1.2?",
+		"input":      map[string]interface{}{"type": "confirm"},
+	})
+
+	w := respondToPrompt(router, id, "true", strangerCookies)
+	assert.NotEqual(t, http.StatusOK, w.Code)
+
+	w = respondToPrompt(router, id, "true", aliceCookies)
+	require.Equal(t, http.StatusOK, w.Code)
+	w = respondToPrompt(router, id, "true", aliceCookies)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, "pending", fetchResult(t, router, id, token)["status"])
+
+	w = respondToPrompt(router, id, "true", bobCookies)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	result := fetchResult(t, router, id, token)
+	assert.Equal(t, "answered", result["status"])
+	response := result["response"].(map[string]interface{})
+	assert.Equal(t, "approved", response["outcome"])
+	answers := response["answers"].([]interface{})
+	require.Len(t, answers, 2)
+	assert.Equal(t, alice, answers[0].(map[string]interface{})["key"])
+	assert.Equal(t, bob, answers[1].(map[string]interface{})["key"])
+	assert.Equal(t, true, answers[1].(map[string]interface{})["response"])
+}
+
+func TestPromptHandler_Post_InvalidPolicy(t *testing.T) {
+	router := setupTestRouter()
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"recipients": []string{testPublicKey, otherPublicKey},
+		"policy":     map[string]interface{}{"mode": "quorum", "quorum": 3},
+		"message":    "Release?",
+	})
+	req := httptest.NewRequest("POST", "/api/prompts", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "quorum must be between 1 and 2")
+}
+
+func TestPromptHandler_Post_InvalidRecipients(t *testing.T) {
+	router := setupTestRouter()
+
+	tooMany := make([]string, testConfig().MaxRecipients+1)
+	for i := range tooMany {
+		key := make([]byte, ed25519.PublicKeySize)
+		key[0] = byte(i)
+		tooMany[i] = base64.StdEncoding.EncodeToString(key)
+	}
+	for name, test := range map[string]struct {
+		recipients []string
+		code       string
+	}{
+		"too many recipients": {tooMany, "too_many_recipients"},
+		"short key":           {[]string{testPublicKey, "AAAA"}, "invalid_public_key"},
+		"not base64":          {[]string{"not a key"}, "invalid_public_key"},
+	} {
+		body, _ := json.Marshal(map[string]interface{}{"recipients": test.recipients, "message": "Everyone?", "async": true})
+		req := httptest.NewRequest("POST", "/api/prompts", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code, name)
+		assert.Contains(t, w.Body.String(), test.code, name)
+	}
+}
+
+func TestSenderPolicyHandler(t *testing.T) {
+	router := setupTestRouter()
+	recipient, cookies := newTestIdentity(t)
+	friend, friendPriv, _ := newTestSigner(t)
+	stranger, strangerPriv, _ := newTestSigner(t)
+	path := "/api/policy/" + utils.HashPublicKey(recipient)
+
+	request := func(method string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	post := func(sender *utils.Sender) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]interface{}{
+			"public_key": recipient,
+			"message":    "Hello",
+			"async":      true,
+			"sender":     sender,
+		})
+		req := httptest.NewRequest("POST", "/api/prompts", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Keys start out open
+	w := request("GET", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"mode":"open"}`, w.Body.String())
+	assert.Equal(t, http.StatusAccepted, post(nil).Code)
+
+	w = request("PUT", `{"mode":"allowlist","senders":["`+friend+`"]}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = request("GET", "")
+	assert.JSONEq(t, `{"mode":"allowlist","senders":["`+friend+`"]}`, w.Body.String())
+
+	assert.Equal(t, http.StatusAccepted, post(signPrompt(friend, friendPriv, []string{recipient}, "Hello")).Code)
+	for _, sender := range []*utils.Sender{nil, signPrompt(stranger, strangerPriv, []string{recipient}, "Hello")} {
+		w = post(sender)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assert.Contains(t, w.Body.String(), `"code":"sender_rejected"`)
+	}
+
+	w = request("PUT", `{"mode":"blocklist","senders":["`+stranger+`"]}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusAccepted, post(nil).Code)
+	assert.Equal(t, http.StatusForbidden, post(signPrompt(stranger, strangerPriv, []string{recipient}, "Hello")).Code)
+
+	// Rejected prompts never reach the inbox
+	req := httptest.NewRequest("GET", "/api/prompts/"+utils.HashPublicKey(recipient), nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var prompts []map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &prompts))
+	assert.Len(t, prompts, 3)
+	for _, prompt := range prompts {
+		assert.NotEqual(t, stranger, prompt["sender_key"])
+	}
+}
+
+// signPrompt returns the sender block of a prompt signed with priv.
+func signPrompt(publicKey string, priv ed25519.PrivateKey, recipients []string, message string) *utils.Sender {
+	timestamp := time.Now().Unix()
+	payload := utils.SenderPayload(timestamp, recipients, message)
+	return &utils.Sender{
+		PublicKey: publicKey,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(priv, payload)),
+		Timestamp: timestamp,
+	}
+}
+
+func TestPromptHandler_SignedSender(t *testing.T) {
+	router := setupTestRouter()
+	recipient, cookies := newTestIdentity(t)
+	senderKey, senderPriv, _ := newTestSigner(t)
+	keyHash := utils.HashPublicKey(recipient)
+
+	sign := func(message string) *utils.Sender {
+		return signPrompt(senderKey, senderPriv, []string{recipient}, message)
+	}
+
+	// Signed in the body
+	postAsyncPrompt(t, router, map[string]interface{}{
+		"public_key": recipient,
+		"message":    "From the body",
+		"sender":     sign("From the body"),
+	})
+
+	// Signed in headers
+	sender := sign("From the headers")
+	body, _ := json.Marshal(map[string]interface{}{"public_key": recipient, "message": "From the headers", "async": true})
+	req := httptest.NewRequest("POST", "/api/prompts", bytes.NewReader(body))
+	req.Header.Set("X-Sender-Key", sender.PublicKey)
+	req.Header.Set("X-Sender-Signature", sender.Signature)
+	req.Header.Set("X-Sender-Timestamp", strconv.FormatInt(sender.Timestamp, 10))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+
+	postAsyncPrompt(t, router, map[string]interface{}{"public_key": recipient, "message": "Anonymous"})
+
+	// A signature over another message is rejected
+	body, _ = json.Marshal(map[string]interface{}{
+		"public_key": recipient,
+		"message":    "Forged",
+		"sender":     sign("Something else"),
+	})
+	req = httptest.NewRequest("POST", "/api/prompts", bytes.NewReader(body))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), `"code":"sender_signature_invalid"`)
+
+	req = httptest.NewRequest("GET", "/api/prompts/"+keyHash, nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var prompts []map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &prompts))
+	require.Len(t, prompts, 3)
+	for _, prompt := range prompts {
+		if prompt["message"] == "Anonymous" {
+			assert.Nil(t, prompt["sender_key"])
+			assert.Nil(t, prompt["sender_hash"])
+			continue
+		}
+		assert.Equal(t, senderKey, prompt["sender_key"])
+		assert.Equal(t, utils.HashPublicKey(senderKey), prompt["sender_hash"])
+	}
+}
+
+func TestPromptHandler_SignedReceipt(t *testing.T) {
+	router := setupTestRouter()
+	pubKeyB64, priv, cookies := newTestSigner(t)
+
+	message := "Approve the deploy?"
+	id, token := postAsyncPrompt(t, router, map[string]interface{}{
+		"public_key": pubKeyB64,
+		"message":    message,
+	})
+
+	receipt := &utils.Receipt{
+		PromptId:    id,
+		MessageHash: utils.HashMessage(message),
+		Response:    "approved",
+		Timestamp:   time.Now().Unix(),
+	}
+	sign := func(receipt *utils.Receipt) string {
+		return base64.StdEncoding.EncodeToString(ed25519.Sign(priv, receipt.Payload()))
+	}
+	respond := func(response string, signature string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/prompts/"+id, strings.NewReader(response))
+		req.Header.Set("X-Receipt-Signature", signature)
+		req.Header.Set("X-Receipt-Timestamp", strconv.FormatInt(receipt.Timestamp, 10))
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// A signature over a different response is rejected
+	w := respond("rejected", sign(receipt))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = respond("approved", sign(receipt))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	result := fetchResult(t, router, id, token)
+	data, err := json.Marshal(result["receipt"])
+	require.NoError(t, err)
+	var returned utils.Receipt
+	require.NoError(t, json.Unmarshal(data, &returned))
+	assert.Equal(t, pubKeyB64, returned.PublicKey)
+	assert.Equal(t, id, returned.PromptId)
+	assert.NoError(t, utils.VerifyReceipt(&returned, message))
+}
+
+func TestPromptHandler_SignedFormReceipt(t *testing.T) {
+	router := setupTestRouter()
+	pubKeyB64, priv, cookies := newTestSigner(t)
+
+	message := "Where to?"
+	id, token := postAsyncPrompt(t, router, map[string]interface{}{
+		"public_key": pubKeyB64,
+		"message":    message,
+		"input": map[string]interface{}{
+			"type":   "form",
+			"schema": json.RawMessage(`{"type":"object","properties":{"region":{"type":"string"},"note":{"type":"string"}}}`),
+		},
+	})
+	respond := func(response string) *httptest.ResponseRecorder {
+		receipt := &utils.Receipt{PromptId: id, MessageHash: utils.HashMessage(message), Response: response, Timestamp: time.Now().Unix()}
+		req := httptest.NewRequest("POST", "/api/prompts/"+id, strings.NewReader(response))
+		req.Header.Set("X-Receipt-Signature", base64.StdEncoding.EncodeToString(ed25519.Sign(priv, receipt.Payload())))
+		req.Header.Set("X-Receipt-Timestamp", strconv.FormatInt(receipt.Timestamp, 10))
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// The receipt would not cover the answer as the poster gets it
+	w := respond(`{"region": "eu", "note": "a<b"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "canonical form")
+
+	canonical := `{"note":"a<b","region":"eu"}`
+	require.Equal(t, http.StatusOK, respond(canonical).Code)
+	result := fetchResult(t, router, id, token)
+	receipt := result["receipt"].(map[string]interface{})
+	assert.Equal(t, canonical, receipt["response"])
+	response, err := json.Marshal(result["response"])
+	require.NoError(t, err)
+	assert.JSONEq(t, canonical, string(response))
+}
+
+func TestPromptHandler_EncryptedPrompt(t *testing.T) {
+	cfg := testConfig()
+	cfg.StorageBackend = "file"
+	cfg.StoragePath = filepath.Join(t.TempDir(), "prompts.journal")
+	router := InitializeRouter(cfg, metrics.New(), nil)
+	pubKeyB64, priv, cookies := newTestSigner(t)
+
+	const secret = "the vault combination is 31-4-15"
+	const answer = "rotated it to 9-26-53"
+
+	// The poster seals the message and keeps the private half of the reply key
+	sealed, err := utils.SealForKey(pubKeyB64, secret)
+	require.NoError(t, err)
+	replyKey, replyPublic, err := utils.GenerateReplyKey()
+	require.NoError(t, err)
+	id, token := postAsyncPrompt(t, router, map[string]interface{}{
+		"public_key": pubKeyB64,
+		"message":    sealed,
+		"encrypted":  true,
+		"reply_key":  replyPublic,
+	})
+
+	// The recipient gets the sealed message and opens it with its own key
+	hashedKey := sha256.Sum256([]byte(pubKeyB64))
+	req := httptest.NewRequest("GET", "/api/prompts/"+hex.EncodeToString(hashedKey[:]), nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var prompts []map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &prompts))
+	require.Len(t, prompts, 1)
+	assert.Equal(t, true, prompts[0]["encrypted"])
+	assert.Equal(t, replyPublic, prompts[0]["reply_key"])
+	xPriv, err := utils.Ed25519PrivateKeyToX25519(priv)
+	require.NoError(t, err)
+	message, err := utils.Open(xPriv, prompts[0]["message"].(string))
+	require.NoError(t, err)
+	assert.Equal(t, secret, string(message))
+
+	// Plaintext responses are refused
+	w = respondToPrompt(router, id, answer, cookies)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	replyPublicKey, err := utils.ParseReplyKey(prompts[0]["reply_key"].(string))
+	require.NoError(t, err)
+	sealedAnswer, err := utils.Seal(replyPublicKey, []byte(answer))
+	require.NoError(t, err)
+	w = respondToPrompt(router, id, sealedAnswer, cookies)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	result := fetchResult(t, router, id, token)
+	response, err := utils.OpenReply(replyKey, result["response"].(string))
+	require.NoError(t, err)
+	assert.Equal(t, answer, response)
+
+	// Nothing the server kept contains either plaintext
+	journal, err := os.ReadFile(cfg.StoragePath)
+	require.NoError(t, err)
+	assert.NotContains(t, string(journal), secret)
+	assert.NotContains(t, string(journal), answer)
+	assert.Contains(t, string(journal), sealedAnswer)
+}
+
+func TestPromptHandler_Post_EncryptedInvalid(t *testing.T) {
+	router := setupTestRouter()
+	pubKeyB64, _ := newTestIdentity(t)
+	sealed, err := utils.SealForKey(pubKeyB64, "secret")
+	require.NoError(t, err)
+	_, replyPublic, err := utils.GenerateReplyKey()
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		prompt map[string]interface{}
+	}{
+		{"plaintext message", map[string]interface{}{"public_key": pubKeyB64, "message": "secret", "encrypted": true, "reply_key": replyPublic}},
+		{"missing reply key", map[string]interface{}{"public_key": pubKeyB64, "message": sealed, "encrypted": true}},
+		{"structured input", map[string]interface{}{"public_key": pubKeyB64, "message": sealed, "encrypted": true, "reply_key": replyPublic, "input": map[string]string{"type": "confirm"}}},
+		{"several recipients", map[string]interface{}{"recipients": []string{pubKeyB64, testPublicKey}, "message": sealed, "encrypted": true, "reply_key": replyPublic}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(tt.prompt)
+			req := httptest.NewRequest("POST", "/api/prompts", bytes.NewReader(body))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+		})
+	}
+}
+
+func TestPromptHandler_Post_CallbackURL(t *testing.T) {
+	type delivery struct {
+		signature string
+		body      []byte
+	}
+	deliveries := make(chan delivery, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		deliveries <- delivery{r.Header.Get(utils.WebhookSignatureHeader), body}
+	}))
+	defer receiver.Close()
+
+	// The receiver is on loopback
+	cfg := testConfig()
+	cfg.WebhookAllowPrivate = true
+	router := InitializeRouter(cfg, metrics.New(), nil)
+	pubKeyB64, cookies := newTestIdentity(t)
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"public_key":   pubKeyB64,
+		"message":      "Ship it?",
+		"callback_url": receiver.URL + "/hooks/prompt",
+	})
+	req := httptest.NewRequest("POST", "/api/prompts", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	// The poster is not held
+	require.Equal(t, http.StatusAccepted, w.Code)
+	var accepted map[string]string
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &accepted))
+	secret := accepted["webhook_secret"]
+	require.NotEmpty(t, secret)
+
+	w = respondToPrompt(router, accepted["id"], "shipped", cookies)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	select {
+	case d := <-deliveries:
+		assert.NoError(t, utils.VerifyWebhook(secret, d.signature, d.body, time.Minute))
+		var result map[string]interface{}
+		require.NoError(t, json.Unmarshal(d.body, &result))
+		assert.Equal(t, accepted["id"], result["id"])
+		assert.Equal(t, "answered", result["status"])
+		assert.Equal(t, "shipped", result["response"])
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+}
+
+func TestPromptHandler_Post_InvalidCallbackURL(t *testing.T) {
+	router := setupTestRouter()
+
+	for _, callbackURL := range []string{
+		"file:///etc/passwd",
+		"http://localhost:9090/metrics",
+		"http://127.0.0.1/hook",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://[::1]/hook",
+		"http://10.0.0.1/hook",
+	} {
+		body, _ := json.Marshal(map[string]interface{}{
+			"public_key":   testPublicKey,
+			"message":      "Ship it?",
+			"callback_url": callbackURL,
+		})
+		req := httptest.NewRequest("POST", "/api/prompts", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code, callbackURL)
+	}
+}
+
+func TestSSEHandler_LastEventIDReplay(t *testing.T) {
+	router := setupTestRouter()
+	pubKeyB64, cookies := newTestIdentity(t)
+	hashedKey := sha256.Sum256([]byte(pubKeyB64))
+	keyHash := hex.EncodeToString(hashedKey[:])
+
+	// stream connects for a moment and returns everything it received
+	stream := func(lastEventID string, during func()) string {
+		req := httptest.NewRequest("GET", "/api/sse/"+keyHash, nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		ctx, cancel := context.WithCancel(req.Context())
+		w := httptest.NewRecorder()
+		done := make(chan bool)
+		go func() {
+			router.ServeHTTP(w, req.WithContext(ctx))
+			close(done)
+		}()
+		time.Sleep(20 * time.Millisecond)
+		during()
+		cancel()
+		<-done
+		return w.Body.String()
+	}
+
+	first := stream("", func() {
+		postAsyncPrompt(t, router, map[string]interface{}{"public_key": pubKeyB64, "message": "first"})
+	})
+	require.Contains(t, first, `"content":"first"`)
+	var lastEventID string
+	for _, line := range strings.Split(first, "\n") {
+		if id, found := strings.CutPrefix(line, "id: "); found {
+			lastEventID = id
+		}
+	}
+	require.NotEmpty(t, lastEventID)
+
+	// Posted while the browser was offline
+	postAsyncPrompt(t, router, map[string]interface{}{"public_key": pubKeyB64, "message": "second"})
+
+	resumed := stream(lastEventID, func() {})
+	assert.Contains(t, resumed, `"type":"reconnected"`)
+	assert.Contains(t, resumed, `"content":"second"`)
+	assert.NotContains(t, resumed, `"content":"first"`)
+}
+
+// withCookie returns cookies with the named cookie replaced, or removed if
+// value is empty.
+func withCookie(cookies []*http.Cookie, name string, value string) []*http.Cookie {
+	var result []*http.Cookie
+	for _, cookie := range cookies {
+		if cookie.Name != name {
+			result = append(result, cookie)
+		}
+	}
+	if value != "" {
+		result = append(result, &http.Cookie{Name: name, Value: value})
+	}
+	return result
+}
+
+func TestAPIErrors(t *testing.T) {
+	router := setupTestRouter()
+	alice, _, aliceCookies := newTestSigner(t)
+	bob, _ := newTestIdentity(t)
+	hashedKey := sha256.Sum256([]byte(alice))
+	aliceHash := hex.EncodeToString(hashedKey[:])
+
+	pending, token := postAsyncPrompt(t, router, map[string]interface{}{
+		"public_key": alice,
+		"message":    "Deploy?",
+		"input":      map[string]interface{}{"type": "confirm"},
+	})
+	closed, _ := postAsyncPrompt(t, router, map[string]interface{}{
+		"public_key": alice,
+		"message":    "Restart?",
+	})
+	require.Equal(t, http.StatusOK, respondToPrompt(router, closed, "yes", aliceCookies).Code)
+	shared, _ := postAsyncPrompt(t, router, map[string]interface{}{
+		"recipients": []string{alice, bob},
+		"policy":     map[string]interface{}{"mode": "all"},
+		"message":    "Release?",
+	})
+	require.Equal(t, http.StatusOK, respondToPrompt(router, shared, "yes", aliceCookies).Code)
+
+	expiredToken := jwt.NewWithClaims(jwt.SigningMethodHS256, &utils.Claims{
+		KeyHash: aliceHash,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute)),
+		},
+	})
+	expiredToken.Header["kid"] = testTokens.KeyIDs()[0]
+	expired, err := expiredToken.SignedString([]byte(testConfig().CSRFTokenSecret))
+	require.NoError(t, err)
+	wrongSignature := base64.StdEncoding.EncodeToString(make([]byte, ed25519.SignatureSize))
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		tooLarge bool
+		header   map[string]string
+		cookies  []*http.Cookie
+		status   int
+		code     string
+	}{
+		{name: "body too large", method: "POST", path: "/api/prompts", body: "{}", tooLarge: true,
+			status: http.StatusRequestEntityTooLarge, code: "body_too_large"},
+		{name: "invalid body", method: "POST", path: "/api/prompts", body: "{",
+			status: http.StatusBadRequest, code: "invalid_body"},
+		{name: "missing field", method: "POST", path: "/api/prompts", body: `{"public_key":"` + alice + `"}`,
+			status: http.StatusBadRequest, code: "missing_field"},
+		{name: "invalid public key", method: "POST", path: "/api/prompts", body: `{"public_key":"!","message":"hi"}`,
+			status: http.StatusBadRequest, code: "invalid_public_key"},
+		{name: "invalid policy", method: "POST", path: "/api/prompts",
+			body:   `{"recipients":["` + alice + `","` + bob + `"],"policy":{"mode":"quorum","quorum":3},"message":"hi"}`,
+			status: http.StatusBadRequest, code: "invalid_policy"},
+		{name: "invalid input", method: "POST", path: "/api/prompts",
+			body:   `{"public_key":"` + alice + `","message":"hi","input":{"type":"single_choice"}}`,
+			status: http.StatusBadRequest, code: "invalid_input"},
+		{name: "invalid encryption", method: "POST", path: "/api/prompts",
+			body:   `{"public_key":"` + alice + `","message":"hi","encrypted":true}`,
+			status: http.StatusBadRequest, code: "invalid_encryption"},
+		{name: "invalid callback url", method: "POST", path: "/api/prompts",
+			body:   `{"public_key":"` + alice + `","message":"hi","callback_url":"ftp://example.com"}`,
+			status: http.StatusBadRequest, code: "invalid_callback_url"},
+		{name: "invalid timeout", method: "POST", path: "/api/prompts",
+			body:   `{"public_key":"` + alice + `","message":"hi","timeout":-1}`,
+			status: http.StatusBadRequest, code: "invalid_timeout"},
+		{name: "invalid sender", method: "POST", path: "/api/prompts",
+			body:   `{"public_key":"` + alice + `","message":"hi"}`,
+			header: map[string]string{"X-Sender-Key": bob, "X-Sender-Signature": wrongSignature},
+			status: http.StatusBadRequest, code: "invalid_sender"},
+		{name: "sender signature invalid", method: "POST", path: "/api/prompts",
+			body: `{"public_key":"` + alice + `","message":"hi","sender":{"public_key":"` + bob + `","signature":"` + wrongSignature +
+				`","timestamp":` + strconv.FormatInt(time.Now().Unix(), 10) + `}}`,
+			status: http.StatusUnauthorized, code: "sender_signature_invalid"},
+		{name: "missing poster token", method: "GET", path: "/api/prompts/" + pending + "/result",
+			status: http.StatusUnauthorized, code: "missing_poster_token"},
+		{name: "result of unknown prompt", method: "GET", path: "/api/prompts/unknown/result",
+			header: map[string]string{"Authorization": "Bearer " + token},
+			status: http.StatusNotFound, code: "prompt_not_found"},
+		{name: "invalid poster token", method: "GET", path: "/api/prompts/" + pending + "/result",
+			header: map[string]string{"Authorization": "Bearer wrong"},
+			status: http.StatusForbidden, code: "poster_token_invalid"},
+		{name: "invalid wait", method: "GET", path: "/api/prompts/" + pending + "/result?wait=soon",
+			header: map[string]string{"Authorization": "Bearer " + token},
+			status: http.StatusBadRequest, code: "invalid_wait"},
+		{name: "missing key", method: "GET", path: "/api/prompts/" + aliceHash,
+			status: http.StatusUnauthorized, code: "missing_key"},
+		{name: "key mismatch", method: "GET", path: "/api/prompts/" + strings.Repeat("0", 64), cookies: aliceCookies,
+			status: http.StatusForbidden, code: "key_mismatch"},
+		{name: "missing signature", method: "GET", path: "/api/prompts/" + aliceHash,
+			cookies: withCookie(aliceCookies, "CSRFChallenge", ""),
+			status:  http.StatusUnauthorized, code: "missing_signature"},
+		{name: "missing token", method: "GET", path: "/api/prompts/" + aliceHash,
+			cookies: withCookie(aliceCookies, "CSRFToken", ""),
+			status:  http.StatusUnauthorized, code: "missing_token"},
+		{name: "token expired", method: "GET", path: "/api/prompts/" + aliceHash,
+			cookies: withCookie(aliceCookies, "CSRFToken", expired),
+			status:  http.StatusUnauthorized, code: "token_expired"},
+		{name: "token invalid", method: "GET", path: "/api/prompts/" + aliceHash,
+			cookies: withCookie(aliceCookies, "CSRFToken", "not.a.token"),
+			status:  http.StatusUnauthorized, code: "token_invalid"},
+		{name: "signature invalid", method: "GET", path: "/api/prompts/" + aliceHash,
+			cookies: withCookie(aliceCookies, "CSRFChallenge", wrongSignature),
+			status:  http.StatusUnauthorized, code: "signature_invalid"},
+		{name: "signature malformed", method: "GET", path: "/api/prompts/" + aliceHash,
+			cookies: withCookie(aliceCookies, "CSRFChallenge", "not base64"),
+			status:  http.StatusUnauthorized, code: "signature_malformed"},
+		{name: "event stream without key", method: "GET", path: "/api/sse/" + aliceHash,
+			status: http.StatusUnauthorized, code: "missing_key"},
+		{name: "challenge for another key", method: "GET", path: "/api/auth/" + strings.Repeat("0", 64), cookies: aliceCookies,
+			status: http.StatusForbidden, code: "key_mismatch"},
+		{name: "respond body too large", method: "POST", path: "/api/prompts/" + pending, body: "true", tooLarge: true,
+			cookies: aliceCookies, status: http.StatusRequestEntityTooLarge, code: "body_too_large"},
+		{name: "respond to unknown prompt", method: "POST", path: "/api/prompts/unknown", body: "true", cookies: aliceCookies,
+			status: http.StatusNotFound, code: "prompt_not_found"},
+		{name: "respond without key", method: "POST", path: "/api/prompts/" + pending, body: "true",
+			status: http.StatusUnauthorized, code: "missing_key"},
+		{name: "invalid receipt", method: "POST", path: "/api/prompts/" + pending, body: "true", cookies: aliceCookies,
+			header: map[string]string{"X-Receipt-Signature": wrongSignature},
+			status: http.StatusBadRequest, code: "invalid_receipt"},
+		{name: "invalid response", method: "POST", path: "/api/prompts/" + pending, body: "maybe", cookies: aliceCookies,
+			status: http.StatusUnprocessableEntity, code: "invalid_response"},
+		{name: "prompt closed", method: "POST", path: "/api/prompts/" + closed, body: "no", cookies: aliceCookies,
+			status: http.StatusConflict, code: "prompt_closed"},
+		{name: "already answered", method: "POST", path: "/api/prompts/" + shared, body: "no", cookies: aliceCookies,
+			status: http.StatusConflict, code: "already_answered"},
+		{name: "sender policy without key", method: "GET", path: "/api/policy/" + aliceHash,
+			status: http.StatusUnauthorized, code: "missing_key"},
+		{name: "invalid sender policy", method: "PUT", path: "/api/policy/" + aliceHash, body: `{"mode":"friends"}`,
+			cookies: aliceCookies, status: http.StatusBadRequest, code: "invalid_sender_policy"},
+		{name: "unknown endpoint", method: "GET", path: "/api/nothing",
+			status: http.StatusNotFound, code: "not_found"},
+		{name: "method not allowed", method: "DELETE", path: "/api/prompts",
+			status: http.StatusMethodNotAllowed, code: "method_not_allowed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.tooLarge {
+				req.ContentLength = 100 * 1024 * 1024
+			}
+			for name, value := range tt.header {
+				req.Header.Set(name, value)
+			}
+			for _, cookie := range tt.cookies {
+				req.AddCookie(cookie)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.status, w.Code, w.Body.String())
+			assert.Equal(t, "application/problem+json", w.Header().Get("Content-Type"))
+			assert.Empty(t, w.Header().Get("Location"), "API routes never redirect")
+
+			var problem map[string]interface{}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &problem))
+			assert.Equal(t, tt.code, problem["code"])
+			assert.Equal(t, float64(tt.status), problem["status"])
+			assert.Equal(t, http.StatusText(tt.status), problem["title"])
+			assert.NotEmpty(t, problem["detail"])
+		})
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	cfg := testConfig()
+	cfg.MetricsToken = "scrape-token"
+	router := InitializeRouter(cfg, metrics.New(), nil)
+	pubKeyB64, _ := newTestIdentity(t)
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"public_key": pubKeyB64,
+		"message":    "Count me",
+		"async":      true,
+	})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/prompts", bytes.NewReader(body)))
+	require.Equal(t, http.StatusAccepted, w.Code)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/sse/"+strings.Repeat("0", 64), nil))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer scrape-token")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	text := w.Body.String()
+	assert.Contains(t, text, "prompt_service_prompts_created_total 1\n")
+	assert.Contains(t, text, "prompt_service_prompts_pending 1\n")
+	assert.Contains(t, text, `prompt_service_http_requests_total{route="/api/prompts",method="POST",code="202"} 1`)
+	assert.Contains(t, text, `prompt_service_auth_failures_total{reason="missing_key"} 1`)
+	assert.Contains(t, text, `prompt_service_rate_limited_total{scope="ip"} 0`)
+}
+
+func TestMetricsEndpoint_DisabledWithoutToken(t *testing.T) {
+	router := setupTestRouter()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestAuditStream(t *testing.T) {
+	var audit bytes.Buffer
+	router := InitializeRouter(testConfig(), metrics.New(), logging.NewAudit(&audit))
+	pubKeyB64, cookies := newTestIdentity(t)
+
+	id, _ := postAsyncPrompt(t, router, map[string]interface{}{
+		"public_key": pubKeyB64,
+		"message":    "The launch code is 0000",
+	})
+	w := respondToPrompt(router, id, "confirmed-secret-answer", cookies)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotEmpty(t, w.Header().Get("X-Request-ID"))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/prompts/"+strings.Repeat("0", 64), nil))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+
+	events := map[string]map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSpace(audit.String()), "\n") {
+		var record map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(line), &record))
+		events[record["audit"].(string)] = record
+	}
+	require.Contains(t, events, "prompt.created")
+	require.Contains(t, events, "prompt.answered")
+	require.Contains(t, events, "auth.succeeded")
+	require.Contains(t, events, "auth.failed")
+	assert.Equal(t, id, events["prompt.created"]["prompt_id"])
+	assert.Equal(t, id, events["prompt.answered"]["prompt_id"])
+	assert.NotEmpty(t, events["prompt.answered"]["request_id"])
+	assert.Equal(t, "missing_key", events["auth.failed"]["reason"])
+
+	// Nothing sensitive ends up in the audit stream
+	assert.NotContains(t, audit.String(), "launch code")
+	assert.NotContains(t, audit.String(), "confirmed-secret-answer")
+	assert.NotContains(t, audit.String(), pubKeyB64)
+	for _, cookie := range cookies {
+		assert.NotContains(t, audit.String(), cookie.Value)
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	app := NewApp(testConfig(), metrics.New(), nil)
+	server := httptest.NewServer(app.Router)
+	defer server.Close()
+
+	// Connections are not reused, so none are left for Shutdown to wait on
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	for _, path := range []string{"/healthz", "/readyz"} {
+		res, err := client.Get(server.URL + path)
+		require.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode, path)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, app.Shutdown(ctx, server.Config))
+
+	// Readiness fails and new prompts are refused, while liveness holds
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	body := `{"public_key":"` + base64.StdEncoding.EncodeToString(make([]byte, 32)) + `","message":"Continue?"}`
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, httptest.NewRequest("POST", "/api/prompts", strings.NewReader(body)))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "5", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), `"code":"service_restarting"`)
+}
+
+func TestCSRFKeyRotation(t *testing.T) {
+	var audit bytes.Buffer
+	cfg := config.Default()
+	cfg.CSRFKeyFile = filepath.Join(t.TempDir(), "csrf-keys.json")
+	app := NewApp(cfg, metrics.New(), logging.NewAudit(&audit))
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	pubKeyB64 := base64.StdEncoding.EncodeToString(pub)
+	hashedKey := sha256.Sum256([]byte(pubKeyB64))
+	keyHash := hex.EncodeToString(hashedKey[:])
+	login := func() []*http.Cookie {
+		req := httptest.NewRequest("GET", "/api/auth/"+keyHash, nil)
+		req.AddCookie(&http.Cookie{Name: "publicKey", Value: pubKeyB64})
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		token := w.Body.String()
+		return []*http.Cookie{
+			{Name: "publicKey", Value: pubKeyB64},
+			{Name: "CSRFToken", Value: token},
+			{Name: "CSRFChallenge", Value: base64.StdEncoding.EncodeToString(ed25519.Sign(priv, []byte(token)))},
+		}
+	}
+	listPrompts := func(cookies []*http.Cookie) int {
+		req := httptest.NewRequest("GET", "/api/prompts/"+keyHash, nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	before := login()
+	require.NoError(t, app.RotateKeys())
+
+	// Browsers that logged in before the rotation stay logged in
+	assert.Equal(t, http.StatusOK, listPrompts(before))
+	assert.Equal(t, http.StatusOK, listPrompts(login()))
+	assert.Contains(t, audit.String(), `"audit":"auth.key_rotated"`)
+
+	// The keys outlive a restart
+	restarted := NewApp(cfg, metrics.New(), nil)
+	req := httptest.NewRequest("GET", "/api/prompts/"+keyHash, nil)
+	for _, cookie := range before {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	restarted.Router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
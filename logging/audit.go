@@ -0,0 +1,56 @@
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+// Audit events. Each is one JSON line with "audit" set to the event.
+const (
+	AuditPromptCreated   = "prompt.created"
+	AuditPromptAnswered  = "prompt.answered"
+	AuditPromptExpired   = "prompt.expired"
+	AuditPromptCancelled = "prompt.cancelled"
+	AuditAnswerRejected  = "prompt.answer_rejected"
+	AuditPromptRejected  = "prompt.rejected"
+	AuditAuthSucceeded   = "auth.succeeded"
+	AuditAuthFailed      = "auth.failed"
+	AuditKeyRotated      = "auth.key_rotated"
+)
+
+// Audit is the stream of prompt lifecycle events and authentication
+// decisions. It is separate from the application log so it can be kept
+// longer or shipped elsewhere. Records only hold ids, key hashes and
+// outcomes: never messages, responses, tokens or signatures. A nil *Audit
+// records nothing.
+type Audit struct {
+	logger *slog.Logger
+}
+
+// NewAudit returns an audit stream that writes JSON lines to w.
+func NewAudit(w io.Writer) *Audit {
+	return &Audit{logger: slog.New(slog.NewJSONHandler(w, nil))}
+}
+
+// Record writes an audit event with the request id of ctx and attrs, which
+// are key and value pairs as for slog.
+func (a *Audit) Record(ctx context.Context, event string, attrs ...any) {
+	if a == nil {
+		return
+	}
+	attrs = append([]any{"audit", event}, attrs...)
+	if id := RequestID(ctx); id != "" {
+		attrs = append(attrs, "request_id", id)
+	}
+	a.logger.InfoContext(ctx, "audit", attrs...)
+}
+
+type auditKey struct{}
+
+// AuditFrom returns the audit stream the middleware attached to r, or nil.
+func AuditFrom(r *http.Request) *Audit {
+	audit, _ := r.Context().Value(auditKey{}).(*Audit)
+	return audit
+}
@@ -0,0 +1,85 @@
+// Package logging sets up structured JSON logs, request ids and the audit
+// stream.
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// RequestIDHeader carries the request id in requests and responses.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the ids accepted from clients.
+const maxRequestIDLength = 128
+
+// NewLogger returns a logger that writes JSON lines at level and above.
+func NewLogger(w io.Writer, level slog.Level) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level}))
+}
+
+// ParseLevel parses debug, info, warn or error. Anything else is info.
+func ParseLevel(name string) slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return slog.LevelInfo
+	}
+	return level
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context that carries id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request id carried by ctx, or "".
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// FromContext returns the default logger with the request id of ctx, if
+// there is one.
+func FromContext(ctx context.Context) *slog.Logger {
+	if id := RequestID(ctx); id != "" {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
+
+// Middleware gives every request an id, echoed in the X-Request-ID
+// response header. An id sent by the client or a proxy is kept if it looks
+// sane, so requests can be followed across services. The audit stream is
+// attached to the request for the handlers.
+func Middleware(audit *Audit) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(RequestIDHeader)
+			if !validRequestID(id) {
+				id = uuid.New().String()
+			}
+			w.Header().Set(RequestIDHeader, id)
+			ctx := WithRequestID(r.Context(), id)
+			ctx = context.WithValue(ctx, auditKey{}, audit)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// validRequestID accepts short ids made of printable ASCII without spaces,
+// so they can't forge log lines or headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	return !strings.ContainsFunc(id, func(r rune) bool {
+		return r <= ' ' || r > '~'
+	})
+}
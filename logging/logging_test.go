@@ -0,0 +1,67 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMiddleware(t *testing.T) {
+	audit := NewAudit(&bytes.Buffer{})
+	var seen string
+	handler := Middleware(audit)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestID(r.Context())
+		assert.Equal(t, audit, AuditFrom(r))
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.NotEmpty(t, seen)
+	assert.Equal(t, seen, w.Header().Get(RequestIDHeader))
+
+	// Ids from upstream are kept
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(RequestIDHeader, "upstream-42")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, "upstream-42", seen)
+	assert.Equal(t, "upstream-42", w.Header().Get(RequestIDHeader))
+
+	// Unless they could forge log lines
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(RequestIDHeader, "bad id\n")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.NotEqual(t, "bad id\n", seen)
+	assert.Equal(t, seen, w.Header().Get(RequestIDHeader))
+}
+
+func TestAuditRecord(t *testing.T) {
+	var out bytes.Buffer
+	audit := NewAudit(&out)
+	audit.Record(WithRequestID(context.Background(), "req-1"), AuditPromptCreated, "prompt_id", "p-1")
+
+	var record map[string]interface{}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &record))
+	assert.Equal(t, AuditPromptCreated, record["audit"])
+	assert.Equal(t, "p-1", record["prompt_id"])
+	assert.Equal(t, "req-1", record["request_id"])
+
+	// A nil stream records nothing
+	var none *Audit
+	none.Record(context.Background(), AuditPromptCreated)
+}
+
+func TestParseLevel(t *testing.T) {
+	assert.Equal(t, slog.LevelDebug, ParseLevel("debug"))
+	assert.Equal(t, slog.LevelWarn, ParseLevel("WARN"))
+	assert.Equal(t, slog.LevelInfo, ParseLevel(""))
+	assert.Equal(t, slog.LevelInfo, ParseLevel("loud"))
+}
@@ -1,12 +1,24 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"embed"
-	"log"
+	"errors"
+	"flag"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"prompt-service-server/config"
 	"prompt-service-server/core"
 	"prompt-service-server/handlers"
+	"prompt-service-server/logging"
+	"prompt-service-server/metrics"
+	"prompt-service-server/utils"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -15,50 +27,275 @@ import (
 //go:embed favicon.ico
 var staticFiles embed.FS
 
-func InitializeRouter(cfg *config.Config) *mux.Router {
-	promptStore := core.NewPromptStore()
+// App is the service: its router and what has to be shut down with it.
+type App struct {
+	Router   *mux.Router
+	store    *core.PromptStore
+	prompts  *handlers.PromptHandler
+	webhooks *core.Webhooks
+	tokens   *utils.TokenIssuer
+	audit    *logging.Audit
+}
+
+// InitializeRouter returns the router of a new App.
+func InitializeRouter(cfg *config.Config, m *metrics.Metrics, audit *logging.Audit) *mux.Router {
+	return NewApp(cfg, m, audit).Router
+}
+
+func NewApp(cfg *config.Config, m *metrics.Metrics, audit *logging.Audit) *App {
+	storage, err := core.OpenStorage(cfg.StorageBackend, cfg.StoragePath)
+	if err != nil {
+		slog.Error("Failed to open storage", "error", err)
+		os.Exit(1)
+	}
+	webhooks := core.NewWebhooks(core.WebhookOptions{
+		MaxAttempts:    cfg.WebhookMaxAttempts,
+		DeadLetterPath: cfg.WebhookDeadLetterPath,
+		AllowPrivate:   cfg.WebhookAllowPrivate,
+	})
+	promptStore := core.NewPromptStoreWithOptions(core.StoreOptions{
+		Storage:         storage,
+		ResultRetention: time.Duration(cfg.ResultRetentionSeconds) * time.Second,
+		MaxPending:      cfg.MaxPendingPerRecipient,
+		Metrics:         m,
+		Audit:           audit,
+		Webhooks:        webhooks,
+	})
+
+	tokens, err := utils.OpenTokenIssuer(cfg)
+	if err != nil {
+		slog.Error("Failed to open CSRF signing keys", "error", err)
+		os.Exit(1)
+	}
+	if cfg.CSRFTokenSecret == "" && cfg.CSRFKeyFile == "" {
+		slog.Warn("CSRF signing key is generated for this run only; set CSRF_KEY_FILE to keep it across restarts")
+	}
 
 	// Initialize handlers
 	indexHandler := handlers.NewIndexHandler(staticFiles)
 	keyHandler := handlers.NewKeyHandler(staticFiles)
-	authHandler := handlers.NewAuthHandler()
-	promptHandler := handlers.NewPromptHandler(promptStore)
-	sseHandler := handlers.NewSSEHandler(promptStore)
+	authHandler := handlers.NewAuthHandler(tokens)
+	promptHandler := handlers.NewPromptHandler(cfg, promptStore, tokens)
+	sseHandler := handlers.NewSSEHandler(promptStore, tokens)
+	senderPolicyHandler := handlers.NewSenderPolicyHandler(cfg, promptStore, tokens)
+	healthHandler := handlers.NewHealthHandler(func() bool { return !promptHandler.Draining() })
 	corsMiddleware := handlers.NewCORSMiddleware(cfg)
 
+	limits := promptHandler.RateLimits()
+	for scope, limiter := range map[string]*utils.RateLimiter{
+		"ip":        limits.IP,
+		"sender":    limits.Sender,
+		"recipient": limits.Recipient,
+	} {
+		m.Registry.NewCounterFunc("prompt_service_rate_limited_total", "Prompts refused by a rate limit, by scope.",
+			func() float64 { return float64(limiter.Rejected()) }, "scope", scope)
+	}
+
 	// Create router
 	r := mux.NewRouter()
+	r.NotFoundHandler = http.HandlerFunc(handlers.NotFound)
+	r.MethodNotAllowedHandler = http.HandlerFunc(handlers.MethodNotAllowed)
 
-	// Apply CORS middleware to all routes
+	// Give every routed request an id and count it, then apply CORS
+	// middleware to all routes
+	r.Use(logging.Middleware(audit))
+	r.Use(m.Middleware)
 	r.Use(corsMiddleware.Handler)
 
 	// This will serve files under http://localhost:8000/static/<filename>
 	r.PathPrefix("/static/").Handler(http.FileServer(http.FS(staticFiles)))
 	r.Handle("/favicon.ico", http.FileServer(http.FS(staticFiles)))
 
+	// Probes
+	r.HandleFunc("/healthz", healthHandler.Healthz).Methods("GET")
+	r.HandleFunc("/readyz", healthHandler.Readyz).Methods("GET")
+
 	// API endpoints
 	r.HandleFunc("/", indexHandler.Get).Methods("GET")
 	r.HandleFunc("/key/{id}", keyHandler.Get).Methods("GET")
 	r.HandleFunc("/api/auth/{id}", authHandler.Get).Methods("GET")
 	r.HandleFunc("/api/prompts", promptHandler.Post).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/challenge", promptHandler.Challenge).Methods("GET", "OPTIONS")
 	r.HandleFunc("/api/prompts/{id}", promptHandler.Respond).Methods("POST")
 	r.HandleFunc("/api/prompts/{id}", promptHandler.Get).Methods("GET")
+	r.HandleFunc("/api/prompts/{id}/result", promptHandler.Result).Methods("GET", "OPTIONS")
 	r.HandleFunc("/api/sse/{id}", sseHandler.Get).Methods("GET")
+	r.HandleFunc("/api/policy/{id}", senderPolicyHandler.Get).Methods("GET")
+	r.HandleFunc("/api/policy/{id}", senderPolicyHandler.Put).Methods("PUT")
 
-	return r
+	// Without a separate address, metrics are only served with a token
+	if cfg.MetricsAddr == "" && cfg.MetricsToken != "" {
+		r.Handle("/metrics", m.Registry.Handler(cfg.MetricsToken)).Methods("GET")
+	}
+
+	return &App{Router: r, store: promptStore, prompts: promptHandler, webhooks: webhooks, tokens: tokens, audit: audit}
+}
+
+// RotateKeys makes a new key sign CSRF tokens and challenges. Tokens signed
+// by the previous key keep working until they expire.
+func (a *App) RotateKeys() error {
+	id, err := a.tokens.Rotate()
+	if err != nil {
+		slog.Error("Failed to rotate CSRF signing key", "error", err)
+		return err
+	}
+	slog.Info("Rotated CSRF signing key", "kid", id)
+	a.audit.Record(context.Background(), logging.AuditKeyRotated, "kid", id)
+	return nil
+}
+
+// Shutdown stops the app without cutting anyone off mid-flight. New prompts
+// are refused and readiness fails first. SSE clients are then told to come
+// back after a while, and posters waiting on their connection get their
+// prompt handed over or cancelled. Only then does the listener close.
+// Webhooks that are still being retried are dead lettered last. The whole
+// sequence is bounded by ctx.
+func (a *App) Shutdown(ctx context.Context, servers ...*http.Server) error {
+	a.prompts.Drain()
+	a.store.Shutdown(handlers.RestartRetryAfter)
+	if err := a.prompts.WaitHeld(ctx); err != nil {
+		slog.Warn("Posters still waiting at the end of the grace period", "error", err)
+	}
+	var errs []error
+	for _, server := range servers {
+		errs = append(errs, server.Shutdown(ctx))
+	}
+	err := errors.Join(errs...)
+	if closeErr := a.store.Close(); closeErr != nil {
+		slog.Error("Failed to close storage", "error", closeErr)
+	}
+	// No prompt closes any more, so no webhook is added after this
+	if webhookErr := a.webhooks.Shutdown(ctx); webhookErr != nil {
+		slog.Warn("Webhooks still being delivered at the end of the grace period were dead lettered", "error", webhookErr)
+	}
+	return err
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "ask" {
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		code := runAsk(ctx, os.Args[2:], os.Stdin, os.Stdout, os.Stderr)
+		stop()
+		os.Exit(code)
+	}
+
 	// Load config
-	cfg := config.LoadConfig()
-	r := InitializeRouter(cfg)
+	cfg, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logging.NewLogger(os.Stdout, logging.ParseLevel(cfg.LogLevel)))
+	audit := logging.NewAudit(os.Stdout)
+	if cfg.AuditLogPath != "" {
+		file, err := os.OpenFile(cfg.AuditLogPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			slog.Error("Failed to open audit log", "error", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		audit = logging.NewAudit(file)
+	}
+	m := metrics.New()
+	app := NewApp(cfg, m, audit)
 
-	// Start server
-	port := cfg.Port
-	if port == "" {
-		port = "8080"
+	// Every address is opened before any is served, so a mistake in one
+	// stops the server before it takes requests
+	listeners, err := utils.NewListeners(cfg.SocketFileMode())
+	if err != nil {
+		slog.Error("Failed to take over sockets from systemd", "error", err)
+		os.Exit(1)
+	}
+	var servers []*http.Server
+	var bindings []binding
+	listen := func(server *http.Server, addrs ...string) {
+		servers = append(servers, server)
+		for _, addr := range addrs {
+			opened, err := listeners.Listen(addr)
+			if err != nil {
+				slog.Error("Failed to listen", "addr", addr, "error", err)
+				os.Exit(1)
+			}
+			for _, listener := range opened {
+				bindings = append(bindings, binding{server, listener})
+			}
+		}
 	}
 
-	log.Printf("Server starting on port %s", port)
-	log.Fatal(http.ListenAndServe(":"+port, r))
+	server := &http.Server{Handler: app.Router}
+	if cfg.TLSEnabled() {
+		certificates, err := utils.NewCertificateReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			slog.Error("Failed to load TLS certificate", "error", err)
+			os.Exit(1)
+		}
+		// HTTP/2 is offered along with HTTP/1.1
+		server.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certificates.GetCertificate,
+		}
+	}
+	listen(server, cfg.ListenAddrs()...)
+	if cfg.HTTPRedirectAddr != "" {
+		listen(&http.Server{Handler: handlers.RedirectToHTTPS(cfg.HTTPSPort())}, cfg.HTTPRedirectAddr)
+	}
+	if cfg.MetricsAddr != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("GET /metrics", m.Registry.Handler(cfg.MetricsToken))
+		listen(&http.Server{Handler: metricsMux}, cfg.MetricsAddr)
+	}
+	if unused := listeners.Unused(); len(unused) > 0 {
+		slog.Warn("Sockets passed by systemd are not listened on", "names", unused)
+	}
+
+	stop, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	rotate := make(chan os.Signal, 1)
+	signal.Notify(rotate, syscall.SIGUSR1)
+	go func() {
+		for range rotate {
+			app.RotateKeys()
+		}
+	}()
+	for _, binding := range bindings {
+		go binding.serve()
+	}
+
+	<-stop.Done()
+	grace := time.Duration(cfg.ShutdownGraceSeconds) * time.Second
+	slog.Info("Shutting down", "grace", grace.String())
+	ctx, cancelGrace := context.WithTimeout(context.Background(), grace)
+	defer cancelGrace()
+	if err := app.Shutdown(ctx, servers...); err != nil {
+		slog.Error("Shutdown did not finish in time", "error", err)
+		for _, server := range servers {
+			server.Close()
+		}
+	}
+}
+
+// binding is a server and one of the listeners it serves on.
+type binding struct {
+	server   *http.Server
+	listener net.Listener
+}
+
+// serve runs the server on the listener until it is shut down, over TLS if
+// the server has a TLS config.
+func (b binding) serve() {
+	addr := b.listener.Addr()
+	slog.Info("Server starting", "addr", addr.String(), "network", addr.Network(), "tls", b.server.TLSConfig != nil)
+	var err error
+	if b.server.TLSConfig != nil {
+		err = b.server.ServeTLS(b.listener, "", "")
+	} else {
+		err = b.server.Serve(b.listener)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Server failed", "addr", addr.String(), "error", err)
+		os.Exit(1)
+	}
 }
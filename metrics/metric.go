@@ -0,0 +1,247 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// vec is a family of float values keyed by label values.
+type vec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mutex  sync.Mutex
+	series map[string]*value
+}
+
+type value struct {
+	labels []string
+	value  float64
+}
+
+func newVec(name string, help string, kind string, labels []string) *vec {
+	return &vec{name: name, help: help, kind: kind, labels: labels, series: make(map[string]*value)}
+}
+
+func (v *vec) describe() (string, string, string) {
+	return v.name, v.help, v.kind
+}
+
+// add adds delta to the series of labelValues, which must match the label
+// names the metric was created with.
+func (v *vec) add(delta float64, labelValues []string) {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", v.name, len(v.labels), len(labelValues)))
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	key := seriesKey(labelValues)
+	s, exists := v.series[key]
+	if !exists {
+		s = &value{labels: append([]string(nil), labelValues...)}
+		v.series[key] = s
+	}
+	s.value += delta
+}
+
+func (v *vec) set(x float64, labelValues []string) {
+	v.mutex.Lock()
+	s, exists := v.series[seriesKey(labelValues)]
+	if exists {
+		s.value = x
+	}
+	v.mutex.Unlock()
+	if !exists {
+		v.add(x, labelValues)
+	}
+}
+
+func (v *vec) collect(w io.Writer) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if len(v.labels) == 0 && len(v.series) == 0 {
+		// Metrics without labels are reported from the start
+		fmt.Fprintf(w, "%s 0\n", v.name)
+		return
+	}
+	for _, key := range sortedKeys(v.series) {
+		s := v.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", v.name, labelPairs(v.labels, s.labels), formatValue(s.value))
+	}
+}
+
+// Counter is a value that only goes up, optionally split by labels.
+type Counter struct {
+	*vec
+}
+
+// NewCounter creates and registers a counter with the given label names.
+func (r *Registry) NewCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{newVec(name, help, "counter", labels)}
+	r.register(c)
+	return c
+}
+
+// Inc adds one to the series of labelValues.
+func (c *Counter) Inc(labelValues ...string) {
+	c.add(1, labelValues)
+}
+
+// Add adds delta, which must not be negative, to the series of labelValues.
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic("metrics: counters cannot decrease")
+	}
+	c.add(delta, labelValues)
+}
+
+// Gauge is a value that goes up and down, optionally split by labels.
+type Gauge struct {
+	*vec
+}
+
+// NewGauge creates and registers a gauge with the given label names.
+func (r *Registry) NewGauge(name string, help string, labels ...string) *Gauge {
+	g := &Gauge{newVec(name, help, "gauge", labels)}
+	r.register(g)
+	return g
+}
+
+// Add adds delta to the series of labelValues.
+func (g *Gauge) Add(delta float64, labelValues ...string) {
+	g.add(delta, labelValues)
+}
+
+// Set sets the series of labelValues.
+func (g *Gauge) Set(x float64, labelValues ...string) {
+	g.set(x, labelValues)
+}
+
+// funcMetric is a single series whose value is read when it is written.
+type funcMetric struct {
+	name   string
+	help   string
+	kind   string
+	labels string
+	read   func() float64
+}
+
+func (f *funcMetric) describe() (string, string, string) {
+	return f.name, f.help, f.kind
+}
+
+func (f *funcMetric) collect(w io.Writer) {
+	fmt.Fprintf(w, "%s%s %s\n", f.name, f.labels, formatValue(f.read()))
+}
+
+// NewCounterFunc registers a counter read from read whenever the metrics
+// are written. labels are name and value pairs; several funcs may share a
+// name with different labels.
+func (r *Registry) NewCounterFunc(name string, help string, read func() float64, labels ...string) {
+	r.register(newFuncMetric(name, help, "counter", read, labels))
+}
+
+// NewGaugeFunc is NewCounterFunc for a value that goes up and down.
+func (r *Registry) NewGaugeFunc(name string, help string, read func() float64, labels ...string) {
+	r.register(newFuncMetric(name, help, "gauge", read, labels))
+}
+
+func newFuncMetric(name string, help string, kind string, read func() float64, labels []string) *funcMetric {
+	if len(labels)%2 != 0 {
+		panic(fmt.Sprintf("metrics: %s labels must be name and value pairs", name))
+	}
+	names := make([]string, 0, len(labels)/2)
+	values := make([]string, 0, len(labels)/2)
+	for i := 0; i < len(labels); i += 2 {
+		names = append(names, labels[i])
+		values = append(values, labels[i+1])
+	}
+	return &funcMetric{name: name, help: help, kind: kind, labels: labelPairs(names, values), read: read}
+}
+
+// Histogram counts observations in buckets, optionally split by labels.
+type Histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mutex  sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labels []string
+	counts []uint64 // Per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram creates and registers a histogram with the given upper
+// bucket bounds, in increasing order, and label names.
+func (r *Registry) NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+	r.register(h)
+	return h
+}
+
+func (h *Histogram) describe() (string, string, string) {
+	return h.name, h.help, "histogram"
+}
+
+// Observe records x in the series of labelValues.
+func (h *Histogram) Observe(x float64, labelValues ...string) {
+	if len(labelValues) != len(h.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", h.name, len(h.labels), len(labelValues)))
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	key := seriesKey(labelValues)
+	s, exists := h.series[key]
+	if !exists {
+		s = &histogramSeries{
+			labels: append([]string(nil), labelValues...),
+			counts: make([]uint64, len(h.buckets)),
+		}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if x <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+	s.count++
+	s.sum += x
+}
+
+func (h *Histogram) collect(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	names := append(append([]string(nil), h.labels...), "le")
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelPairs(names, withLabel(s.labels, formatValue(bound))), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelPairs(names, withLabel(s.labels, "+Inf")), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelPairs(h.labels, s.labels), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelPairs(h.labels, s.labels), s.count)
+	}
+}
+
+// withLabel returns a copy of values with value appended.
+func withLabel(values []string, value string) []string {
+	return append(append(make([]string, 0, len(values)+1), values...), value)
+}
@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistryWrite(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounter("requests_total", "Requests.", "code")
+	requests.Inc("200")
+	requests.Add(2, "500")
+	r.NewGauge("connections", "Open connections.").Add(3)
+	r.NewGaugeFunc("queue", "Queued \"jobs\".", func() float64 { return 7 }, "name", `a"b`)
+	latency := r.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1})
+	latency.Observe(0.05)
+	latency.Observe(0.5)
+	latency.Observe(5)
+
+	var out bytes.Buffer
+	r.Write(&out)
+	assert.Equal(t, `# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{code="200"} 1
+requests_total{code="500"} 2
+# HELP connections Open connections.
+# TYPE connections gauge
+connections 3
+# HELP queue Queued "jobs".
+# TYPE queue gauge
+queue{name="a\"b"} 7
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 5.55
+latency_seconds_count 3
+`, out.String())
+}
+
+func TestRegistryFuncsShareFamily(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterFunc("limited_total", "Limited.", func() float64 { return 1 }, "scope", "ip")
+	r.NewCounterFunc("limited_total", "Limited.", func() float64 { return 2 }, "scope", "sender")
+
+	var out bytes.Buffer
+	r.Write(&out)
+	assert.Equal(t, "# HELP limited_total Limited.\n# TYPE limited_total counter\n"+
+		"limited_total{scope=\"ip\"} 1\nlimited_total{scope=\"sender\"} 2\n", out.String())
+}
+
+func TestHandlerToken(t *testing.T) {
+	handler := NewRegistry().Handler("secret")
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, ContentType, w.Header().Get("Content-Type"))
+}
+
+func TestMiddleware(t *testing.T) {
+	m := New()
+	router := mux.NewRouter()
+	router.Use(m.Middleware)
+	router.HandleFunc("/api/prompts/{id}", func(w http.ResponseWriter, r *http.Request) {
+		FromRequest(r).AuthFailed("missing_key")
+		_, flushes := w.(http.Flusher)
+		assert.True(t, flushes)
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/prompts/abc", nil))
+
+	var out bytes.Buffer
+	m.Registry.Write(&out)
+	assert.Contains(t, out.String(), `prompt_service_http_requests_total{route="/api/prompts/{id}",method="GET",code="401"} 1`)
+	assert.Contains(t, out.String(), `prompt_service_http_request_duration_seconds_count{route="/api/prompts/{id}",method="GET"} 1`)
+	assert.Contains(t, out.String(), `prompt_service_auth_failures_total{reason="missing_key"} 1`)
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *Metrics
+	m.PromptCreated()
+	m.PromptClosed("answered", time.Now(), time.Now())
+	m.PendingChanged(1)
+	m.SSEConnectionsChanged(1)
+	m.AuthFailed("missing_key")
+	require.Nil(t, FromRequest(httptest.NewRequest("GET", "/", nil)))
+}
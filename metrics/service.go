@@ -0,0 +1,165 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Metrics are the metrics of the prompt service. The store, the router and
+// the handlers record into it. A nil *Metrics records nothing, so code that
+// is used without metrics, such as in tests, needs no checks.
+type Metrics struct {
+	Registry *Registry
+
+	promptsCreated  *Counter
+	promptsClosed   *Counter
+	pendingPrompts  *Gauge
+	timeToAnswer    *Histogram
+	quotaRejections *Counter
+	sseConnections  *Gauge
+	authFailures    *Counter
+	httpRequests    *Counter
+	httpDuration    *Histogram
+}
+
+// New creates the service metrics in a new registry.
+func New() *Metrics {
+	r := NewRegistry()
+	return &Metrics{
+		Registry: r,
+		promptsCreated: r.NewCounter("prompt_service_prompts_created_total",
+			"Prompts stored."),
+		promptsClosed: r.NewCounter("prompt_service_prompts_closed_total",
+			"Prompts closed, by final status.", "status"),
+		pendingPrompts: r.NewGauge("prompt_service_prompts_pending",
+			"Prompts waiting for an answer."),
+		timeToAnswer: r.NewHistogram("prompt_service_time_to_answer_seconds",
+			"Time from posting a prompt until it was answered.",
+			[]float64{1, 5, 15, 30, 60, 300, 900, 1800, 3600, 14400, 86400}),
+		quotaRejections: r.NewCounter("prompt_service_pending_quota_rejections_total",
+			"Prompts refused because a recipient had too many pending prompts."),
+		sseConnections: r.NewGauge("prompt_service_sse_connections",
+			"Open SSE connections."),
+		authFailures: r.NewCounter("prompt_service_auth_failures_total",
+			"Failed authentications, by problem code.", "reason"),
+		httpRequests: r.NewCounter("prompt_service_http_requests_total",
+			"HTTP requests, by route, method and status code.", "route", "method", "code"),
+		httpDuration: r.NewHistogram("prompt_service_http_request_duration_seconds",
+			"Time to serve HTTP requests, by route and method. Held prompts and SSE streams last as long as they are open.",
+			[]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 60, 300}, "route", "method"),
+	}
+}
+
+// PromptCreated records a stored prompt.
+func (m *Metrics) PromptCreated() {
+	if m == nil {
+		return
+	}
+	m.promptsCreated.Inc()
+}
+
+// PromptClosed records a prompt that ended in status. Answered prompts with
+// a known creation time also record how long the answer took.
+func (m *Metrics) PromptClosed(status string, created time.Time, closed time.Time) {
+	if m == nil {
+		return
+	}
+	m.promptsClosed.Inc(status)
+	if status == "answered" && !created.IsZero() {
+		m.timeToAnswer.Observe(closed.Sub(created).Seconds())
+	}
+}
+
+// PendingChanged adds delta to the pending prompts.
+func (m *Metrics) PendingChanged(delta int) {
+	if m == nil {
+		return
+	}
+	m.pendingPrompts.Add(float64(delta))
+}
+
+// QuotaRejected records a prompt refused for a recipient's pending quota.
+func (m *Metrics) QuotaRejected() {
+	if m == nil {
+		return
+	}
+	m.quotaRejections.Inc()
+}
+
+// SSEConnectionsChanged adds delta to the open SSE connections.
+func (m *Metrics) SSEConnectionsChanged(delta int) {
+	if m == nil {
+		return
+	}
+	m.sseConnections.Add(float64(delta))
+}
+
+// AuthFailed records a failed authentication with the problem code that
+// says why.
+func (m *Metrics) AuthFailed(reason string) {
+	if m == nil {
+		return
+	}
+	m.authFailures.Inc(reason)
+}
+
+type contextKey struct{}
+
+// FromRequest returns the metrics the middleware attached to r, or nil.
+func FromRequest(r *http.Request) *Metrics {
+	m, _ := r.Context().Value(contextKey{}).(*Metrics)
+	return m
+}
+
+// Middleware counts and times requests per route of the mux router, and
+// attaches the metrics to the request for the handlers.
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unmatched"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), contextKey{}, m)))
+		m.httpRequests.Inc(route, r.Method, strconv.Itoa(recorder.status))
+		m.httpDuration.Observe(time.Since(start).Seconds(), route, r.Method)
+	})
+}
+
+// statusRecorder remembers the status code written through it. It passes
+// flushes on for SSE and unwraps for http.ResponseController.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if !s.wroteHeader {
+		s.status = status
+		s.wroteHeader = true
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	s.wroteHeader = true
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
@@ -19,9 +19,14 @@ in {
     };
 
     csrfTokenSecret = mkOption {
-      type = types.str;
+      type = types.nullOr types.str;
+      default = null;
       description = ''
-        CSRF token secret.
+        CSRF token secret. At least 32 random bytes, such as the output
+        of `openssl rand -hex 32`; the service refuses to start otherwise.
+        If null, signing keys are generated and kept in the state
+        directory, and `systemctl reload prompt-service-server` rotates
+        them.
 
         WARNING: Do not hardcode secrets in your configuration!
         Use a secret management tool such as agenix or sops-nix to securely provide this value.
@@ -42,6 +47,106 @@ in {
       '';
     };
 
+    storageBackend = mkOption {
+      type = types.enum [ "memory" "file" ];
+      default = "memory";
+      description = ''
+        Where pending prompts are kept.
+
+        "memory" loses all pending prompts on restart.
+        "file" keeps a journal in the service state directory and restores
+        pending prompts on startup.
+      '';
+    };
+
+    trustProxy = mkOption {
+      type = types.bool;
+      default = false;
+      description = ''
+        Take the client IP used for rate limiting from the last
+        X-Forwarded-For entry. Only enable this behind a reverse proxy
+        that sets the header, or clients can pick their own IP.
+      '';
+    };
+
+    listen = mkOption {
+      type = types.listOf types.str;
+      default = [];
+      example = [ "unix:/run/prompt-service-server/api.sock" "127.0.0.1:9000" ];
+      description = ''
+        Addresses to serve the API on instead of port: host:port,
+        unix:/path or systemd:name. Unix sockets can be created in
+        /run/prompt-service-server.
+      '';
+    };
+
+    socketMode = mkOption {
+      type = types.str;
+      default = "0660";
+      description = ''
+        Permissions of the Unix sockets the service listens on. With the
+        default, a reverse proxy needs to be in the service's group.
+      '';
+    };
+
+    socketActivation = mkOption {
+      type = types.listOf types.str;
+      default = [];
+      example = [ "/run/prompt-service-server.sock" ];
+      description = ''
+        ListenStream= addresses of a socket unit that systemd opens and
+        passes to the service, which then starts on the first connection
+        and does not refuse connections while it restarts. They are served
+        along with listen, or instead of port if listen is empty.
+      '';
+    };
+
+    metricsAddress = mkOption {
+      type = types.str;
+      default = "";
+      example = "127.0.0.1:9090";
+      description = ''
+        Address to serve Prometheus metrics on at /metrics, separate from
+        the public port, such as a private port or unix:/path. Metrics are
+        not served if empty.
+      '';
+    };
+
+    tlsCertFile = mkOption {
+      type = types.nullOr types.str;
+      default = null;
+      example = "/var/lib/acme/example.com/fullchain.pem";
+      description = ''
+        PEM certificate chain to serve HTTPS and HTTP/2 with. It is
+        reloaded when it changes. Requires tlsKeyFile.
+      '';
+    };
+
+    tlsKeyFile = mkOption {
+      type = types.nullOr types.str;
+      default = null;
+      example = "/var/lib/acme/example.com/key.pem";
+      description = "PEM private key of tlsCertFile.";
+    };
+
+    httpRedirectAddress = mkOption {
+      type = types.str;
+      default = "";
+      example = ":80";
+      description = ''
+        Address to redirect plain HTTP to HTTPS from. Requires TLS.
+      '';
+    };
+
+    shutdownGrace = mkOption {
+      type = types.int;
+      default = 10;
+      description = ''
+        Seconds the service has on stop to hand off waiting posters and
+        close connections before it exits anyway.
+      '';
+    };
+
     user = mkOption {
       type = types.str;
       default = "prompt-service";
@@ -56,6 +161,19 @@ in {
   };
 
   config = mkIf cfg.enable {
+    # Sockets passed to the service, named so LISTEN can pick them
+    systemd.sockets.prompt-service-server = mkIf (cfg.socketActivation != []) {
+      description = "Prompt Service Server socket";
+      wantedBy = [ "sockets.target" ];
+      listenStreams = cfg.socketActivation;
+      socketConfig = {
+        FileDescriptorName = "api";
+        SocketUser = cfg.user;
+        SocketGroup = cfg.group;
+        SocketMode = cfg.socketMode;
+      };
+    };
+
     # Create the user and group
     users.users.${cfg.user} = {
       isSystemUser = true;
@@ -71,9 +189,12 @@ in {
       description = "Prompt Service Server";
       wantedBy = [ "multi-user.target" ];
       after = [ "network.target" ];
+      requires = optional (cfg.socketActivation != []) "prompt-service-server.socket";
 
       serviceConfig = {
         ExecStart = "${pkg}/bin/prompt-service-server";
+        # Rotates the CSRF signing key
+        ExecReload = "${pkgs.coreutils}/bin/kill -USR1 $MAINPID";
         User = cfg.user;
         Group = cfg.group;
 
@@ -86,21 +207,46 @@ in {
         ProtectKernelTunables = true;
         ProtectKernelModules = true;
         ProtectControlGroups = true;
-        RestrictAddressFamilies = [ "AF_INET" "AF_INET6" ];
+        RestrictAddressFamilies = [ "AF_UNIX" "AF_INET" "AF_INET6" ];
         RestrictNamespaces = true;
         MemoryDenyWriteExecute = true;
         LockPersonality = true;
 
+        # Ports below 1024, such as 443 and 80, may be bound
+        AmbientCapabilities = [ "CAP_NET_BIND_SERVICE" ];
+        CapabilityBoundingSet = [ "CAP_NET_BIND_SERVICE" ];
+
+        # Writable state for the file storage backend
+        StateDirectory = "prompt-service-server";
+        StateDirectoryMode = "0700";
+        # Unix sockets, whose own mode decides who may connect
+        RuntimeDirectory = "prompt-service-server";
+        RuntimeDirectoryMode = "0755";
+
         # Environment variables
         Environment = [
           "PORT=${toString cfg.port}"
-          "CSRF_TOKEN_SECRET=${cfg.csrfTokenSecret}"
+          "LISTEN=${concatStringsSep "," (cfg.listen ++ optional (cfg.socketActivation != []) "systemd:api")}"
+          "SOCKET_MODE=${cfg.socketMode}"
+          (if cfg.csrfTokenSecret != null
+            then "CSRF_TOKEN_SECRET=${cfg.csrfTokenSecret}"
+            else "CSRF_KEY_FILE=/var/lib/prompt-service-server/csrf-keys.json")
           "ALLOWED_ORIGINS=${cfg.allowedOrigins}"
+          "STORAGE_BACKEND=${cfg.storageBackend}"
+          "TRUST_PROXY=${boolToString cfg.trustProxy}"
+          "METRICS_ADDR=${cfg.metricsAddress}"
+          "SHUTDOWN_GRACE=${toString cfg.shutdownGrace}"
+          "TLS_CERT_FILE=${toString cfg.tlsCertFile}"
+          "TLS_KEY_FILE=${toString cfg.tlsKeyFile}"
+          "HTTP_REDIRECT_ADDR=${cfg.httpRedirectAddress}"
+          "STORAGE_PATH=/var/lib/prompt-service-server/prompts.journal"
+          "WEBHOOK_DEAD_LETTER_PATH=/var/lib/prompt-service-server/webhook-dead-letters.jsonl"
         ];
 
         # Restart on failure
         Restart = "on-failure";
         RestartSec = 5;
+        TimeoutStopSec = cfg.shutdownGrace + 5;
 
         # Limits
         LimitNOFILE = 1024;
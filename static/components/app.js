@@ -2,7 +2,7 @@ import { h } from 'preact';
 import { useState } from 'preact/hooks';
 import { KeyList } from './key-list.js';
 import { ImportForm } from './import-form.js';
-import { useKeyStore } from '../utils/storage-utils.js';
+import { useKeyStore, setCookie } from '../utils/storage-utils.js';
 import { generateKeyPair } from '../utils/key-utils.js';
 import { hashPublicKey } from '../utils/crypto-utils.js';
 export function App() {
@@ -30,7 +30,7 @@ export function App() {
             // Add to storage
             await addKey(keyData);
             // Set cookie with public key
-            document.cookie = `publicKey=${publicKeyB64}; path=/`;
+            setCookie('publicKey', publicKeyB64, 'path=/');
             // Redirect to key page
             window.location.href = `/key/${publicKeyHash}`;
         } catch (error) {
@@ -88,7 +88,7 @@ export function App() {
             setImportText('');
             setPublicKey('');
             // Set cookie with public key
-            document.cookie = `publicKey=${publicKeyB64}; path=/`;
+            setCookie('publicKey', publicKeyB64, 'path=/');
             // Redirect to key page
             window.location.href = `/key/${publicKeyHash}`;
         } catch (error) {
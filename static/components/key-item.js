@@ -1,4 +1,5 @@
 import { h } from 'preact';
+import { setCookie } from '../utils/storage-utils.js';
 export function KeyItem({ keyData, removeKey }) {
     const keyHash = keyData.publicKeyHash;
     return h('div', { className: 'key-item' },
@@ -6,7 +7,7 @@ export function KeyItem({ keyData, removeKey }) {
             h('button', {
                 className: 'key-button outline',
                 onClick: () => {
-                    document.cookie = `publicKey=${keyData.publicKey}; path=/`;
+                    setCookie('publicKey', keyData.publicKey, 'path=/');
                     window.location.href = `/key/${keyHash}`;
                 },
                 key: `link-${keyData.publicKey}`
@@ -0,0 +1,179 @@
+// components/prompt-input.js
+import { h } from 'preact';
+import { useState } from 'preact/hooks';
+
+// Renders the answer form for a prompt. Structured inputs are submitted as
+// JSON, free text is submitted as is.
+export function PromptInput({ prompt, onSubmit }) {
+    const input = prompt.input || { type: 'text' };
+    switch (input.type) {
+        case 'confirm':
+            return h('div', { className: 'response-form' },
+                h('button', { onClick: () => onSubmit('true') }, 'Yes'),
+                h('button', { className: 'secondary', onClick: () => onSubmit('false') }, 'No')
+            );
+        case 'single_choice':
+            return h('div', { className: 'response-form' },
+                input.options.map(option =>
+                    h('button', {
+                        key: option,
+                        className: 'outline',
+                        onClick: () => onSubmit(canonicalJSON(option))
+                    }, option)
+                )
+            );
+        case 'multi_choice':
+            return h(MultiChoiceInput, { options: input.options, onSubmit });
+        case 'number':
+            return h(NumberInput, { input, onSubmit });
+        case 'form':
+            return h(FormInput, { schema: input.schema, onSubmit });
+        default:
+            return h(TextInput, { onSubmit });
+    }
+}
+
+// Encodes a value the way the server stores answers: compact, with object
+// keys sorted by code point, and with U+2028 and U+2029 escaped. Receipts
+// are signed over this form, so it has to match byte for byte.
+function canonicalJSON(value) {
+    if (Array.isArray(value)) {
+        return '[' + value.map(canonicalJSON).join(',') + ']';
+    }
+    if (value !== null && typeof value === 'object') {
+        const codePoints = (s) => Array.from(s, c => c.codePointAt(0));
+        const compare = (a, b) => {
+            const x = codePoints(a), y = codePoints(b);
+            for (let i = 0; i < Math.min(x.length, y.length); i++) {
+                if (x[i] !== y[i]) return x[i] - y[i];
+            }
+            return x.length - y.length;
+        };
+        const keys = Object.keys(value).filter(key => value[key] !== undefined).sort(compare);
+        return '{' + keys.map(key => canonicalJSON(key) + ':' + canonicalJSON(value[key])).join(',') + '}';
+    }
+    return JSON.stringify(value).replace(/\u2028/g, '\\u2028').replace(/\u2029/g, '\\u2029');
+}
+
+function TextInput({ onSubmit }) {
+    const [value, setValue] = useState('');
+    return h('div', { className: 'response-form' },
+        h('input', {
+            type: 'text',
+            placeholder: 'Enter your response',
+            value,
+            onInput: (e) => setValue(e.target.value)
+        }),
+        h('button', {
+            onClick: () => {
+                onSubmit(value);
+                setValue('');
+            }
+        }, 'Submit')
+    );
+}
+
+function MultiChoiceInput({ options, onSubmit }) {
+    const [selected, setSelected] = useState([]);
+    const toggle = (option) => setSelected(prev =>
+        prev.includes(option) ? prev.filter(o => o !== option) : [...prev, option]
+    );
+    return h('div', { className: 'response-form' },
+        h('fieldset', null,
+            options.map(option =>
+                h('label', { key: option },
+                    h('input', {
+                        type: 'checkbox',
+                        checked: selected.includes(option),
+                        onChange: () => toggle(option)
+                    }),
+                    option
+                )
+            )
+        ),
+        h('button', { onClick: () => onSubmit(canonicalJSON(selected)) }, 'Submit')
+    );
+}
+
+function NumberInput({ input, onSubmit }) {
+    const [value, setValue] = useState('');
+    return h('div', { className: 'response-form' },
+        h('input', {
+            type: 'number',
+            min: input.min,
+            max: input.max,
+            step: 'any',
+            value,
+            onInput: (e) => setValue(e.target.value)
+        }),
+        h('button', {
+            disabled: value === '',
+            onClick: () => onSubmit(String(Number(value)))
+        }, 'Submit')
+    );
+}
+
+// Renders one field per top level schema property. Anything the form cannot
+// represent is left to the server side validation.
+function FormInput({ schema, onSubmit }) {
+    const properties = schema.properties || {};
+    const [values, setValues] = useState({});
+    const setField = (name, value) => setValues(prev => {
+        const next = { ...prev };
+        if (value === undefined) {
+            delete next[name];
+        } else {
+            next[name] = value;
+        }
+        return next;
+    });
+
+    const field = (name, property) => {
+        const label = property.title || name;
+        if (Array.isArray(property.enum)) {
+            return h('label', { key: name }, label,
+                h('select', {
+                    value: values[name] === undefined ? '' : JSON.stringify(values[name]),
+                    onChange: (e) => setField(name, e.target.value === '' ? undefined : JSON.parse(e.target.value))
+                },
+                    h('option', { value: '' }, '—'),
+                    property.enum.map(option =>
+                        h('option', { key: JSON.stringify(option), value: JSON.stringify(option) }, String(option))
+                    )
+                )
+            );
+        }
+        if (property.type === 'boolean') {
+            return h('label', { key: name },
+                h('input', {
+                    type: 'checkbox',
+                    checked: values[name] === true,
+                    onChange: (e) => setField(name, e.target.checked)
+                }),
+                label
+            );
+        }
+        if (property.type === 'number' || property.type === 'integer') {
+            return h('label', { key: name }, label,
+                h('input', {
+                    type: 'number',
+                    min: property.minimum,
+                    max: property.maximum,
+                    step: property.type === 'integer' ? 1 : 'any',
+                    onInput: (e) => setField(name, e.target.value === '' ? undefined : Number(e.target.value))
+                })
+            );
+        }
+        return h('label', { key: name }, label,
+            h('input', {
+                type: 'text',
+                onInput: (e) => setField(name, e.target.value)
+            })
+        );
+    };
+
+    return h('div', { className: 'response-form' },
+        Object.entries(properties).map(([name, property]) => field(name, property)),
+        h('button', { onClick: () => onSubmit(canonicalJSON(values)) }, 'Submit')
+    );
+}
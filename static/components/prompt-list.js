@@ -2,8 +2,28 @@
 import { h } from 'preact';
 import { useState } from 'preact/hooks';
 import { signMessage } from '../utils/key-utils.js';
-import { hashPublicKey } from '../utils/crypto-utils.js';
-import { useKeyStore } from '../utils/storage-utils.js';
+import { hashPublicKey, hashMessage, senderFingerprint } from '../utils/crypto-utils.js';
+import { useKeyStore, setCookie } from '../utils/storage-utils.js';
+import { PromptInput } from './prompt-input.js';
+import { SenderPolicy } from './sender-policy.js';
+import { openSealed, seal } from '../utils/seal-utils.js';
+
+// Responses to encrypted prompts are sealed to the poster, so only the
+// responder's own session knows what they were
+const displayedResponse = (prompt, response) =>
+    prompt.encrypted ? '(encrypted)' : response || ' ';
+
+// Open the message of an encrypted prompt for display. The sealed message is
+// kept, since receipts refer to it.
+const decryptPrompt = async (keyData, prompt) => {
+    if (!prompt.encrypted) return prompt;
+    try {
+        const plaintext = await openSealed(keyData, prompt.message);
+        return { ...prompt, plaintext, response: prompt.response && displayedResponse(prompt, prompt.response) };
+    } catch (err) {
+        return { ...prompt, plaintext: '(cannot decrypt this prompt)' };
+    }
+};
 
 export function PromptList() {
     const [activeKey, setActiveKey] = useState(null);
@@ -34,9 +54,9 @@ export function PromptList() {
         try {
             const challenge = await fetchChallenge(activeKey.publicKeyHash);
             const signature = await signMessage(activeKey, challenge);
-            document.cookie = `CSRFChallenge=${signature}; path=/api; max-age=300`;
+            setCookie('CSRFChallenge', signature, 'path=/api; max-age=300');
             if (!sseConnection || sseConnection.readyState === EventSource.CLOSED) {
-                setSSEConnection(setupSSE(activeKey.publicKeyHash));
+                setSSEConnection(setupSSE(activeKey));
             }
         } catch (error) {
             setError('Failed to sign challenge');
@@ -71,26 +91,38 @@ export function PromptList() {
     const [loading] = useKeyStore(initializeKey);
 
     // Setup SSE connection
-    const setupSSE = (publicKeyHash) => {
-        const eventSource = new EventSource(`/api/sse/${publicKeyHash}`, {
+    const setupSSE = (keyData) => {
+        const eventSource = new EventSource(`/api/sse/${keyData.publicKeyHash}`, {
             withCredentials: true
         });
         
+        let restarting = false;
         eventSource.onmessage = function(event) {
             console.log('SSE Message:', event.data);
             const data = JSON.parse(event.data);
             if (data.type === 'connected') {
-                fetchPrompts(publicKeyHash);
+                restarting = false;
+                fetchPrompts(keyData);
+            } else if (data.type === 'reconnected') {
+                // Missed events are replayed right after this one
+                restarting = false;
+                setError('');
+            } else if (data.type === 'server_shutdown') {
+                // The browser reconnects on its own after the retry hint
+                restarting = true;
+                setError('Server is restarting, reconnecting…');
             } else if (data.type === 'challenge_updated') {
                 console.log('Challenge updated, TODO: handle re-authentication');
             } else if (data.type === 'new_prompt') {
-                fetchPrompts(publicKeyHash);
+                fetchPrompts(keyData);
+            } else if (data.type === 'prompt_expired' || data.type === 'prompt_cancelled' || data.type === 'prompt_closed') {
+                setPrompts(prev => prev.filter(prompt => prompt.id !== data.id));
             } else if (data.type === 'prompt_responded') {
                 const promptId = data.id;
                 const response = data.content;
                 setPrompts(prev => 
                     prev.map(prompt => 
-                        prompt.id === promptId ? {...prompt, response: response || ' '} : prompt
+                        prompt.id === promptId ? {...prompt, response: prompt.response || displayedResponse(prompt, response)} : prompt
                     )
                 );
             }
@@ -98,17 +130,19 @@ export function PromptList() {
         
         eventSource.onerror = (error) => {
             console.error('SSE Error:', error);
-            setError('SSE connection error');
+            if (!restarting) {
+                setError('SSE connection error');
+            }
         };
 
         return eventSource;
     };
 
     // Fetch prompts from API
-    const fetchPrompts = async (publicKeyHash) => {
+    const fetchPrompts = async (keyData) => {
         setLoadingPrompts(true);
         try {
-            const response = await fetch(`/api/prompts/${publicKeyHash}`, {
+            const response = await fetch(`/api/prompts/${keyData.publicKeyHash}`, {
                 method: 'GET',
                 credentials: 'same-origin'
             });
@@ -116,7 +150,11 @@ export function PromptList() {
             if (response.ok) {
                 const data = await response.json();
                 if (!Array.isArray(data)) throw new Error('Invalid prompts data');
-                setPrompts(data);
+                // Expired and cancelled prompts are kept for their posters only,
+                // as are prompts closed by other recipients before we answered
+                const visible = data.filter(prompt => prompt.status === 'pending' ||
+                    (prompt.status === 'answered' && (!prompt.policy || prompt.response)));
+                setPrompts(await Promise.all(visible.map(prompt => decryptPrompt(keyData, prompt))));
             } else {
                 setError('Failed to fetch prompts');
             }
@@ -127,17 +165,27 @@ export function PromptList() {
         }
     };
 
-    // Handle response submission
-    const handleResponse = async (promptId, response) => {
+    // Handle response submission. The response is signed together with the
+    // prompt so the poster can verify who answered.
+    const handleResponse = async (prompt, response) => {
+        const promptId = prompt.id;
         try {
+            const timestamp = Math.floor(Date.now() / 1000);
+            // Encrypted prompts are answered with a response sealed to the poster
+            const body = prompt.encrypted ? await seal(prompt.reply_key, response) : response;
+            const messageHash = await hashMessage(prompt.message);
+            const receipt = ['prompt-receipt-v1', promptId, messageHash, timestamp, body].join('\n');
+            const signature = await signMessage(activeKey, receipt);
             const responseHeaders = {
-                'Content-Type': 'plain/text'
+                'Content-Type': 'plain/text',
+                'X-Receipt-Signature': signature,
+                'X-Receipt-Timestamp': String(timestamp)
             };
             
             const res = await fetch(`/api/prompts/${promptId}`, {
                 method: 'POST',
                 headers: responseHeaders,
-                body: response,
+                body,
                 credentials: 'same-origin'
             });
             
@@ -148,6 +196,13 @@ export function PromptList() {
                         prompt.id === promptId ? {...prompt, response: response || ' '} : prompt
                     )
                 );
+            } else if (res.status === 422) {
+                const problem = await res.json();
+                setError('Invalid response: ' + problem.detail);
+            } else if (res.status === 409 || res.status === 404) {
+                // Answered elsewhere first, or gone
+                setPrompts(prev => prev.filter(prompt => prompt.id !== promptId));
+                setError(res.status === 409 ? 'Prompt was already answered' : 'Prompt no longer exists');
             } else {
                 setError('Failed to submit response');
             }
@@ -182,11 +237,13 @@ export function PromptList() {
         h('div', { className: 'key-actions' },
             h('button', {
                 onClick: () => {
-                    document.cookie = 'publicKey=; path=/; expires=Thu, 01 Jan 1970 00:00:00 UTC;';
+                    setCookie('publicKey', '', 'path=/; expires=Thu, 01 Jan 1970 00:00:00 UTC');
                     window.location.href = '/';
                 }
             }, 'Switch Key')
         ),
+        // Shown once the challenge is signed, since the policy API needs it
+        sseConnection && activeKey?.publicKeyHash ? h(SenderPolicy, { publicKeyHash: activeKey.publicKeyHash }) : null,
         h('div', null,
             h('p', null, error)
         ),
@@ -198,26 +255,21 @@ export function PromptList() {
                 prompts.map(prompt => 
                     h('div', { className: 'prompt-item' },
                         h('hr', null),
+                        h('div', { className: 'prompt-sender', title: prompt.sender_key || '' },
+                            prompt.sender_hash ?
+                                'from: ' + senderFingerprint(prompt.sender_hash) :
+                                'from: anonymous (unsigned)'
+                        ),
                         h('div', { className: 'prompt-message' },
-                            h('p', null, prompt.message)
+                            h('p', null, prompt.plaintext ?? prompt.message)
                         ),
                         h('div', { className: 'prompt-actions' },
                             prompt.response ? 
                                 h('p', null, '-> ', prompt.response) :
-                                h('div', { className: 'response-form' },
-                                    h('input', {
-                                        type: 'text',
-                                        placeholder: 'Enter your response',
-                                        id: `response-${prompt.id}`
-                                    }),
-                                    h('button', {
-                                        onClick: () => {
-                                            const input = document.getElementById(`response-${prompt.id}`);
-                                            handleResponse(prompt.id, input.value);
-                                            input.value = '';
-                                        }
-                                    }, 'Submit')
-                                )
+                                h(PromptInput, {
+                                    prompt,
+                                    onSubmit: (response) => handleResponse(prompt, response)
+                                })
                         )
                     )
                 )
@@ -0,0 +1,70 @@
+// components/sender-policy.js
+import { h } from 'preact';
+import { useState, useEffect } from 'preact/hooks';
+
+// Lets the key holder choose whose prompts reach them: everyone, only signed
+// prompts from listed senders, or everyone but listed senders. Unsigned
+// prompts can also be made to carry proof of work.
+export function SenderPolicy({ publicKeyHash }) {
+    const [mode, setMode] = useState('open');
+    const [senders, setSenders] = useState('');
+    const [difficulty, setDifficulty] = useState(0);
+    const [status, setStatus] = useState('');
+
+    useEffect(() => {
+        fetch(`/api/policy/${publicKeyHash}`, { credentials: 'same-origin' })
+            .then(res => res.ok ? res.json() : Promise.reject(res))
+            .then(policy => {
+                setMode(policy.mode);
+                setSenders((policy.senders || []).join('\n'));
+                setDifficulty(policy.difficulty || 0);
+            })
+            .catch(() => setStatus('Failed to load sender policy'));
+    }, [publicKeyHash]);
+
+    const save = async () => {
+        const policy = {
+            mode,
+            senders: senders.split('\n').map(s => s.trim()).filter(Boolean),
+            difficulty: Number(difficulty) || 0
+        };
+        const res = await fetch(`/api/policy/${publicKeyHash}`, {
+            method: 'PUT',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify(policy),
+            credentials: 'same-origin'
+        });
+        if (res.ok) {
+            setStatus('Saved');
+        } else {
+            const problem = await res.json();
+            setStatus(problem.detail);
+        }
+    };
+
+    return h('details', { className: 'sender-policy' },
+        h('summary', null, 'Who can send me prompts'),
+        h('select', { value: mode, onChange: (e) => setMode(e.target.value) },
+            h('option', { value: 'open' }, 'Everyone'),
+            h('option', { value: 'allowlist' }, 'Only signed prompts from these senders'),
+            h('option', { value: 'blocklist' }, 'Everyone except these senders')
+        ),
+        mode !== 'open' ? h('textarea', {
+            placeholder: 'One sender public key per line',
+            value: senders,
+            onInput: (e) => setSenders(e.target.value)
+        }) : null,
+        h('label', null,
+            'Proof of work for unsigned prompts (bits, 0 for none) ',
+            h('input', {
+                type: 'number',
+                min: 0,
+                max: 32,
+                value: difficulty,
+                onInput: (e) => setDifficulty(e.target.value)
+            })
+        ),
+        h('button', { onClick: save }, 'Save'),
+        status ? h('p', null, status) : null
+    );
+}
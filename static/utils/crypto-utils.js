@@ -1,8 +1,22 @@
 // Hash function using SubtleCrypto
 export async function hashPublicKey(publicKey) {
+    return sha256Hex(publicKey);
+}
+
+// Hash a prompt message the way signed receipts refer to it
+export async function hashMessage(message) {
+    return sha256Hex(message);
+}
+
+// Short, readable form of a sender's key hash, e.g. "3f2a 9c01 77be 04d5"
+export function senderFingerprint(senderHash) {
+    return senderHash.slice(0, 16).match(/.{4}/g).join(' ');
+}
+
+async function sha256Hex(text) {
     const encoder = new TextEncoder();
-    const data = encoder.encode(publicKey);
+    const data = encoder.encode(text);
     const hashBuffer = await crypto.subtle.digest('SHA-256', data);
     const hashArray = Array.from(new Uint8Array(hashBuffer));
     return hashArray.map(b => b.toString(16).padStart(2, '0')).join('');
-}
\ No newline at end of file
+}
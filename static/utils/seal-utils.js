@@ -0,0 +1,71 @@
+// Sealed boxes as produced by the server's utils.Seal: base64 of the
+// ephemeral X25519 public key, a 12 byte nonce and the AES-256-GCM
+// ciphertext. The box key is SHA-256 of the version, the shared secret and
+// the ephemeral public key.
+const SEAL_VERSION = 'prompt-seal-v1';
+
+// PKCS#8 header of a raw 32 byte X25519 private key
+const X25519_PKCS8_PREFIX = [
+    0x30, 0x2e, 0x02, 0x01, 0x00, 0x30, 0x05, 0x06,
+    0x03, 0x2b, 0x65, 0x6e, 0x04, 0x22, 0x04, 0x20
+];
+
+const fromBase64 = (base64) => Uint8Array.from(atob(base64), c => c.charCodeAt(0));
+const toBase64 = (bytes) => btoa(String.fromCharCode(...bytes));
+
+// Convert the Ed25519 private key of a stored key pair to X25519: the
+// clamped first half of SHA-512 of the seed, which ends the PKCS#8 export.
+async function x25519PrivateKey(keyData) {
+    const pkcs8 = fromBase64(keyData.privateKey);
+    const seed = pkcs8.slice(pkcs8.length - 32);
+    const hash = new Uint8Array(await crypto.subtle.digest('SHA-512', seed));
+    const scalar = hash.slice(0, 32);
+    scalar[0] &= 248;
+    scalar[31] &= 127;
+    scalar[31] |= 64;
+    return crypto.subtle.importKey(
+        'pkcs8',
+        new Uint8Array([...X25519_PKCS8_PREFIX, ...scalar]),
+        { name: 'X25519' },
+        false,
+        ['deriveBits']
+    );
+}
+
+async function boxKey(shared, ephemeralPublic) {
+    const material = new Uint8Array([
+        ...new TextEncoder().encode(SEAL_VERSION),
+        ...new Uint8Array(shared),
+        ...ephemeralPublic
+    ]);
+    const digest = await crypto.subtle.digest('SHA-256', material);
+    return crypto.subtle.importKey('raw', digest, 'AES-GCM', false, ['encrypt', 'decrypt']);
+}
+
+// Open a prompt message sealed to the key pair's public key
+export async function openSealed(keyData, sealed) {
+    const box = fromBase64(sealed);
+    const ephemeralPublic = box.slice(0, 32);
+    const ephemeral = await crypto.subtle.importKey('raw', ephemeralPublic, { name: 'X25519' }, false, []);
+    const privateKey = await x25519PrivateKey(keyData);
+    const shared = await crypto.subtle.deriveBits({ name: 'X25519', public: ephemeral }, privateKey, 256);
+    const key = await boxKey(shared, ephemeralPublic);
+    const plaintext = await crypto.subtle.decrypt({ name: 'AES-GCM', iv: box.slice(32, 44) }, key, box.slice(44));
+    return new TextDecoder().decode(plaintext);
+}
+
+// Seal a response to the poster's base64 encoded X25519 reply key
+export async function seal(replyKey, plaintext) {
+    const recipient = await crypto.subtle.importKey('raw', fromBase64(replyKey), { name: 'X25519' }, false, []);
+    const ephemeral = await crypto.subtle.generateKey({ name: 'X25519' }, true, ['deriveBits']);
+    const ephemeralPublic = new Uint8Array(await crypto.subtle.exportKey('raw', ephemeral.publicKey));
+    const shared = await crypto.subtle.deriveBits({ name: 'X25519', public: recipient }, ephemeral.privateKey, 256);
+    const key = await boxKey(shared, ephemeralPublic);
+    const nonce = crypto.getRandomValues(new Uint8Array(12));
+    const ciphertext = new Uint8Array(await crypto.subtle.encrypt(
+        { name: 'AES-GCM', iv: nonce },
+        key,
+        new TextEncoder().encode(plaintext)
+    ));
+    return toBase64(new Uint8Array([...ephemeralPublic, ...nonce, ...ciphertext]));
+}
@@ -1,5 +1,13 @@
 import { useState, useEffect } from 'preact/hooks';
 import { hashPublicKey } from '../utils/crypto-utils.js';
+
+// Sets a cookie, marked Secure when the page was served over HTTPS so it
+// never travels in plain text.
+export function setCookie(name, value, attributes) {
+    const secure = location.protocol === 'https:' ? '; secure' : '';
+    document.cookie = `${name}=${value}; ${attributes}${secure}`;
+}
+
 // Key storage hook
 export function useKeyStore(callback) {
     const [keys, setKeys] = useState([]);
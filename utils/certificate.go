@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertificateCheckInterval is how often the certificate files are checked
+// for changes.
+const CertificateCheckInterval = 10 * time.Second
+
+// CertificateReloader serves a TLS certificate from files and picks up new
+// ones when the files change, such as after a renewal, without a restart.
+// The files are checked during handshakes at most once per
+// CertificateCheckInterval.
+type CertificateReloader struct {
+	certFile string
+	keyFile  string
+
+	mutex       sync.Mutex
+	certificate *tls.Certificate
+	modified    time.Time // Latest modification time of the two files
+	checked     time.Time
+}
+
+// NewCertificateReloader loads the certificate in certFile and keyFile.
+func NewCertificateReloader(certFile string, keyFile string) (*CertificateReloader, error) {
+	r := &CertificateReloader{certFile: certFile, keyFile: keyFile}
+	modified, err := r.modTime()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modified); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the current certificate. It fits
+// tls.Config.GetCertificate.
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if time.Since(r.checked) >= CertificateCheckInterval {
+		r.reload()
+	}
+	return r.certificate, nil
+}
+
+// reload loads the files again if they changed. A pair that does not load,
+// for instance because only one of the files was replaced yet, is logged
+// and the current certificate is kept.
+func (r *CertificateReloader) reload() {
+	r.checked = time.Now()
+	modified, err := r.modTime()
+	if err != nil {
+		slog.Error("Failed to check TLS certificate", "error", err)
+		return
+	}
+	if modified.Equal(r.modified) {
+		return
+	}
+	if err := r.load(modified); err != nil {
+		slog.Error("Failed to reload TLS certificate", "error", err)
+		return
+	}
+	slog.Info("Reloaded TLS certificate", "cert", r.certFile)
+}
+
+func (r *CertificateReloader) load(modified time.Time) error {
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.certificate = &certificate
+	r.modified = modified
+	r.checked = time.Now()
+	return nil
+}
+
+// modTime returns the latest modification time of the two files.
+func (r *CertificateReloader) modTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCertificate writes a self-signed certificate for name and its key
+// as PEM files.
+func writeTestCertificate(t *testing.T, certFile string, keyFile string, name string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+}
+
+// touch moves the modification time of files forward, as a renewal would.
+func touch(t *testing.T, at time.Time, files ...string) {
+	for _, file := range files {
+		require.NoError(t, os.Chtimes(file, at, at))
+	}
+}
+
+func servedName(t *testing.T, r *CertificateReloader) string {
+	certificate, err := r.GetCertificate(nil)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	require.NoError(t, err)
+	return leaf.Subject.CommonName
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeTestCertificate(t, certFile, keyFile, "old.example")
+
+	reloader, err := NewCertificateReloader(certFile, keyFile)
+	require.NoError(t, err)
+	assert.Equal(t, "old.example", servedName(t, reloader))
+
+	// A renewal is picked up once the check interval has passed
+	writeTestCertificate(t, certFile, keyFile, "new.example")
+	touch(t, time.Now().Add(time.Minute), certFile, keyFile)
+	assert.Equal(t, "old.example", servedName(t, reloader))
+	reloader.checked = time.Time{}
+	assert.Equal(t, "new.example", servedName(t, reloader))
+
+	// A half-written renewal keeps the current certificate
+	require.NoError(t, os.WriteFile(certFile, []byte("not a certificate"), 0600))
+	touch(t, time.Now().Add(2*time.Minute), certFile)
+	reloader.checked = time.Time{}
+	assert.Equal(t, "new.example", servedName(t, reloader))
+}
+
+func TestNewCertificateReloader_Errors(t *testing.T) {
+	dir := t.TempDir()
+	_, err := NewCertificateReloader(filepath.Join(dir, "missing.pem"), filepath.Join(dir, "missing-key.pem"))
+	assert.Error(t, err)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	require.NoError(t, os.WriteFile(certFile, []byte("not a certificate"), 0600))
+	_, err = NewCertificateReloader(certFile, certFile)
+	assert.Error(t, err)
+}
@@ -3,39 +3,111 @@ package utils
 import (
 	"errors"
 	"prompt-service-server/config"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
-var cfg = config.LoadConfig()
-var jwtSecret = []byte(cfg.CSRFTokenSecret)
-
 type Claims struct {
 	KeyHash string `json:"key_hash"`
 	jwt.RegisteredClaims
 }
 
-func GenerateCSRFToken(keyHash string) (string, error) {
+// TokenIssuer signs and verifies the tokens the server hands out: CSRF
+// tokens and proof-of-work challenges. It can hold several keys, so that
+// tokens signed before a rotation keep verifying until they expire.
+type TokenIssuer struct {
+	expiry time.Duration
+	window time.Duration // How long a retired key still verifies tokens
+	path   string        // Keys are saved here, if set
+
+	mutex sync.RWMutex
+	keys  []*signingKey // Oldest first; the last one signs
+}
+
+func newTokenIssuer(cfg *config.Config) *TokenIssuer {
+	expiry := time.Duration(cfg.CSRFTokenExpirySeconds) * time.Second
+	return &TokenIssuer{
+		expiry: expiry,
+		window: max(expiry, ChallengeExpiry),
+		path:   cfg.CSRFKeyFile,
+	}
+}
+
+// NewTokenIssuer returns an issuer whose keys live in memory: the CSRF
+// token secret of cfg, or a random key if none is configured.
+func NewTokenIssuer(cfg *config.Config) *TokenIssuer {
+	i := newTokenIssuer(cfg)
+	i.path = ""
+	if cfg.CSRFTokenSecret != "" {
+		i.keys = []*signingKey{staticKey(cfg.CSRFTokenSecret)}
+		return i
+	}
+	key, err := generateKey()
+	if err != nil {
+		// crypto/rand does not fail on supported platforms
+		panic(err)
+	}
+	i.keys = []*signingKey{key}
+	return i
+}
+
+// OpenTokenIssuer returns the issuer described by cfg. With a CSRF key file
+// the keys are loaded from it, and a key is generated and saved there if it
+// has none. Rotations are saved to it as well. Without a key file it is
+// NewTokenIssuer.
+func OpenTokenIssuer(cfg *config.Config) (*TokenIssuer, error) {
+	if cfg.CSRFKeyFile == "" {
+		return NewTokenIssuer(cfg), nil
+	}
+	i := newTokenIssuer(cfg)
+	keys, err := loadKeys(i.path)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, key := range keys {
+		if !i.expired(key, now) {
+			i.keys = append(i.keys, key)
+		}
+	}
+	if len(i.keys) == 0 || !i.keys[len(i.keys)-1].Retired.IsZero() {
+		if _, err := i.Rotate(); err != nil {
+			return nil, err
+		}
+	}
+	return i, nil
+}
+
+// CSRFTokenExpiry is how long a CSRF token is valid.
+func (i *TokenIssuer) CSRFTokenExpiry() time.Duration {
+	return i.expiry
+}
+
+func (i *TokenIssuer) GenerateCSRFToken(keyHash string) (string, error) {
 	// Generate a JWT with a secret key
 	now := time.Now()
 	claims := &Claims{
 		KeyHash: keyHash, // This would be the user's public key hash
 		RegisteredClaims: jwt.RegisteredClaims{
 			IssuedAt:  jwt.NewNumericDate(now),
-			ExpiresAt: jwt.NewNumericDate(now.Add(time.Duration(cfg.CSRFTokenExpirySeconds) * time.Second)),
+			ExpiresAt: jwt.NewNumericDate(now.Add(i.expiry)),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	return i.sign(claims, false)
 }
 
-func VerifyJWT(tokenString string) error {
+func (i *TokenIssuer) VerifyJWT(tokenString string) error {
 	// Verify the JWT signature
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
+		key, err := i.verificationKey(token)
+		if err != nil {
+			return nil, err
+		}
+		return key.Secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
 
 	if err != nil {
 		return err
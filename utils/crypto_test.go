@@ -4,41 +4,53 @@ import (
 	"testing"
 	"time"
 
+	"prompt-service-server/config"
+
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+func newTestIssuer() *TokenIssuer {
+	cfg := config.Default()
+	cfg.CSRFTokenSecret = "0123456789abcdef0123456789abcdef"
+	return NewTokenIssuer(cfg)
+}
+
 func TestGenerateCSRFToken(t *testing.T) {
+	issuer := newTestIssuer()
 	keyHash := "test-key-hash"
 
-	token, err := GenerateCSRFToken(keyHash)
+	token, err := issuer.GenerateCSRFToken(keyHash)
 	require.NoError(t, err)
 	assert.NotEmpty(t, token)
 
 	// Verify the token can be parsed and contains expected claims
-	err = VerifyJWT(token)
+	err = issuer.VerifyJWT(token)
 	assert.NoError(t, err)
 }
 
 func TestVerifyJWT_ValidToken(t *testing.T) {
+	issuer := newTestIssuer()
 	keyHash := "test-key-hash"
 
-	token, err := GenerateCSRFToken(keyHash)
+	token, err := issuer.GenerateCSRFToken(keyHash)
 	require.NoError(t, err)
 
-	err = VerifyJWT(token)
+	err = issuer.VerifyJWT(token)
 	assert.NoError(t, err)
 }
 
 func TestVerifyJWT_InvalidToken(t *testing.T) {
+	issuer := newTestIssuer()
 	invalidToken := "invalid.jwt.token"
 
-	err := VerifyJWT(invalidToken)
+	err := issuer.VerifyJWT(invalidToken)
 	assert.Error(t, err)
 }
 
 func TestVerifyJWT_ExpiredToken(t *testing.T) {
+	issuer := newTestIssuer()
 	// Create a token that expires immediately
 	now := time.Now().Add(-10 * time.Minute) // 10 minutes ago
 	claims := &Claims{
@@ -49,10 +61,18 @@ func TestVerifyJWT_ExpiredToken(t *testing.T) {
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtSecret)
+	tokenString, err := issuer.sign(claims, false)
 	require.NoError(t, err)
 
-	err = VerifyJWT(tokenString)
+	err = issuer.VerifyJWT(tokenString)
 	assert.Error(t, err) // Should fail because token is expired
 }
+
+func TestVerifyJWT_OtherSecret(t *testing.T) {
+	token, err := newTestIssuer().GenerateCSRFToken("test-key-hash")
+	require.NoError(t, err)
+
+	cfg := config.Default()
+	cfg.CSRFTokenSecret = "fedcba9876543210fedcba9876543210"
+	assert.Error(t, NewTokenIssuer(cfg).VerifyJWT(token))
+}
@@ -1,5 +1,7 @@
 package utils
 
+import "context"
+
 type Signal struct {
 	ch chan string
 }
@@ -12,6 +14,21 @@ func (s *Signal) Wait() string {
 	return <-s.ch
 }
 
+// WaitContext waits for a response until the context is done.
+func (s *Signal) WaitContext(ctx context.Context) (string, error) {
+	select {
+	case response := <-s.ch:
+		return response, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// Signal delivers a response to the waiter. Only the first response is
+// delivered; later ones are dropped instead of blocking.
 func (s *Signal) Signal(response string) {
-	s.ch <- response
+	select {
+	case s.ch <- response:
+	default:
+	}
 }
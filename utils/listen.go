@@ -0,0 +1,159 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd.
+const listenFdsStart = 3
+
+// systemdSocket is a socket passed in by systemd socket activation.
+type systemdSocket struct {
+	name     string
+	listener net.Listener
+	used     bool
+}
+
+// Listeners opens the sockets a server serves on. An address is one of
+//
+//	host:port      a TCP port, such as :8080 or 127.0.0.1:9090
+//	unix:/path     a Unix domain socket, created with the socket mode
+//	systemd        every socket passed in by systemd (LISTEN_FDS)
+//	systemd:name   the passed sockets named name (FileDescriptorName=)
+//
+// Each passed socket can be used by one address only.
+type Listeners struct {
+	mode    os.FileMode
+	systemd []*systemdSocket
+}
+
+// NewListeners takes over the sockets passed in by systemd, if any, and
+// creates Unix sockets with mode.
+func NewListeners(mode os.FileMode) (*Listeners, error) {
+	sockets, err := systemdSockets()
+	if err != nil {
+		return nil, err
+	}
+	return &Listeners{mode: mode, systemd: sockets}, nil
+}
+
+// Listen opens the listeners of addr.
+func (l *Listeners) Listen(addr string) ([]net.Listener, error) {
+	switch {
+	case addr == "systemd" || strings.HasPrefix(addr, "systemd:"):
+		return l.passed(addr)
+	case strings.HasPrefix(addr, "unix:"):
+		listener, err := listenUnix(strings.TrimPrefix(addr, "unix:"), l.mode)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{listener}, nil
+	default:
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{listener}, nil
+	}
+}
+
+// Unused closes the passed sockets no address asked for, and returns their
+// names, so that a mistake in the config does not go unnoticed.
+func (l *Listeners) Unused() []string {
+	var names []string
+	for _, socket := range l.systemd {
+		if !socket.used {
+			socket.used = true
+			socket.listener.Close()
+			names = append(names, socket.name)
+		}
+	}
+	return names
+}
+
+// passed returns the sockets from systemd that addr asks for.
+func (l *Listeners) passed(addr string) ([]net.Listener, error) {
+	name, named := strings.CutPrefix(addr, "systemd:")
+	var sockets []*systemdSocket
+	for _, socket := range l.systemd {
+		if named && socket.name != name {
+			continue
+		}
+		if socket.used {
+			return nil, fmt.Errorf("%s: socket %q is already in use", addr, socket.name)
+		}
+		sockets = append(sockets, socket)
+	}
+	if len(sockets) == 0 {
+		return nil, fmt.Errorf("%s: no such socket was passed by systemd", addr)
+	}
+	listeners := make([]net.Listener, len(sockets))
+	for i, socket := range sockets {
+		socket.used = true
+		listeners[i] = socket.listener
+	}
+	return listeners, nil
+}
+
+// listenUnix creates a Unix domain socket at path with mode. A socket left
+// behind by a server that did not stop cleanly is replaced; one that is
+// still being served is not.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("unix:%s: socket is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// systemdSockets returns the sockets systemd passed to this process, as
+// described by sd_listen_fds(3). The environment variables are cleared so
+// child processes do not take them for their own.
+func systemdSockets() ([]*systemdSocket, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 0 {
+		return nil, errors.New("LISTEN_FDS is not a number of sockets")
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	sockets := make([]*systemdSocket, 0, count)
+	for i := 0; i < count; i++ {
+		fd := listenFdsStart + i
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %d (%s) from systemd: %w", fd, name, err)
+		}
+		sockets = append(sockets, &systemdSocket{name: name, listener: listener})
+	}
+	return sockets, nil
+}
@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListeners_Unix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.sock")
+	listeners, err := NewListeners(0600)
+	require.NoError(t, err)
+
+	opened, err := listeners.Listen("unix:" + path)
+	require.NoError(t, err)
+	require.Len(t, opened, 1)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// A socket that is being served is not taken over
+	_, err = listeners.Listen("unix:" + path)
+	assert.Error(t, err)
+
+	// One left behind by a server that died is replaced
+	stale := opened[0].(*net.UnixListener)
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	opened, err = listeners.Listen("unix:" + path)
+	require.NoError(t, err)
+	defer opened[0].Close()
+	conn, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestListeners_TCP(t *testing.T) {
+	listeners, err := NewListeners(0660)
+	require.NoError(t, err)
+	opened, err := listeners.Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	require.Len(t, opened, 1)
+	defer opened[0].Close()
+	assert.Equal(t, "tcp", opened[0].Addr().Network())
+}
+
+func TestListeners_Systemd(t *testing.T) {
+	passed := func(name string) *systemdSocket {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		return &systemdSocket{name: name, listener: listener}
+	}
+	api, admin, spare := passed("api"), passed("admin"), passed("spare")
+	listeners := &Listeners{systemd: []*systemdSocket{api, admin, spare}}
+
+	opened, err := listeners.Listen("systemd:admin")
+	require.NoError(t, err)
+	assert.Equal(t, []net.Listener{admin.listener}, opened)
+	_, err = listeners.Listen("systemd:metrics")
+	assert.Error(t, err, "no socket of that name")
+	// Every socket is used once only
+	_, err = listeners.Listen("systemd")
+	assert.Error(t, err)
+
+	listeners = &Listeners{systemd: []*systemdSocket{api, spare}}
+	opened, err = listeners.Listen("systemd:api")
+	require.NoError(t, err)
+	assert.Equal(t, []net.Listener{api.listener}, opened)
+	assert.Equal(t, []string{"spare"}, listeners.Unused())
+	_, err = spare.listener.Accept()
+	assert.Error(t, err, "unused sockets are closed")
+	api.listener.Close()
+	admin.listener.Close()
+}
+
+func TestSystemdSockets_Environment(t *testing.T) {
+	// Sockets meant for another process are left alone
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "2")
+	sockets, err := systemdSockets()
+	require.NoError(t, err)
+	assert.Empty(t, sockets)
+	assert.Equal(t, "2", os.Getenv("LISTEN_FDS"))
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "many")
+	_, err = systemdSockets()
+	assert.Error(t, err)
+
+	t.Setenv("LISTEN_FDS", "0")
+	t.Setenv("LISTEN_FDNAMES", "")
+	sockets, err = systemdSockets()
+	require.NoError(t, err)
+	assert.Empty(t, sockets)
+	_, set := os.LookupEnv("LISTEN_FDS")
+	assert.False(t, set, "the variables are cleared for child processes")
+}
@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"math/bits"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// proofOfWorkVersion prefixes every hashed solution so it cannot be mistaken
+// for any other hash the server checks.
+const proofOfWorkVersion = "prompt-pow-v1"
+
+// ChallengeExpiry is how long a proof-of-work challenge can be solved and
+// redeemed.
+const ChallengeExpiry = 5 * time.Minute
+
+var (
+	// ErrInvalidChallenge is returned for challenges that were not issued by
+	// this server or have expired.
+	ErrInvalidChallenge = errors.New("invalid or expired challenge")
+	// ErrInsufficientWork is returned when a solution does not have enough
+	// leading zero bits.
+	ErrInsufficientWork = errors.New("solution does not meet the difficulty")
+)
+
+// ChallengeClaims are carried by a proof-of-work challenge. The server keeps
+// no state until the challenge is redeemed; the ID lets it refuse a second
+// redemption.
+type ChallengeClaims struct {
+	Difficulty int `json:"difficulty"`
+	jwt.RegisteredClaims
+}
+
+// ProofOfWork is a poster's solution to a challenge.
+type ProofOfWork struct {
+	Challenge string `json:"challenge"`
+	Nonce     string `json:"nonce"`
+}
+
+// GenerateChallenge returns a signed challenge that asks for difficulty
+// leading zero bits, and when it expires.
+func (i *TokenIssuer) GenerateChallenge(difficulty int) (string, time.Time, error) {
+	id, err := GenerateToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	now := time.Now()
+	expires := now.Add(ChallengeExpiry)
+	claims := &ChallengeClaims{
+		Difficulty: difficulty,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        id,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expires),
+		},
+	}
+	challenge, err := i.sign(claims, true)
+	return challenge, expires, err
+}
+
+// ProofOfWorkHash returns the SHA-256 a solution is judged by: the version,
+// challenge, message hash and nonce on a line each. Binding the message
+// means a solution can't be moved to another prompt.
+func ProofOfWorkHash(challenge string, message string, nonce string) [32]byte {
+	return sha256.Sum256([]byte(proofOfWorkVersion + "\n" +
+		challenge + "\n" +
+		HashMessage(message) + "\n" +
+		nonce))
+}
+
+// LeadingZeroBits counts the zero bits at the start of hash.
+func LeadingZeroBits(hash [32]byte) int {
+	count := 0
+	for _, b := range hash {
+		if b != 0 {
+			return count + bits.LeadingZeros8(b)
+		}
+		count += 8
+	}
+	return count
+}
+
+// VerifyProofOfWork checks that challenge was issued by this server, has
+// not expired and asked for at least difficulty bits, and that nonce solves
+// it for message. It returns the claims so the caller can refuse to accept
+// the same challenge twice.
+func (i *TokenIssuer) VerifyProofOfWork(challenge string, message string, nonce string, difficulty int) (*ChallengeClaims, error) {
+	claims := &ChallengeClaims{}
+	token, err := jwt.ParseWithClaims(challenge, claims, func(token *jwt.Token) (interface{}, error) {
+		key, err := i.verificationKey(token)
+		if err != nil {
+			return nil, err
+		}
+		return key.challengeSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil || !token.Valid || claims.ID == "" {
+		return nil, ErrInvalidChallenge
+	}
+	if claims.Difficulty < difficulty || LeadingZeroBits(ProofOfWorkHash(challenge, message, nonce)) < claims.Difficulty {
+		return nil, ErrInsufficientWork
+	}
+	return claims, nil
+}
+
+// solveCheckInterval is how many nonces are tried between checks whether
+// solving was cancelled.
+const solveCheckInterval = 1 << 16
+
+// SolveProofOfWork searches for a nonce that gives the hash of challenge and
+// message difficulty leading zero bits. Every extra bit doubles the work,
+// so the search gives up with ctx's error once ctx is done.
+func SolveProofOfWork(ctx context.Context, challenge string, message string, difficulty int) (string, error) {
+	for counter := uint64(0); ; counter++ {
+		if counter%solveCheckInterval == 0 && ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		nonce := strconv.FormatUint(counter, 10)
+		if LeadingZeroBits(ProofOfWorkHash(challenge, message, nonce)) >= difficulty {
+			return nonce, nil
+		}
+	}
+}
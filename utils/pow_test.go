@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLeadingZeroBits(t *testing.T) {
+	assert.Equal(t, 0, LeadingZeroBits([32]byte{0x80}))
+	assert.Equal(t, 7, LeadingZeroBits([32]byte{0x01}))
+	assert.Equal(t, 12, LeadingZeroBits([32]byte{0x00, 0x08}))
+	assert.Equal(t, 256, LeadingZeroBits([32]byte{}))
+}
+
+func TestProofOfWork(t *testing.T) {
+	issuer := newTestIssuer()
+	challenge, expires, err := issuer.GenerateChallenge(8)
+	require.NoError(t, err)
+	assert.True(t, expires.After(time.Now()))
+
+	nonce, err := SolveProofOfWork(context.Background(), challenge, "Deploy?", 8)
+	require.NoError(t, err)
+	claims, err := issuer.VerifyProofOfWork(challenge, "Deploy?", nonce, 8)
+	require.NoError(t, err)
+	assert.Equal(t, 8, claims.Difficulty)
+	assert.NotEmpty(t, claims.ID)
+
+	// The solution does not carry over to another message
+	if LeadingZeroBits(ProofOfWorkHash(challenge, "Delete everything?", nonce)) < 8 {
+		_, err = issuer.VerifyProofOfWork(challenge, "Delete everything?", nonce, 8)
+		assert.Equal(t, ErrInsufficientWork, err)
+	}
+
+	// A challenge that asked for less than the recipient wants is refused
+	_, err = issuer.VerifyProofOfWork(challenge, "Deploy?", nonce, 9)
+	assert.Equal(t, ErrInsufficientWork, err)
+
+	// Solving gives up once cancelled, even when no solution is in reach
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = SolveProofOfWork(ctx, challenge, "Deploy?", 256)
+	assert.Equal(t, context.Canceled, err)
+
+	// CSRF tokens are signed with another key
+	csrfToken, err := issuer.GenerateCSRFToken("hash")
+	require.NoError(t, err)
+	_, err = issuer.VerifyProofOfWork(csrfToken, "Deploy?", "0", 0)
+	assert.Equal(t, ErrInvalidChallenge, err)
+	assert.Error(t, issuer.VerifyJWT(challenge))
+}
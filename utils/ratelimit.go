@@ -0,0 +1,136 @@
+package utils
+
+import (
+	"container/list"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxBuckets is how many buckets a RateLimiter keeps. Beyond that the least
+// recently used bucket is forgotten for each new key, which gives that key
+// a full bucket should it come back.
+const maxBuckets = 10000
+
+// RateLimiter is a token bucket per key, such as a client IP or public key.
+// Each bucket holds up to Burst tokens and refills at Rate tokens per
+// second. A nil RateLimiter allows everything.
+type RateLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	buckets  map[string]*list.Element
+	used     *list.List // Of *bucket, least recently used first
+	mutex    sync.Mutex
+	rejected atomic.Uint64
+}
+
+type bucket struct {
+	key     string
+	tokens  float64
+	updated time.Time
+}
+
+// NewRateLimiter returns a limiter that allows perMinute requests per key
+// on average and up to burst at once. It returns nil, which allows
+// everything, if perMinute is not positive.
+func NewRateLimiter(perMinute int, burst int) *RateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+		now:     time.Now,
+		buckets: make(map[string]*list.Element),
+		used:    list.New(),
+	}
+}
+
+// Allow takes a token from the bucket of key. If the bucket is empty it
+// returns false and how long until a token is available.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	element, exists := l.buckets[key]
+	if !exists {
+		l.makeRoom(now)
+		element = l.used.PushBack(&bucket{key: key, tokens: l.burst, updated: now})
+		l.buckets[key] = element
+	}
+	l.used.MoveToBack(element)
+	b := element.Value.(*bucket)
+	b.tokens = l.tokens(b, now)
+	b.updated = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	l.rejected.Add(1)
+	return false, l.wait(b.tokens)
+}
+
+// Check reports whether Allow would take a token from the bucket of key,
+// without taking it. Callers turn the request away if it returns false, so
+// that is counted as rejected.
+func (l *RateLimiter) Check(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	element, exists := l.buckets[key]
+	if !exists {
+		return true, 0
+	}
+	tokens := l.tokens(element.Value.(*bucket), l.now())
+	if tokens >= 1 {
+		return true, 0
+	}
+	l.rejected.Add(1)
+	return false, l.wait(tokens)
+}
+
+// Rejected returns how many requests the limiter turned away.
+func (l *RateLimiter) Rejected() uint64 {
+	if l == nil {
+		return 0
+	}
+	return l.rejected.Load()
+}
+
+// tokens returns how many tokens b holds by now.
+func (l *RateLimiter) tokens(b *bucket, now time.Time) float64 {
+	return math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+}
+
+// wait returns how long a bucket holding tokens takes to hold one.
+func (l *RateLimiter) wait(tokens float64) time.Duration {
+	return time.Duration((1 - tokens) / l.rate * float64(time.Second))
+}
+
+// makeRoom forgets the least recently used buckets that have refilled by
+// now, which behave like new ones anyway, and then the least recently used
+// one if there are still too many. The caller must hold the mutex.
+func (l *RateLimiter) makeRoom(now time.Time) {
+	for l.used.Len() > 0 {
+		oldest := l.used.Front()
+		b := oldest.Value.(*bucket)
+		if l.used.Len() < maxBuckets && l.tokens(b, now) < l.burst {
+			return
+		}
+		l.used.Remove(oldest)
+		delete(l.buckets, b.key)
+	}
+}
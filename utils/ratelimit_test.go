@@ -0,0 +1,121 @@
+package utils
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	limiter := NewRateLimiter(60, 3) // One token per second
+	limiter.now = func() time.Time { return now }
+
+	// The burst is available right away
+	for i := 0; i < 3; i++ {
+		allowed, _ := limiter.Allow("a")
+		assert.True(t, allowed)
+	}
+	allowed, wait := limiter.Allow("a")
+	assert.False(t, allowed)
+	assert.Equal(t, time.Second, wait)
+	assert.Equal(t, uint64(1), limiter.Rejected())
+
+	// Other keys have their own bucket
+	allowed, _ = limiter.Allow("b")
+	assert.True(t, allowed)
+
+	// Tokens refill over time, up to the burst
+	now = now.Add(500 * time.Millisecond)
+	allowed, wait = limiter.Allow("a")
+	assert.False(t, allowed)
+	assert.Equal(t, 500*time.Millisecond, wait)
+	now = now.Add(500 * time.Millisecond)
+	allowed, _ = limiter.Allow("a")
+	assert.True(t, allowed)
+
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		allowed, _ = limiter.Allow("a")
+		assert.True(t, allowed)
+	}
+	allowed, _ = limiter.Allow("a")
+	assert.False(t, allowed)
+}
+
+func TestRateLimiterCheck(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	limiter := NewRateLimiter(60, 1)
+	limiter.now = func() time.Time { return now }
+
+	// Checking takes no token
+	for i := 0; i < 3; i++ {
+		allowed, _ := limiter.Check("a")
+		assert.True(t, allowed)
+	}
+	allowed, _ := limiter.Allow("a")
+	assert.True(t, allowed)
+
+	allowed, wait := limiter.Check("a")
+	assert.False(t, allowed)
+	assert.Equal(t, time.Second, wait)
+	assert.Equal(t, uint64(1), limiter.Rejected())
+	now = now.Add(time.Second)
+	allowed, _ = limiter.Check("a")
+	assert.True(t, allowed)
+	assert.Len(t, limiter.buckets, 1)
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	limiter := NewRateLimiter(0, 10)
+	assert.Nil(t, limiter)
+	for i := 0; i < 100; i++ {
+		allowed, _ := limiter.Allow("a")
+		assert.True(t, allowed)
+	}
+	allowed, _ := limiter.Check("a")
+	assert.True(t, allowed)
+	assert.Equal(t, uint64(0), limiter.Rejected())
+}
+
+func TestRateLimiterForgetsFullBuckets(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	limiter := NewRateLimiter(60, 1)
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < maxBuckets; i++ {
+		limiter.Allow(strconv.Itoa(i))
+	}
+	assert.Len(t, limiter.buckets, maxBuckets)
+
+	// Once they have refilled, the old buckets make room for new ones
+	now = now.Add(time.Minute)
+	limiter.Allow("new")
+	assert.Len(t, limiter.buckets, 1)
+	assert.Equal(t, 1, limiter.used.Len())
+}
+
+func TestRateLimiterForgetsLeastRecentlyUsed(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	limiter := NewRateLimiter(1, 1)
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < maxBuckets; i++ {
+		limiter.Allow(strconv.Itoa(i))
+	}
+	// Using a bucket keeps it
+	allowed, _ := limiter.Allow("0")
+	assert.False(t, allowed)
+
+	// None has refilled, so new keys push out the least recently used
+	limiter.Allow("new")
+	limiter.Allow("newer")
+	assert.Len(t, limiter.buckets, maxBuckets)
+	assert.Contains(t, limiter.buckets, "0")
+	assert.NotContains(t, limiter.buckets, "1")
+	assert.NotContains(t, limiter.buckets, "2")
+	assert.Contains(t, limiter.buckets, "3")
+	assert.Contains(t, limiter.buckets, "newer")
+}
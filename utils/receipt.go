@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// receiptVersion prefixes every signed receipt so the signature cannot be
+// replayed as a signature over anything else, such as a CSRF token.
+const receiptVersion = "prompt-receipt-v1"
+
+var (
+	// ErrMalformedSignature is returned when a key or signature cannot be
+	// decoded.
+	ErrMalformedSignature = errors.New("malformed key or signature")
+	// ErrInvalidSignature is returned when a signature does not match.
+	ErrInvalidSignature = errors.New("invalid signature")
+)
+
+// Receipt is the statement a responder signs when answering a prompt. It
+// lets the poster verify that the holder of PublicKey gave Response to the
+// prompt, without trusting the server that relayed it.
+type Receipt struct {
+	PromptId    string `json:"prompt_id"`
+	MessageHash string `json:"message_hash"` // Hex encoded SHA-256 of the prompt message
+	Response    string `json:"response"`     // The answer exactly as it was signed
+	Timestamp   int64  `json:"timestamp"`    // Unix seconds
+	PublicKey   string `json:"public_key"`   // Base64 encoded Ed25519 public key
+	Signature   string `json:"signature"`    // Base64 encoded Ed25519 signature of Payload
+}
+
+// HashMessage returns the hex encoded SHA-256 of a prompt message.
+func HashMessage(message string) string {
+	hash := sha256.Sum256([]byte(message))
+	return hex.EncodeToString(hash[:])
+}
+
+// Payload returns the canonical bytes the responder signs: the version,
+// prompt id, message hash and timestamp on a line each, followed by the
+// response.
+func (r *Receipt) Payload() []byte {
+	return []byte(receiptVersion + "\n" +
+		r.PromptId + "\n" +
+		r.MessageHash + "\n" +
+		strconv.FormatInt(r.Timestamp, 10) + "\n" +
+		r.Response)
+}
+
+// VerifyReceipt checks that the receipt is for message and carries a valid
+// signature by its public key. Posters can use it offline; the caller still
+// has to check that PublicKey and PromptId are the ones it expects.
+func VerifyReceipt(receipt *Receipt, message string) error {
+	if receipt.MessageHash != HashMessage(message) {
+		return errors.New("receipt is for a different message")
+	}
+	return VerifySignature(receipt.PublicKey, receipt.Payload(), receipt.Signature)
+}
+
+// VerifySignature checks a base64 encoded Ed25519 signature of message
+// against a base64 encoded public key.
+func VerifySignature(publicKey string, message []byte, signature string) error {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("%w: bad public key", ErrMalformedSignature)
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("%w: bad signature", ErrMalformedSignature)
+	}
+	if !ed25519.Verify(key, message, sig) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func signedReceipt(t *testing.T, message string, response string) *Receipt {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	receipt := &Receipt{
+		PromptId:    "prompt-id",
+		MessageHash: HashMessage(message),
+		Response:    response,
+		Timestamp:   1700000000,
+		PublicKey:   base64.StdEncoding.EncodeToString(pub),
+	}
+	receipt.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(priv, receipt.Payload()))
+	return receipt
+}
+
+func TestReceiptPayload(t *testing.T) {
+	receipt := &Receipt{PromptId: "id", MessageHash: "hash", Response: "multi\nline", Timestamp: 42}
+	assert.Equal(t, "prompt-receipt-v1\nid\nhash\n42\nmulti\nline", string(receipt.Payload()))
+}
+
+func TestVerifyReceipt(t *testing.T) {
+	receipt := signedReceipt(t, "Deploy?", "yes")
+	assert.NoError(t, VerifyReceipt(receipt, "Deploy?"))
+
+	// The receipt does not vouch for another message
+	assert.Error(t, VerifyReceipt(receipt, "Delete everything?"))
+
+	tampered := *receipt
+	tampered.Response = "no"
+	assert.Equal(t, ErrInvalidSignature, VerifyReceipt(&tampered, "Deploy?"))
+
+	tampered = *receipt
+	tampered.Timestamp++
+	assert.Equal(t, ErrInvalidSignature, VerifyReceipt(&tampered, "Deploy?"))
+}
+
+func TestVerifySignature_Malformed(t *testing.T) {
+	receipt := signedReceipt(t, "Deploy?", "yes")
+
+	err := VerifySignature("not base64!", receipt.Payload(), receipt.Signature)
+	assert.True(t, errors.Is(err, ErrMalformedSignature))
+
+	err = VerifySignature(base64.StdEncoding.EncodeToString([]byte("short")), receipt.Payload(), receipt.Signature)
+	assert.True(t, errors.Is(err, ErrMalformedSignature))
+
+	err = VerifySignature(receipt.PublicKey, receipt.Payload(), "not base64!")
+	assert.True(t, errors.Is(err, ErrMalformedSignature))
+}
@@ -0,0 +1,191 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"math/big"
+)
+
+// sealVersion is mixed into every sealed box key so keys derived for sealed
+// boxes are never reused for anything else.
+const sealVersion = "prompt-seal-v1"
+
+// sealOverhead is the size of a sealed box around an empty plaintext: the
+// ephemeral X25519 public key, the AES-GCM nonce and the AES-GCM tag.
+const sealOverhead = 32 + 12 + 16
+
+// ErrSealedBox is returned when a sealed box is malformed or cannot be opened.
+var ErrSealedBox = errors.New("cannot open sealed box")
+
+// curve25519P is the field prime 2^255 - 19.
+var curve25519P = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+// Ed25519PublicKeyToX25519 converts an Ed25519 public key to the X25519
+// public key of the same key pair, using the birational map u = (1+y)/(1-y).
+func Ed25519PublicKeyToX25519(publicKey ed25519.PublicKey) (*ecdh.PublicKey, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid Ed25519 public key")
+	}
+	// y is little-endian with the sign of x in the top bit
+	le := make([]byte, len(publicKey))
+	copy(le, publicKey)
+	le[31] &= 0x7f
+	y := new(big.Int).SetBytes(reverse(le))
+
+	one := big.NewInt(1)
+	denominator := new(big.Int).Sub(one, y)
+	denominator.Mod(denominator, curve25519P)
+	inverse := new(big.Int).ModInverse(denominator, curve25519P)
+	if inverse == nil {
+		return nil, errors.New("invalid Ed25519 public key")
+	}
+	u := new(big.Int).Add(one, y)
+	u.Mul(u, inverse)
+	u.Mod(u, curve25519P)
+
+	out := make([]byte, 32)
+	u.FillBytes(out)
+	return ecdh.X25519().NewPublicKey(reverse(out))
+}
+
+// Ed25519PrivateKeyToX25519 converts an Ed25519 private key to the X25519
+// private key of the same key pair: the clamped first half of SHA-512 of
+// the seed.
+func Ed25519PrivateKeyToX25519(privateKey ed25519.PrivateKey) (*ecdh.PrivateKey, error) {
+	hash := sha512.Sum512(privateKey.Seed())
+	scalar := hash[:32]
+	scalar[0] &= 248
+	scalar[31] &= 127
+	scalar[31] |= 64
+	return ecdh.X25519().NewPrivateKey(scalar)
+}
+
+// Seal encrypts plaintext so only the holder of the recipient's private key
+// can read it. The result is base64 of the ephemeral public key, the nonce
+// and the AES-256-GCM ciphertext.
+func Seal(recipient *ecdh.PublicKey, plaintext []byte) (string, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return "", err
+	}
+	ephemeralPublic := ephemeral.PublicKey().Bytes()
+	aead, err := sealCipher(shared, ephemeralPublic)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	box := append(append(ephemeralPublic, nonce...), aead.Seal(nil, nonce, plaintext, nil)...)
+	return base64.StdEncoding.EncodeToString(box), nil
+}
+
+// Open decrypts a sealed box with the recipient's private key.
+func Open(recipient *ecdh.PrivateKey, sealed string) ([]byte, error) {
+	box, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(box) < sealOverhead {
+		return nil, ErrSealedBox
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(box[:32])
+	if err != nil {
+		return nil, ErrSealedBox
+	}
+	shared, err := recipient.ECDH(ephemeral)
+	if err != nil {
+		return nil, ErrSealedBox
+	}
+	aead, err := sealCipher(shared, box[:32])
+	if err != nil {
+		return nil, err
+	}
+	nonce := box[32 : 32+aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, box[32+aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrSealedBox
+	}
+	return plaintext, nil
+}
+
+// IsSealed reports whether s is shaped like a sealed box. It cannot tell
+// whether the box opens.
+func IsSealed(s string) bool {
+	box, err := base64.StdEncoding.DecodeString(s)
+	return err == nil && len(box) >= sealOverhead
+}
+
+// SealForKey encrypts a prompt message to a recipient's base64 encoded
+// Ed25519 public key, as used for the public_key of a prompt.
+func SealForKey(publicKey string, message string) (string, error) {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return "", err
+	}
+	recipient, err := Ed25519PublicKeyToX25519(key)
+	if err != nil {
+		return "", err
+	}
+	return Seal(recipient, []byte(message))
+}
+
+// GenerateReplyKey creates the ephemeral key pair a poster sends with an
+// encrypted prompt. The reply_key to send is the base64 encoded public key;
+// the response is opened with OpenReply.
+func GenerateReplyKey() (*ecdh.PrivateKey, string, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+	return key, base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+// OpenReply decrypts the response to an encrypted prompt.
+func OpenReply(replyKey *ecdh.PrivateKey, sealed string) (string, error) {
+	plaintext, err := Open(replyKey, sealed)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// ParseReplyKey decodes a base64 encoded X25519 reply key.
+func ParseReplyKey(replyKey string) (*ecdh.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(replyKey)
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPublicKey(key)
+}
+
+// sealCipher derives the AES-256-GCM cipher of a sealed box from the shared
+// secret and the ephemeral public key.
+func sealCipher(shared []byte, ephemeralPublic []byte) (cipher.AEAD, error) {
+	hash := sha256.New()
+	hash.Write([]byte(sealVersion))
+	hash.Write(shared)
+	hash.Write(ephemeralPublic)
+	block, err := aes.NewCipher(hash.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func reverse(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i := range b {
+		out[len(b)-1-i] = b[i]
+	}
+	return out
+}
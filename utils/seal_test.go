@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEd25519ToX25519(t *testing.T) {
+	for i := 0; i < 16; i++ {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+
+		xPub, err := Ed25519PublicKeyToX25519(pub)
+		require.NoError(t, err)
+		xPriv, err := Ed25519PrivateKeyToX25519(priv)
+		require.NoError(t, err)
+
+		// Both halves of the converted key pair must still match
+		assert.Equal(t, xPriv.PublicKey().Bytes(), xPub.Bytes())
+	}
+
+	_, err := Ed25519PublicKeyToX25519([]byte("short"))
+	assert.Error(t, err)
+}
+
+func TestSealForKeyAndOpen(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	sealed, err := SealForKey(base64.StdEncoding.EncodeToString(pub), "the launch code is 0000")
+	require.NoError(t, err)
+	assert.True(t, IsSealed(sealed))
+	assert.NotContains(t, sealed, "launch")
+
+	xPriv, err := Ed25519PrivateKeyToX25519(priv)
+	require.NoError(t, err)
+	plaintext, err := Open(xPriv, sealed)
+	require.NoError(t, err)
+	assert.Equal(t, "the launch code is 0000", string(plaintext))
+
+	// Sealing is randomised
+	again, err := SealForKey(base64.StdEncoding.EncodeToString(pub), "the launch code is 0000")
+	require.NoError(t, err)
+	assert.NotEqual(t, sealed, again)
+}
+
+func TestOpen_Rejects(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	xPriv, err := Ed25519PrivateKeyToX25519(priv)
+	require.NoError(t, err)
+
+	sealed, err := Seal(xPriv.PublicKey(), []byte("secret"))
+	require.NoError(t, err)
+
+	box, _ := base64.StdEncoding.DecodeString(sealed)
+	box[len(box)-1] ^= 1
+	_, err = Open(xPriv, base64.StdEncoding.EncodeToString(box))
+	assert.Equal(t, ErrSealedBox, err)
+
+	_, otherPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	other, err := Ed25519PrivateKeyToX25519(otherPriv)
+	require.NoError(t, err)
+	_, err = Open(other, sealed)
+	assert.Equal(t, ErrSealedBox, err)
+
+	_, err = Open(xPriv, "dG9vIHNob3J0")
+	assert.Equal(t, ErrSealedBox, err)
+	assert.False(t, IsSealed("plain text"))
+}
+
+func TestReplyKey(t *testing.T) {
+	replyKey, encoded, err := GenerateReplyKey()
+	require.NoError(t, err)
+
+	public, err := ParseReplyKey(encoded)
+	require.NoError(t, err)
+	sealed, err := Seal(public, []byte("yes"))
+	require.NoError(t, err)
+
+	response, err := OpenReply(replyKey, sealed)
+	require.NoError(t, err)
+	assert.Equal(t, "yes", response)
+}
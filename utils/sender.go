@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// senderVersion prefixes every prompt signature so it cannot be replayed as
+// a receipt or CSRF challenge, or the other way round.
+const senderVersion = "prompt-sender-v1"
+
+// Sender is a poster's signature over the prompt it posts. It tells the
+// recipients who is asking.
+type Sender struct {
+	PublicKey string `json:"public_key"` // Base64 encoded Ed25519 public key
+	Signature string `json:"signature"`  // Base64 encoded Ed25519 signature of SenderPayload
+	Timestamp int64  `json:"timestamp"`  // Unix seconds
+}
+
+// SenderPayload returns the canonical bytes a poster signs: the version,
+// timestamp, recipient keys separated by commas and message hash on a line
+// each. The recipients are listed as in the request, public_key first.
+func SenderPayload(timestamp int64, recipients []string, message string) []byte {
+	return []byte(senderVersion + "\n" +
+		strconv.FormatInt(timestamp, 10) + "\n" +
+		strings.Join(recipients, ",") + "\n" +
+		HashMessage(message))
+}
+
+// Verify checks that the sender signed message for recipients.
+func (s *Sender) Verify(recipients []string, message string) error {
+	return VerifySignature(s.PublicKey, SenderPayload(s.Timestamp, recipients, message), s.Signature)
+}
+
+// HashPublicKey returns the hex encoded SHA-256 of a base64 encoded public
+// key, the same hash that identifies a key in API paths.
+func HashPublicKey(publicKey string) string {
+	hash := sha256.Sum256([]byte(publicKey))
+	return hex.EncodeToString(hash[:])
+}
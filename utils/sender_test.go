@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSenderPayload(t *testing.T) {
+	payload := SenderPayload(42, []string{"a", "b"}, "Deploy?")
+	assert.Equal(t, "prompt-sender-v1\n42\na,b\n"+HashMessage("Deploy?"), string(payload))
+}
+
+func TestSenderVerify(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	recipients := []string{"recipient"}
+	sender := &Sender{
+		PublicKey: base64.StdEncoding.EncodeToString(pub),
+		Timestamp: 1700000000,
+	}
+	sender.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(priv, SenderPayload(sender.Timestamp, recipients, "Deploy?")))
+
+	assert.NoError(t, sender.Verify(recipients, "Deploy?"))
+
+	// The signature does not carry over to another message, recipient or time
+	assert.True(t, errors.Is(sender.Verify(recipients, "Delete everything?"), ErrInvalidSignature))
+	assert.True(t, errors.Is(sender.Verify([]string{"someone else"}, "Deploy?"), ErrInvalidSignature))
+	later := *sender
+	later.Timestamp++
+	assert.True(t, errors.Is(later.Verify(recipients, "Deploy?"), ErrInvalidSignature))
+
+	malformed := *sender
+	malformed.PublicKey = "not a key"
+	assert.True(t, errors.Is(malformed.Verify(recipients, "Deploy?"), ErrMalformedSignature))
+}
+
+func TestHashPublicKey(t *testing.T) {
+	assert.Equal(t, HashMessage("key"), HashPublicKey("key"))
+	assert.Len(t, HashPublicKey("key"), 64)
+}
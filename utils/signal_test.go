@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -42,3 +43,35 @@ func TestSignalMultipleWaits(t *testing.T) {
 		// Expected: Wait() blocked as expected
 	}
 }
+
+func TestSignalOnlyFirstIsDelivered(t *testing.T) {
+	signal := NewSignal()
+
+	done := make(chan bool)
+	go func() {
+		signal.Signal("first response")
+		signal.Signal("second response") // Must not block
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Second Signal() blocked")
+	}
+	assert.Equal(t, "first response", signal.Wait())
+}
+
+func TestSignalWaitContext(t *testing.T) {
+	signal := NewSignal()
+	signal.Signal("response")
+
+	result, err := signal.WaitContext(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "response", result)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = signal.WaitContext(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
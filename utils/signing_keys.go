@@ -0,0 +1,209 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ErrUnknownKey is returned for tokens signed by a key the server does not
+// have, or no longer accepts.
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// signingKey is one of the keys tokens are signed with. Tokens name their
+// key in the kid header.
+type signingKey struct {
+	ID      string    `json:"kid"`
+	Secret  []byte    `json:"secret"`
+	Created time.Time `json:"created"`
+	// Retired is when a newer key took over. The key still verifies tokens
+	// for a while after that, so nobody is logged out by a rotation.
+	Retired time.Time `json:"retired,omitempty"`
+
+	// challengeSecret signs proof-of-work challenges. It is derived from
+	// the secret, so a challenge is never accepted as a CSRF token or the
+	// other way round.
+	challengeSecret []byte
+}
+
+func newSigningKey(id string, secret []byte, created time.Time) *signingKey {
+	key := &signingKey{ID: id, Secret: secret, Created: created}
+	key.derive()
+	return key
+}
+
+func (k *signingKey) derive() {
+	mac := hmac.New(sha256.New, k.Secret)
+	mac.Write([]byte(proofOfWorkVersion))
+	k.challengeSecret = mac.Sum(nil)
+}
+
+// staticKey returns the key for a configured secret. Its id is derived from
+// the secret, so it stays the same across restarts.
+func staticKey(secret string) *signingKey {
+	hash := sha256.Sum256([]byte(secret))
+	return newSigningKey(hex.EncodeToString(hash[:8]), []byte(secret), time.Now())
+}
+
+// generateKey returns a new random key.
+func generateKey() (*signingKey, error) {
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return newSigningKey(hex.EncodeToString(id), secret, time.Now()), nil
+}
+
+// keyFile is how signing keys are kept on disk.
+type keyFile struct {
+	Keys []*signingKey `json:"keys"`
+}
+
+// loadKeys reads the keys kept at path. A missing file holds no keys.
+func loadKeys(path string) ([]*signingKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file keyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("signing keys %s: %w", path, err)
+	}
+	for _, key := range file.Keys {
+		if key.ID == "" || len(key.Secret) < 32 {
+			return nil, fmt.Errorf("signing keys %s: key %q is incomplete", path, key.ID)
+		}
+		key.derive()
+	}
+	return file.Keys, nil
+}
+
+// saveKeys replaces the keys kept at path. The file is written next to it
+// and renamed, so a crash never leaves half a file behind.
+func saveKeys(path string, keys []*signingKey) error {
+	data, err := json.MarshalIndent(keyFile{Keys: keys}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Rotate makes a new key the signing key. Tokens signed by the previous
+// keys keep verifying until they would have expired anyway. With a key file
+// the new key is saved before it is used. Returns the id of the new key.
+func (i *TokenIssuer) Rotate() (string, error) {
+	key, err := generateKey()
+	if err != nil {
+		return "", err
+	}
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	now := time.Now()
+	keys := make([]*signingKey, 0, len(i.keys)+1)
+	for _, old := range i.keys {
+		if i.expired(old, now) {
+			continue
+		}
+		retired := *old
+		if retired.Retired.IsZero() {
+			retired.Retired = now
+		}
+		keys = append(keys, &retired)
+	}
+	keys = append(keys, key)
+	if i.path != "" {
+		if err := saveKeys(i.path, keys); err != nil {
+			return "", err
+		}
+	}
+	i.keys = keys
+	return key.ID, nil
+}
+
+// KeyIDs returns the ids of the keys tokens are accepted from, the signing
+// key last.
+func (i *TokenIssuer) KeyIDs() []string {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	now := time.Now()
+	ids := make([]string, 0, len(i.keys))
+	for _, key := range i.keys {
+		if !i.expired(key, now) {
+			ids = append(ids, key.ID)
+		}
+	}
+	return ids
+}
+
+// expired reports whether a retired key stopped verifying tokens.
+func (i *TokenIssuer) expired(key *signingKey, now time.Time) bool {
+	return !key.Retired.IsZero() && now.After(key.Retired.Add(i.window))
+}
+
+// signingKey returns the key new tokens are signed with.
+func (i *TokenIssuer) signingKey() *signingKey {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	return i.keys[len(i.keys)-1]
+}
+
+// verificationKey returns the key named by the kid header of token.
+func (i *TokenIssuer) verificationKey(token *jwt.Token) (*signingKey, error) {
+	id, _ := token.Header["kid"].(string)
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	for _, key := range i.keys {
+		if key.ID == id {
+			if i.expired(key, time.Now()) {
+				break
+			}
+			return key, nil
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+// sign returns token signed by the signing key, with its kid header set.
+func (i *TokenIssuer) sign(claims jwt.Claims, challenge bool) (string, error) {
+	key := i.signingKey()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = key.ID
+	if challenge {
+		return token.SignedString(key.challengeSecret)
+	}
+	return token.SignedString(key.Secret)
+}
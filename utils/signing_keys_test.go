@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"prompt-service-server/config"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenIssuer_KeyID(t *testing.T) {
+	issuer := newTestIssuer()
+	token, err := issuer.GenerateCSRFToken("hash")
+	require.NoError(t, err)
+
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, &Claims{})
+	require.NoError(t, err)
+	assert.Equal(t, issuer.KeyIDs()[0], parsed.Header["kid"])
+
+	// The key of a configured secret keeps its id across restarts
+	assert.Equal(t, issuer.KeyIDs(), newTestIssuer().KeyIDs())
+
+	// Without a secret every issuer has a key of its own
+	assert.NotEqual(t, NewTokenIssuer(config.Default()).KeyIDs(), NewTokenIssuer(config.Default()).KeyIDs())
+}
+
+func TestTokenIssuer_Rotate(t *testing.T) {
+	issuer := newTestIssuer()
+	before, err := issuer.GenerateCSRFToken("hash")
+	require.NoError(t, err)
+	challenge, _, err := issuer.GenerateChallenge(0)
+	require.NoError(t, err)
+
+	id, err := issuer.Rotate()
+	require.NoError(t, err)
+	ids := issuer.KeyIDs()
+	require.Len(t, ids, 2)
+	assert.Equal(t, id, ids[1])
+
+	// Tokens of the previous key still verify during the rotation window
+	after, err := issuer.GenerateCSRFToken("hash")
+	require.NoError(t, err)
+	assert.NoError(t, issuer.VerifyJWT(before))
+	assert.NoError(t, issuer.VerifyJWT(after))
+	_, err = issuer.VerifyProofOfWork(challenge, "Deploy?", "0", 0)
+	assert.NoError(t, err)
+
+	// and not after it
+	issuer.keys[0].Retired = time.Now().Add(-issuer.window - time.Second)
+	assert.True(t, errors.Is(issuer.VerifyJWT(before), ErrUnknownKey))
+	assert.NoError(t, issuer.VerifyJWT(after))
+	assert.Equal(t, []string{id}, issuer.KeyIDs())
+
+	// A later rotation drops the expired key for good
+	_, err = issuer.Rotate()
+	require.NoError(t, err)
+	assert.Len(t, issuer.KeyIDs(), 2)
+	assert.Len(t, issuer.keys, 2)
+
+	// Another server's tokens do not name a key this one has
+	other, err := NewTokenIssuer(config.Default()).GenerateCSRFToken("hash")
+	require.NoError(t, err)
+	assert.True(t, errors.Is(issuer.VerifyJWT(other), ErrUnknownKey))
+}
+
+func TestOpenTokenIssuer_KeyFile(t *testing.T) {
+	cfg := config.Default()
+	cfg.CSRFKeyFile = filepath.Join(t.TempDir(), "csrf-keys.json")
+
+	// A key is generated and saved on first start
+	issuer, err := OpenTokenIssuer(cfg)
+	require.NoError(t, err)
+	token, err := issuer.GenerateCSRFToken("hash")
+	require.NoError(t, err)
+	info, err := os.Stat(cfg.CSRFKeyFile)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// and used after a restart, as is a rotation
+	restarted, err := OpenTokenIssuer(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, issuer.KeyIDs(), restarted.KeyIDs())
+	assert.NoError(t, restarted.VerifyJWT(token))
+
+	id, err := restarted.Rotate()
+	require.NoError(t, err)
+	restarted, err = OpenTokenIssuer(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, []string{issuer.KeyIDs()[0], id}, restarted.KeyIDs())
+	assert.NoError(t, restarted.VerifyJWT(token))
+
+	// A broken key file is an error rather than a silent new key
+	require.NoError(t, os.WriteFile(cfg.CSRFKeyFile, []byte("{"), 0600))
+	_, err = OpenTokenIssuer(cfg)
+	assert.Error(t, err)
+}
@@ -0,0 +1,29 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateToken(t *testing.T) {
+	token, err := GenerateToken()
+	require.NoError(t, err)
+	assert.Len(t, token, 43)
+
+	other, err := GenerateToken()
+	require.NoError(t, err)
+	assert.NotEqual(t, token, other)
+}
+
+func TestVerifyToken(t *testing.T) {
+	token, err := GenerateToken()
+	require.NoError(t, err)
+	hash := HashToken(token)
+
+	assert.True(t, VerifyToken(token, hash))
+	assert.False(t, VerifyToken("wrong", hash))
+	assert.False(t, VerifyToken("", ""))
+	assert.False(t, VerifyToken(token, ""))
+}
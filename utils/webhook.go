@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// WebhookSignatureHeader carries the signature of a webhook delivery.
+const WebhookSignatureHeader = "X-Prompt-Signature"
+
+// SignWebhook returns the signature header value for a webhook body: the
+// Unix timestamp and the hex encoded HMAC-SHA256 of "<timestamp>.<body>".
+func SignWebhook(secret string, timestamp time.Time, body []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+	return "t=" + t + ",v1=" + webhookMAC(secret, t, body)
+}
+
+// VerifyWebhook checks a signature header produced by SignWebhook. Posters
+// use it to make sure a delivery came from the server and is recent; a zero
+// tolerance skips the age check.
+func VerifyWebhook(secret string, header string, body []byte, tolerance time.Duration) error {
+	var timestamp, signature string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signature = value
+		}
+	}
+	if timestamp == "" || signature == "" {
+		return errors.New("malformed webhook signature")
+	}
+	if !hmac.Equal([]byte(signature), []byte(webhookMAC(secret, timestamp, body))) {
+		return ErrInvalidSignature
+	}
+	if tolerance > 0 {
+		seconds, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return errors.New("malformed webhook signature")
+		}
+		if age := time.Since(time.Unix(seconds, 0)); age > tolerance || age < -tolerance {
+			return errors.New("webhook signature is too old")
+		}
+	}
+	return nil
+}
+
+func webhookMAC(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ErrNonPublicAddress is returned for webhooks to an address that is not on
+// the public internet, such as the server's own network.
+var ErrNonPublicAddress = errors.New("address is not public")
+
+// reservedPrefixes are ranges that are global unicast by the netip tests
+// but do not lead to the public internet, or can be made to lead back into
+// a private network.
+var reservedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // This network
+	netip.MustParsePrefix("100.64.0.0/10"),  // Carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),   // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"),  // Benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),    // Reserved
+	netip.MustParsePrefix("64:ff9b::/96"),   // NAT64
+	netip.MustParsePrefix("64:ff9b:1::/48"), // Local NAT64
+	netip.MustParsePrefix("2002::/16"),      // 6to4
+}
+
+// IsPublicAddress reports whether ip is on the public internet rather than
+// loopback, private, link-local, multicast or otherwise reserved.
+func IsPublicAddress(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, prefix := range reservedPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// RefuseNonPublic is a net.Dialer Control function that refuses to connect
+// to addresses IsPublicAddress rejects. It runs after the host name was
+// resolved, so names that resolve to internal addresses are refused too.
+func RefuseNonPublic(network string, address string, _ syscall.RawConn) error {
+	addr, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !IsPublicAddress(addr.Addr()) {
+		return fmt.Errorf("%s: %w", address, ErrNonPublicAddress)
+	}
+	return nil
+}
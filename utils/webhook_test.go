@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignAndVerifyWebhook(t *testing.T) {
+	body := []byte(`{"id":"1","status":"answered"}`)
+	header := SignWebhook("secret", time.Now(), body)
+	assert.True(t, strings.HasPrefix(header, "t="))
+
+	assert.NoError(t, VerifyWebhook("secret", header, body, time.Minute))
+	assert.Equal(t, ErrInvalidSignature, VerifyWebhook("other", header, body, time.Minute))
+	assert.Equal(t, ErrInvalidSignature, VerifyWebhook("secret", header, []byte(`{}`), time.Minute))
+	assert.Error(t, VerifyWebhook("secret", "garbage", body, time.Minute))
+
+	old := SignWebhook("secret", time.Now().Add(-time.Hour), body)
+	assert.Error(t, VerifyWebhook("secret", old, body, time.Minute))
+	assert.NoError(t, VerifyWebhook("secret", old, body, 0))
+}
+
+func TestIsPublicAddress(t *testing.T) {
+	for _, ip := range []string{"93.184.216.34", "2606:2800:220:1:248:1893:25c8:1946", "::ffff:93.184.216.34"} {
+		assert.True(t, IsPublicAddress(netip.MustParseAddr(ip)), ip)
+	}
+	for _, ip := range []string{
+		"127.0.0.1", "::1", "0.0.0.0", "::", "10.1.2.3", "172.16.0.1", "192.168.1.1",
+		"169.254.169.254", "fe80::1", "fd00::1", "100.64.0.1", "224.0.0.1",
+		"255.255.255.255", "::ffff:127.0.0.1", "64:ff9b::a00:1", "2002:a00:1::1",
+	} {
+		assert.False(t, IsPublicAddress(netip.MustParseAddr(ip)), ip)
+	}
+
+	assert.NoError(t, RefuseNonPublic("tcp4", "93.184.216.34:443", nil))
+	err := RefuseNonPublic("tcp4", "169.254.169.254:80", nil)
+	assert.True(t, errors.Is(err, ErrNonPublicAddress))
+}